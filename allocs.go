@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime/metrics"
+	"time"
+)
+
+// allocationReport prints how many heap allocations the game makes per frame,
+// once a second. Run the game with -allocs to check that playing a level does
+// not allocate, allocations in the frame loop lead to GC hitches.
+//
+// It counts the allocations of all goroutines, so the sound mixer and the
+// network also show up here.
+type allocationReport struct {
+	// We read runtime/metrics instead of runtime.ReadMemStats because that
+	// stops the world, which would cause the very hitches we look for.
+	samples    [2]metrics.Sample
+	last       uint64
+	frames     int
+	lastReport time.Time
+}
+
+func newAllocationReport() *allocationReport {
+	r := &allocationReport{lastReport: time.Now()}
+	r.samples[0].Name = "/gc/heap/allocs:objects"
+	// Tiny allocations, small objects without pointers, are counted
+	// separately.
+	r.samples[1].Name = "/gc/heap/tiny/allocs:objects"
+	r.last = r.total()
+	return r
+}
+
+func (r *allocationReport) total() uint64 {
+	metrics.Read(r.samples[:])
+	var n uint64
+	for _, s := range r.samples {
+		if s.Value.Kind() == metrics.KindUint64 {
+			n += s.Value.Uint64()
+		}
+	}
+	return n
+}
+
+// frameDone is called at the end of every frame.
+func (r *allocationReport) frameDone(now time.Time) {
+	r.frames++
+	if now.Sub(r.lastReport) < time.Second {
+		return
+	}
+	total := r.total()
+	fmt.Fprintf(
+		os.Stderr,
+		"allocations per frame: %.1f\n",
+		float64(total-r.last)/float64(r.frames),
+	)
+	r.last = total
+	r.frames = 0
+	r.lastReport = now
+}
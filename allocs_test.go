@@ -0,0 +1,125 @@
+//go:build windows
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	m "github.com/gonutz/d3dmath/column_major/d3dmath"
+)
+
+// nullRenderer accepts all calls without rendering anything.
+type nullRenderer struct{}
+
+func (nullRenderer) createTexture(int, int, []byte) (textureHandle, error) { return 1, nil }
+func (nullRenderer) releaseTexture(textureHandle)                          {}
+func (nullRenderer) createMesh([]float32, []uint32) (meshHandle, error)    { return 1, nil }
+func (nullRenderer) createDynamicMesh(int) (meshHandle, error)             { return 1, nil }
+func (nullRenderer) updateMesh(meshHandle, int, []float32) error           { return nil }
+func (nullRenderer) releaseMesh(meshHandle)                                {}
+func (nullRenderer) meshMemory() (int, int)                                { return 0, 0 }
+func (nullRenderer) beginFrame(uint8) error                                { return nil }
+func (nullRenderer) endFrame() error                                       { return nil }
+func (nullRenderer) restore() error                                        { return nil }
+func (nullRenderer) setDisplayMode(displayMode) error                      { return nil }
+func (nullRenderer) setViewport(float32, float32, float32, float32) error  { return nil }
+func (nullRenderer) setLight(*lightingPreset) error                        { return nil }
+func (nullRenderer) setColor(m.Vec4) error                                 { return nil }
+func (nullRenderer) setMaterial(material) error                            { return nil }
+func (nullRenderer) setTexture(textureHandle) error                        { return nil }
+func (nullRenderer) setTransform(m.Mat4, m.Mat4) error                     { return nil }
+func (nullRenderer) drawMesh(meshHandle, int, int) error                   { return nil }
+func (nullRenderer) beginHUD(float32, float32) error                       { return nil }
+func (nullRenderer) drawHUD(textureHandle, []float32) error                { return nil }
+func (nullRenderer) endHUD() error                                         { return nil }
+func (nullRenderer) close()                                                {}
+
+// TestFrameDoesNotAllocate formats and draws a HUD like the one while playing
+// a level and submits it, together with some level geometry. Once the buffers
+// have grown in the first frame, a frame must not allocate.
+func TestFrameDoesNotAllocate(t *testing.T) {
+	gfx := nullRenderer{}
+	h := &hud{gfx: gfx}
+	overlay := newStatsOverlay()
+	var buf []byte
+	white := m.Vec4{1, 1, 1, 1}
+	frame := 0
+	allocs := testing.AllocsPerRun(100, func() {
+		frame++
+		buf = append(buf[:0], "Time "...)
+		buf = appendLevelTime(buf, time.Duration(frame)*time.Second/60)
+		h.textBytes(10, 10, 32, buf, white)
+		buf = appendMilliseconds(buf[:0], time.Duration(frame)*time.Microsecond)
+		h.textBytes(10, 50, 32, buf, white)
+		h.text(10, 90, 32, "Collect all the jokers!", white)
+		h.rect(0, 0, 200, 40, m.Vec4{0, 0, 0, 0.5})
+		h.sprite(spriteCircle, 300, 10, 120, 40, white)
+		h.image(1, 500, 10, 64, 64, [4][2]float32{{0, 0}, {1, 0}, {0, 1}, {1, 1}})
+		overlay.draw(h, overlayStats{meshes: 3, activeSounds: 2})
+
+		if err := drawTriangles(gfx, 1, 0, 1000); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.draw(1280, 720); err != nil {
+			t.Fatal(err)
+		}
+		publishFrameCounters(16*time.Millisecond, 0)
+	})
+	if allocs > 0 {
+		t.Errorf("a frame makes %v allocations, want 0", allocs)
+	}
+}
+
+// TestLevelDrawDoesNotAllocate draws a level with everything in it, for two
+// players and a remote one. Drawing the level must not allocate, it runs once
+// per player in every frame.
+func TestLevelDrawDoesNotAllocate(t *testing.T) {
+	l := allLevels[1]
+	l.npcs = []npc{{tile: tilePos{8, 8}, rot: 0.25}}
+	part := modelPart{firstVertex: 0, endVertex: 3 * float32sPerTexturedVertex}
+	limb := func(name string) modelPart {
+		p := part
+		p.name = name
+		return p
+	}
+	s := levelScene{
+		mesh:         1,
+		levelTexture: 1,
+		whiteTexture: 2,
+		jokerTexture: 3,
+		levelModel:   model{part},
+		gem:          model{part},
+		box:          model{part},
+		tile:         model{part},
+		joker: model{
+			limb("body"),
+			limb("leftLeg"), limb("rightLeg"),
+			limb("leftArm"), limb("rightArm"),
+			limb("leftHand"), limb("rightHand"),
+		},
+		props:         map[string]model{"ramp": {part}},
+		jokerArmJoint: m.Vec3{0, 1.5, 0},
+		jokerLegJoint: m.Vec3{0, 0.8, 0},
+		level:         &l,
+		collected:     make([]bool, len(l.collectibles)),
+		pickedUp:      make([]bool, len(l.items)),
+		doorOpen:      make([]bool, len(l.doors)),
+		teleportUsed:  make([]bool, len(l.teleports)),
+		jokers:        []joker{{pos: l.jokerStart}, {pos: l.jokerStart}},
+		showRemote:    true,
+		brightness:    1,
+		light:         &lightingPresets[lightingNoon],
+		fieldOfView:   60,
+	}
+	view := m.LookAt(m.Vec3{5, 10, 5}, l.jokerStart, m.Vec3{0, 1, 0})
+	allocs := testing.AllocsPerRun(100, func() {
+		s.spin += 0.01
+		if err := drawLevel(nullRenderer{}, &s, view, 16.0/9); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs > 0 {
+		t.Errorf("drawing a level makes %v allocations, want 0", allocs)
+	}
+}
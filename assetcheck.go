@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/gonutz/obj"
+)
+
+// validateAssets decodes every file in the assets directory the way the game
+// would load it. Instead of stopping at the first broken file, it collects all
+// problems into one error with a line per file, so after a big asset change we
+// see everything that needs fixing at once. It returns nil if all assets are
+// fine.
+//
+// Shaders are not checked here, they need the Direct3D device to compile.
+func validateAssets(fsys fs.FS) error {
+	var problems []error
+	report := func(path string, err error) {
+		problems = append(problems, fmt.Errorf("%s: %w", path, err))
+	}
+
+	err := fs.WalkDir(fsys, "assets", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			report(p, err)
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		ext := strings.ToLower(path.Ext(p))
+		if !isValidatedAsset(ext) {
+			return nil
+		}
+		data, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			report(p, err)
+			return nil
+		}
+		if err := validateAsset(p, ext, data); err != nil {
+			report(p, err)
+		}
+		return nil
+	})
+	if err != nil {
+		problems = append(problems, err)
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d broken assets\n%w", len(problems), errors.Join(problems...))
+}
+
+func isValidatedAsset(ext string) bool {
+	switch ext {
+	case ".jpg", ".jpeg", ".png", ".obj", ".ogg", ".mp3", ".raw", ".json":
+		return true
+	}
+	return false
+}
+
+func validateAsset(p, ext string, data []byte) error {
+	switch ext {
+	case ".jpg", ".jpeg", ".png":
+		_, err := decodeRGBA(data)
+		return err
+	case ".obj":
+		// Validate checks that all face indices refer to existing vertices,
+		// texture coordinates and normals.
+		_, err := obj.DecodeWithOptions(
+			bytes.NewReader(data),
+			obj.DecodeOptions{Validate: true},
+		)
+		return err
+	case ".ogg", ".mp3", ".raw":
+		_, err := decodeSound(p, data)
+		return err
+	case ".json":
+		if p == "assets/dialogue.json" {
+			_, err := parseDialogues(data)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,303 @@
+// Package assetpack reads and writes asset packs, archives of compressed
+// files. A pack starts with the magic bytes "ASSETPK1" and the number of
+// files, followed by an index entry per file and then the file data. All
+// numbers are little-endian uint32.
+//
+// An index entry is the length of the file name, the name itself, the offset
+// of the file's data relative to the end of the index, the size of the
+// compressed data and the size of the uncompressed file. The data is
+// compressed with DEFLATE.
+package assetpack
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+const magic = "ASSETPK1"
+
+// File is a file to be written into a pack. Its Name is the path that is
+// used to open it from the pack, with forward slashes, e.g. "assets/joker.obj".
+type File struct {
+	Name string
+	Data []byte
+}
+
+// Write compresses the files into a pack.
+func Write(w io.Writer, files []File) error {
+	var data bytes.Buffer
+	type entry struct {
+		name                   string
+		offset, packed, length uint32
+	}
+	entries := make([]entry, 0, len(files))
+	for _, f := range files {
+		if !fs.ValidPath(f.Name) {
+			return fmt.Errorf("assetpack: invalid file name %q", f.Name)
+		}
+		start := data.Len()
+		compressor, err := flate.NewWriter(&data, flate.BestCompression)
+		if err != nil {
+			return err
+		}
+		if _, err := compressor.Write(f.Data); err != nil {
+			return err
+		}
+		if err := compressor.Close(); err != nil {
+			return err
+		}
+		entries = append(entries, entry{
+			name:   f.Name,
+			offset: uint32(start),
+			packed: uint32(data.Len() - start),
+			length: uint32(len(f.Data)),
+		})
+	}
+
+	var index bytes.Buffer
+	index.WriteString(magic)
+	binary.Write(&index, binary.LittleEndian, uint32(len(entries)))
+	for _, e := range entries {
+		binary.Write(&index, binary.LittleEndian, uint32(len(e.name)))
+		index.WriteString(e.name)
+		binary.Write(&index, binary.LittleEndian, [3]uint32{e.offset, e.packed, e.length})
+	}
+
+	if _, err := w.Write(index.Bytes()); err != nil {
+		return err
+	}
+	_, err := w.Write(data.Bytes())
+	return err
+}
+
+// Pack is an opened asset pack. It implements fs.FS, files are decompressed
+// while reading them, so only the files that are used are ever decompressed
+// and opening a big file does not decompress all of it up front. ReadFile
+// decompresses the whole file at once.
+type Pack struct {
+	data    []byte
+	entries map[string]entry
+	// dirs are all directories that contain files, for ReadDir.
+	dirs map[string][]fs.DirEntry
+}
+
+type entry struct {
+	name   string
+	data   []byte
+	length int
+}
+
+var errCorrupt = errors.New("assetpack: corrupt pack")
+
+// maxRatio is the most that DEFLATE can compress: a 258 byte match takes at
+// least 2 bits. Sizes in the index that are larger than this are corrupt,
+// ReadFile would allocate them before finding out.
+const maxRatio = 1032
+
+// Open reads the index of a pack. The pack keeps a reference to data, which
+// must not be modified afterwards.
+func Open(data []byte) (*Pack, error) {
+	if !bytes.HasPrefix(data, []byte(magic)) {
+		return nil, errors.New("assetpack: not an asset pack")
+	}
+	r := bytes.NewReader(data[len(magic):])
+	var count uint32
+	if binary.Read(r, binary.LittleEndian, &count) != nil {
+		return nil, errCorrupt
+	}
+
+	type rawEntry struct {
+		name                   string
+		offset, packed, length uint32
+	}
+	raw := make([]rawEntry, 0, min(count, 1024))
+	for range count {
+		var nameLength uint32
+		if binary.Read(r, binary.LittleEndian, &nameLength) != nil ||
+			int64(nameLength) > int64(r.Len()) {
+			return nil, errCorrupt
+		}
+		name := make([]byte, nameLength)
+		io.ReadFull(r, name)
+		var sizes [3]uint32
+		if binary.Read(r, binary.LittleEndian, &sizes) != nil {
+			return nil, errCorrupt
+		}
+		raw = append(raw, rawEntry{string(name), sizes[0], sizes[1], sizes[2]})
+	}
+
+	fileData := data[len(data)-r.Len():]
+	p := &Pack{
+		data:    data,
+		entries: make(map[string]entry, len(raw)),
+		dirs:    map[string][]fs.DirEntry{},
+	}
+	for _, e := range raw {
+		end := uint64(e.offset) + uint64(e.packed)
+		if !fs.ValidPath(e.name) || end > uint64(len(fileData)) ||
+			uint64(e.length) > maxRatio*uint64(e.packed) {
+			return nil, errCorrupt
+		}
+		p.entries[e.name] = entry{
+			name:   e.name,
+			data:   fileData[e.offset:end],
+			length: int(e.length),
+		}
+		p.addToDir(e.name, fileInfo{name: path.Base(e.name), size: int64(e.length)})
+	}
+	for _, entries := range p.dirs {
+		slices.SortFunc(entries, func(a, b fs.DirEntry) int {
+			return strings.Compare(a.Name(), b.Name())
+		})
+	}
+	return p, nil
+}
+
+// addToDir adds the file or directory to its parent directory, creating all
+// parent directories on the way.
+func (p *Pack) addToDir(name string, info fileInfo) {
+	dir := path.Dir(name)
+	_, known := p.dirs[dir]
+	p.dirs[dir] = append(p.dirs[dir], fs.FileInfoToDirEntry(info))
+	if !known && dir != "." {
+		p.addToDir(dir, fileInfo{name: path.Base(dir), dir: true})
+	}
+}
+
+// ReadFile decompresses the named file.
+func (p *Pack) ReadFile(name string) ([]byte, error) {
+	e, ok := p.entries[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrNotExist}
+	}
+	data := make([]byte, e.length)
+	decompressor := flate.NewReader(bytes.NewReader(e.data))
+	defer decompressor.Close()
+	if _, err := io.ReadFull(decompressor, data); err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errCorrupt}
+	}
+	return data, nil
+}
+
+// ReadDir lists the files and directories in the named directory.
+func (p *Pack) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, ok := p.dirs[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	return slices.Clone(entries), nil
+}
+
+// Open implements fs.FS.
+func (p *Pack) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if entries, ok := p.dirs[name]; ok || name == "." {
+		// The dir hands out its entries, they must not be our index.
+		return &dir{
+			info:    fileInfo{name: path.Base(name), dir: true},
+			entries: slices.Clone(entries),
+		}, nil
+	}
+	e, ok := p.entries[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &file{
+		name:         name,
+		decompressor: flate.NewReader(bytes.NewReader(e.data)),
+		left:         e.length,
+		info:         fileInfo{name: path.Base(name), size: int64(e.length)},
+	}, nil
+}
+
+// file decompresses its data on the fly while it is read.
+type file struct {
+	name         string
+	decompressor io.ReadCloser
+	// left is the number of uncompressed bytes that were not read yet.
+	left int
+	info fileInfo
+}
+
+func (f *file) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *file) Close() error               { return f.decompressor.Close() }
+
+func (f *file) Read(b []byte) (int, error) {
+	if f.left == 0 {
+		return 0, io.EOF
+	}
+	if len(b) > f.left {
+		b = b[:f.left]
+	}
+	n, err := f.decompressor.Read(b)
+	f.left -= n
+	if err == io.EOF {
+		if f.left > 0 {
+			// The compressed data ends before the size in the index.
+			return n, &fs.PathError{Op: "read", Path: f.name, Err: errCorrupt}
+		}
+		err = nil
+	}
+	if err != nil {
+		return n, &fs.PathError{Op: "read", Path: f.name, Err: errCorrupt}
+	}
+	return n, nil
+}
+
+type dir struct {
+	info fileInfo
+	// entries are the ones that ReadDir did not return yet.
+	entries []fs.DirEntry
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *dir) Close() error               { return nil }
+func (d *dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errors.New("is a directory")}
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	entries := d.entries[:n:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+type fileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (i fileInfo) Name() string       { return i.name }
+func (i fileInfo) Size() int64        { return i.size }
+func (i fileInfo) ModTime() time.Time { return time.Time{} }
+func (i fileInfo) IsDir() bool        { return i.dir }
+func (i fileInfo) Sys() any           { return nil }
+
+func (i fileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
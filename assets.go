@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"time"
+
+	"github.com/gonutz/go_game_demo/assetpack"
+)
+
+// assets is where we read all asset files from. Release builds use the asset
+// pack embedded into the executable, see release.go. Dev builds read the files
+// from disk so they can be changed while the game is running, see dev.go.
+var assets fs.FS
+
+func readAsset(path string) ([]byte, error) {
+	return fs.ReadFile(assets, path)
+}
+
+// withExternalPacks loads the asset pack files and puts them on top of base.
+// Files in the packs replace the ones in base, later packs win.
+func withExternalPacks(base fs.FS, packPaths []string) (fs.FS, error) {
+	layers := overlayFS{base}
+	for _, p := range packPaths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		pack, err := assetpack.Open(data)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, pack)
+	}
+	if len(layers) == 1 {
+		return base, nil
+	}
+	return layers, nil
+}
+
+// overlayFS opens files from the last layer that has them.
+type overlayFS []fs.FS
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	for i := len(o) - 1; i > 0; i-- {
+		f, err := o[i].Open(name)
+		if !errors.Is(err, fs.ErrNotExist) {
+			return f, err
+		}
+	}
+	return o[0].Open(name)
+}
+
+// ReadFile reads the file from the last layer that has it. This lets asset
+// packs decompress the file in one go instead of streaming it through Open.
+func (o overlayFS) ReadFile(name string) ([]byte, error) {
+	for i := len(o) - 1; i > 0; i-- {
+		data, err := fs.ReadFile(o[i], name)
+		if !errors.Is(err, fs.ErrNotExist) {
+			return data, err
+		}
+	}
+	return fs.ReadFile(o[0], name)
+}
+
+// assetWatcher polls the files in a directory and reports the ones that
+// changed since the last check.
+type assetWatcher struct {
+	dir       string
+	modTimes  map[string]time.Time
+	lastCheck time.Time
+}
+
+// assetPollInterval keeps us from hitting the disk every frame.
+const assetPollInterval = 500 * time.Millisecond
+
+func newAssetWatcher(dir string) *assetWatcher {
+	w := &assetWatcher{dir: dir, modTimes: map[string]time.Time{}}
+	w.changes(time.Now())
+	return w
+}
+
+// changes returns the paths of all files that were created or modified since
+// the last call. The paths start with the watched directory, e.g.
+// "assets/joker.jpg", like the paths we use to read assets.
+func (w *assetWatcher) changes(now time.Time) []string {
+	if now.Sub(w.lastCheck) < assetPollInterval {
+		return nil
+	}
+	w.lastCheck = now
+
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return nil
+	}
+
+	var changed []string
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		p := path.Join(w.dir, e.Name())
+		last, known := w.modTimes[p]
+		if !info.ModTime().Equal(last) {
+			w.modTimes[p] = info.ModTime()
+			if known {
+				changed = append(changed, p)
+			}
+		}
+	}
+	return changed
+}
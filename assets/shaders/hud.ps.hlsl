@@ -0,0 +1,14 @@
+sampler font;
+
+struct input {
+	float2 uv: TEXCOORD0;
+	float4 color: COLOR0;
+};
+
+struct output {
+	float4 color: COLOR0;
+};
+
+void main(in input IN, out output OUT) {
+	OUT.color = IN.color * tex2D(font, IN.uv);
+}
@@ -0,0 +1,22 @@
+float4 screenSize;
+
+struct input {
+	float2 position: POSITION;
+	float2 uv: TEXCOORD0;
+	float4 color: COLOR0;
+};
+
+struct output {
+	float4 position: POSITION;
+	float2 uv: TEXCOORD0;
+	float4 color: COLOR0;
+};
+
+void main(in input IN, out output OUT) {
+	// Go from pixels to clip space, Y points down in pixels but up in clip
+	// space.
+	float2 p = IN.position / screenSize.xy;
+	OUT.position = float4(2 * p.x - 1, 1 - 2 * p.y, 0, 1);
+	OUT.uv = IN.uv;
+	OUT.color = IN.color;
+}
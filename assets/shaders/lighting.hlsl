@@ -0,0 +1,36 @@
+// lighting returns how much light falls onto a surface point at pos, in view
+// space, with the given normal. lightColor is the color of the directional
+// light, ambientColor that of the light that falls onto all surfaces equally.
+// lightParameters is (specular strength, specular exponent, ambient strength,
+// emissive). Emissive objects glow by themselves, at 1 they are not lit at
+// all.
+//
+// For an explanation of this lighting model, see
+// https://learnopengl.com/Lighting/Basic-Lighting
+float4 lighting(
+	float3 normal,
+	float3 pos,
+	float3 lightDirection,
+	float4 lightColor,
+	float4 ambientColor,
+	float4 lightParameters
+) {
+	float3 norm = normalize(normal);
+
+	float ambientStrength = lightParameters.z;
+	float4 ambient = ambientStrength * ambientColor;
+
+	float3 lightDir = -normalize(lightDirection);
+	float diff = max(0, dot(norm, lightDir));
+	float4 diffuse = diff * lightColor;
+
+	float specularStrength = lightParameters.x;
+	float3 viewPos = float3(0, 0, 0);
+	float3 viewDir = normalize(viewPos - pos);
+	float3 reflectDir = reflect(-lightDir, norm);
+	float spec = pow(max(0, dot(viewDir, reflectDir)), lightParameters.y);
+	float4 specular = specularStrength * spec * lightColor;
+
+	float4 lit = min(1, ambient + diffuse + specular);
+	return lerp(lit, float4(1, 1, 1, 1), lightParameters.w);
+}
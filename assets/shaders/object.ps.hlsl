@@ -0,0 +1,37 @@
+#include "lighting.hlsl"
+
+float4 colorFactor;
+float4 lightDirection;
+float4 lightColor;
+float4 ambientColor;
+// lightParameters is (specular strength, specular exponent, ambient strength,
+// emissive).
+float4 lightParameters;
+
+sampler img;
+
+struct input {
+	float3 normal: NORMAL;
+	float2 uv: TEXCOORD0;
+	float4 worldPosition: TEXCOORD1;
+	// color is the vertex color, it tints the texture.
+	float4 color: COLOR0;
+};
+
+struct output {
+	float4 color: COLOR0;
+};
+
+void main(in input IN, out output OUT) {
+	float4 objectColor = tex2D(img, IN.uv) * IN.color;
+	float3 pos = IN.worldPosition.xyz / IN.worldPosition.w;
+	float4 light = lighting(
+		IN.normal,
+		pos,
+		lightDirection.xyz,
+		lightColor,
+		ambientColor,
+		lightParameters
+	);
+	OUT.color = light * objectColor * colorFactor;
+}
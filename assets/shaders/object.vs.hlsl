@@ -0,0 +1,25 @@
+float4x4 mvp;
+float4x4 normalTransform;
+
+struct input {
+	float4 position: POSITION;
+	float3 normal: NORMAL;
+	float2 uv: TEXCOORD0;
+	float4 color: COLOR0;
+};
+
+struct output {
+	float4 position: POSITION;
+	float3 normal: NORMAL;
+	float2 uv: TEXCOORD0;
+	float4 worldPosition: TEXCOORD1;
+	float4 color: COLOR0;
+};
+
+void main(in input IN, out output OUT) {
+	OUT.position = mul(IN.position, mvp);
+	OUT.normal = mul(float4(IN.normal, 1), normalTransform).xyz;
+	OUT.uv = IN.uv;
+	OUT.worldPosition = OUT.position;
+	OUT.color = IN.color;
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	m "github.com/gonutz/d3dmath/column_major/d3dmath"
+	"github.com/gonutz/w32/v2"
+)
+
+// The game code talks to the platform through the three interfaces below. The
+// default implementations are Direct3D 9 for rendering, DirectSound for audio
+// and DirectInput plus XInput for input. Other backends, or mocks that record
+// calls instead of rendering, only need to implement these methods.
+
+// textureHandle and meshHandle identify the resources that a renderer created.
+// The zero handles are invalid.
+type textureHandle int
+
+const invalidTexture textureHandle = 0
+
+type meshHandle int
+
+const invalidMesh meshHandle = 0
+
+// renderer draws our lit 3D objects and the HUD. The shaders are the
+// renderer's business, the game only sets the light, materials and transforms.
+type renderer interface {
+	// createTexture makes a texture from 4 bytes per pixel, in blue, green,
+	// red, alpha order, see readImage.
+	createTexture(width, height int, pixels []byte) (textureHandle, error)
+	releaseTexture(t textureHandle)
+	// createMesh uploads triangle lists of float32sPerTexturedVertex floats
+	// per vertex, with one color per vertex, see vertexColor.
+	createMesh(vertices []float32, colors []uint32) (meshHandle, error)
+	// createDynamicMesh makes room for vertexCount white vertices, which are
+	// filled in with updateMesh. offset is the index of the first float to
+	// overwrite.
+	createDynamicMesh(vertexCount int) (meshHandle, error)
+	updateMesh(mesh meshHandle, offset int, vertices []float32) error
+	releaseMesh(mesh meshHandle)
+	// meshMemory is how many meshes there are and how many bytes they use.
+	meshMemory() (count, bytes int)
+
+	// beginFrame clears the screen to a gray level and starts drawing.
+	// endFrame shows the frame, it returns errDeviceLost if we cannot render
+	// right now. restore tries to get rendering back after that, it returns
+	// errDeviceLost until it succeeds.
+	beginFrame(background uint8) error
+	endFrame() error
+	restore() error
+	setDisplayMode(mode displayMode) error
+	// setViewport limits drawing to a part of the screen, in fractions of
+	// its size.
+	setViewport(x, y, width, height float32) error
+
+	// The following calls set what drawMesh uses. color tints the texture.
+	setLight(light *lightingPreset) error
+	setColor(color m.Vec4) error
+	setMaterial(mat material) error
+	setTexture(t textureHandle) error
+	setTransform(mvp, normalTransform m.Mat4) error
+	drawMesh(mesh meshHandle, firstVertex, triangleCount int) error
+
+	// The HUD is drawn in pixels, with the origin at the top-left. Its
+	// vertices are float32sPerHUDVertex floats each. Between beginHUD and
+	// endHUD, only drawHUD is allowed.
+	beginHUD(screenWidth, screenHeight float32) error
+	drawHUD(texture textureHandle, vertices []float32) error
+	endHUD() error
+
+	close()
+}
+
+// audioOutput plays sounds from the assets. Handles identify a playing sound
+// for changing or stopping it later.
+type audioOutput interface {
+	preload(path string) error
+	reload(path string) error
+	play(path string) (soundHandle, error)
+	loop(path string) (soundHandle, error)
+	queueLoopAfter(atEndOf soundHandle, path string) (soundHandle, error)
+	setSpeed(handle soundHandle, speed float64) error
+	setVolume(handle soundHandle, volume float64) error
+	stop(handle soundHandle) error
+	setBus(handle soundHandle, bus soundBus) error
+	// setDirection pans the sound across the speakers, see surroundGains.
+	setDirection(handle soundHandle, azimuth float64) error
+	// preloadLowPass makes a muffled copy of a sound, see addStem.
+	preloadLowPass(path, filteredPath string, cutoffHz float64) error
+	// addStem plays another file in sync with the sound, e.g. a layer of
+	// the music. setStemVolume then mixes the stems, 0 is the sound itself.
+	addStem(handle soundHandle, path string) (int, error)
+	setStemVolume(handle soundHandle, stem int, volume float64) error
+	setBusVolume(bus soundBus, volume float64)
+	setMasterVolume(volume float64)
+	// update is called once per frame to keep the output buffer filled.
+	update() error
+	pause() error
+	resume() error
+	// underrunCount is how many times we could not keep up with playback.
+	underrunCount() int
+	soundCounts() (active, playing int)
+	close()
+}
+
+// inputSource reads all controllers once per frame into its state.
+type inputSource interface {
+	// state returns the input for the current frame. The pointer stays valid,
+	// update overwrites its contents.
+	state() *inputState
+	update()
+	connectJoystick()
+	connectKeyboard(window w32.HWND)
+	// gameControllers lists the plugged in DirectInput controllers, and
+	// usesController tells if one of them is our joystick.
+	gameControllers() []gameController
+	usesController(c gameController) bool
+	// setPlayer1Controller picks player 1's controller, see allControllers.
+	setPlayer1Controller(choice string)
+	// runControlPanel opens a settings dialog for the controllers, if the
+	// backend has one.
+	runControlPanel(owner w32.HWND) error
+	// rumble sets the speeds of the player's low and high frequency motors,
+	// from 0 to 1. Players without rumble motors ignore this.
+	rumble(player int, low, high float32)
+	close()
+}
+
+var (
+	_ renderer    = (*graphicsSystem)(nil)
+	_ audioOutput = (*soundSystem)(nil)
+	_ inputSource = (*inputSystem)(nil)
+)
@@ -0,0 +1,120 @@
+// compileshaders compiles the shaders in the given directories to bytecode,
+// which the game loads instead of compiling them at start-up. Every file
+// <name>.vs.hlsl is compiled as a vertex shader and <name>.ps.hlsl as a pixel
+// shader, the bytecode is written next to it as <name>.vs.fxo or
+// <name>.ps.fxo. Other .hlsl files are headers, they are only included.
+//
+//	go run ./cmd/compileshaders assets/shaders
+//
+// With -check, nothing is written. This way a build can make sure that all
+// shaders compile without running the game. -disasm also writes the assembly
+// of each shader to a .asm file, to look at its instruction count.
+//
+// The compiler is the D3DCompiler DLL that comes with Windows, so this only
+// runs on Windows.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gonutz/dxc"
+)
+
+func main() {
+	check := flag.Bool("check", false, "only compile, do not write any files")
+	disasm := flag.Bool("disasm", false, "also write the assembly to .asm files")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: compileshaders [-check] [-disasm] dir...")
+		os.Exit(2)
+	}
+	failed := false
+	for _, dir := range flag.Args() {
+		if err := run(dir, *check, *disasm); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// targets are the shader profiles of the shader kinds, by file name suffix.
+var targets = map[string]string{
+	".vs.hlsl": "vs_3_0",
+	".ps.hlsl": "ps_3_0",
+}
+
+func run(dir string, check, disasm bool) error {
+	var failures []error
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		for suffix, target := range targets {
+			if strings.HasSuffix(path, suffix) {
+				if err := compile(path, target, check, disasm); err != nil {
+					failures = append(failures, err)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return errors.Join(failures...)
+}
+
+func compile(path, target string, check, disasm bool) error {
+	code, err := dxc.CompileFile(path, "main", target, nil, dxc.WARNINGS_ARE_ERRORS, 0)
+	if err != nil {
+		var compileErr *dxc.CompileError
+		if errors.As(err, &compileErr) && len(compileErr.Messages) > 0 {
+			return formatMessages(compileErr.Messages)
+		}
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if check {
+		return nil
+	}
+
+	base := strings.TrimSuffix(path, ".hlsl")
+	if err := os.WriteFile(base+".fxo", code, 0644); err != nil {
+		return err
+	}
+	if disasm {
+		asm, err := dxc.Disassemble(code, 0, path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if err := os.WriteFile(base+".asm", []byte(asm), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatMessages writes the compiler messages like the Go compiler does, as
+// file:line:column: message, which editors understand.
+func formatMessages(messages []dxc.Message) error {
+	var lines []string
+	for _, m := range messages {
+		kind := "error"
+		if m.Warning {
+			kind = "warning"
+		}
+		lines = append(lines, fmt.Sprintf(
+			"%s:%d:%d: %s %s: %s",
+			filepath.ToSlash(m.File), m.Line, m.Column, kind, m.Code, m.Text,
+		))
+	}
+	return errors.New(strings.Join(lines, "\n"))
+}
@@ -0,0 +1,188 @@
+// packassets writes the files in the given directories into an asset pack,
+// which the game embeds instead of the plain asset files. File names in the
+// pack are the paths as given on the command line, e.g.
+//
+//	go run ./cmd/packassets -o assets.pack assets
+//
+// stores assets/joker.obj under the name "assets/joker.obj".
+//
+// With -manifest, only the files listed in the manifest are packed, all other
+// files in the directories are skipped. This is how the demo build leaves out
+// the content it does not use, see demo_assets.txt.
+//
+// Every packed shader needs its bytecode from compileshaders next to it,
+// otherwise packing fails. Release builds would compile the shader at
+// start-up instead, which is what the bytecode is there to avoid.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gonutz/go_game_demo/assetpack"
+)
+
+func main() {
+	output := flag.String("o", "assets.pack", "output file")
+	manifestPath := flag.String("manifest", "", "only pack the files listed in this file")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: packassets [-o file] [-manifest file] dir...")
+		os.Exit(2)
+	}
+	var m manifest
+	if *manifestPath != "" {
+		var err error
+		m, err = readManifest(*manifestPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	if err := run(*output, flag.Args(), m); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// run packs the files in dirs into output. If m is not nil, only the files in
+// m are packed.
+func run(output string, dirs []string, m manifest) error {
+	var files []assetpack.File
+	size := 0
+	skipped := 0
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			name := filepath.ToSlash(filepath.Clean(path))
+			if m != nil && !m.includes(name) {
+				skipped++
+				return nil
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			files = append(files, assetpack.File{
+				Name: name,
+				Data: data,
+			})
+			size += len(data)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if missing := m.missing(files); len(missing) > 0 {
+		return fmt.Errorf("files in manifest not found: %s", strings.Join(missing, ", "))
+	}
+	if missing := missingBytecode(files); len(missing) > 0 {
+		return fmt.Errorf(
+			"shader bytecode not found, run go run ./cmd/compileshaders first: %s",
+			strings.Join(missing, ", "),
+		)
+	}
+
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	if err := assetpack.Write(f, files); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(output)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("packed %d files, %d bytes into %d bytes\n", len(files), size, info.Size())
+	if skipped > 0 {
+		fmt.Printf("skipped %d files that are not in the manifest\n", skipped)
+	}
+	return nil
+}
+
+// missingBytecode returns the .fxo files that compileshaders writes for the
+// shaders in files but that are not in files.
+func missingBytecode(files []assetpack.File) []string {
+	packed := map[string]bool{}
+	for _, f := range files {
+		packed[f.Name] = true
+	}
+	var missing []string
+	for _, f := range files {
+		if strings.HasSuffix(f.Name, ".vs.hlsl") || strings.HasSuffix(f.Name, ".ps.hlsl") {
+			fxo := strings.TrimSuffix(f.Name, ".hlsl") + ".fxo"
+			if !packed[fxo] {
+				missing = append(missing, fxo)
+			}
+		}
+	}
+	return missing
+}
+
+// manifest lists the files that go into a pack. Entries ending in a slash
+// include everything in that directory.
+type manifest []string
+
+// readManifest reads a manifest file with one path per line. Empty lines and
+// lines starting with # are ignored.
+func readManifest(path string) (manifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := manifest{}
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		line := strings.TrimSpace(lines.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			m = append(m, line)
+		}
+	}
+	return m, lines.Err()
+}
+
+func (m manifest) includes(name string) bool {
+	for _, entry := range m {
+		if name == entry ||
+			strings.HasSuffix(entry, "/") && strings.HasPrefix(name, entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// missing returns the entries in m that did not match any of the files, these
+// are usually typos.
+func (m manifest) missing(files []assetpack.File) []string {
+	var missing []string
+	for _, entry := range m {
+		found := false
+		for _, f := range files {
+			if manifest([]string{entry}).includes(f.Name) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, entry)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"math"
+
+	m "github.com/gonutz/d3dmath/column_major/d3dmath"
+)
+
+// meshCollider does mesh-accurate collision against the triangles of selected
+// model parts. The grid of floor heights is good enough for most of the level
+// but it cannot represent ramps and other geometry that is not grid-shaped.
+//
+// Each part keeps its bounding box, which we use to quickly skip parts that
+// are not near the moving box before testing their triangles.
+type meshCollider struct {
+	parts []colliderPart
+}
+
+type colliderPart struct {
+	box       m.AABB
+	triangles [][3]m.Vec3
+}
+
+// sweepStep is the longest distance that we move a box in one step when
+// sweeping it. It is well below the joker's size so the box cannot skip over
+// thin geometry.
+const sweepStep = 0.05
+
+// addPart adds the triangles of a model part. vertices are in our usual
+// layout with float32sPerVertex floats per vertex, the position coming first.
+// Each position is transformed before it is added.
+func (c *meshCollider) addPart(vertices []float32, float32sPerVertex int, transform m.Mat4) {
+	part := colliderPart{box: m.EmptyAABB()}
+	var tri [3]m.Vec3
+	for i := 0; i+float32sPerVertex <= len(vertices); i += float32sPerVertex {
+		p := m.Vec3{vertices[i], vertices[i+1], vertices[i+2]}
+		p = p.Homogeneous().MulMat(transform).DropW()
+		part.box = part.box.Extend(p)
+		n := (i / float32sPerVertex) % 3
+		tri[n] = p
+		if n == 2 {
+			part.triangles = append(part.triangles, tri)
+		}
+	}
+	if len(part.triangles) > 0 {
+		c.parts = append(c.parts, part)
+	}
+}
+
+// overlaps is true if the box intersects any triangle.
+func (c *meshCollider) overlaps(b m.AABB) bool {
+	center, half := b.Center(), b.HalfSize()
+	for _, p := range c.parts {
+		if !p.box.Intersects(b) {
+			continue
+		}
+		for _, t := range p.triangles {
+			if triangleOverlapsBox(t, center, half) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sweep moves the box along delta and returns the fraction in [0..1] of delta
+// that it can move before touching a triangle. hit is true if it touches one
+// on the way. If the box already overlaps a triangle at the start, it cannot
+// move at all.
+func (c *meshCollider) sweep(b m.AABB, delta m.Vec3) (t float32, hit bool) {
+	// Only parts near the whole path are relevant for the sweep.
+	path := b.Merge(b.Moved(delta))
+	near := meshCollider{parts: make([]colliderPart, 0, 4)}
+	for _, p := range c.parts {
+		if p.box.Intersects(path) {
+			near.parts = append(near.parts, p)
+		}
+	}
+	if len(near.parts) == 0 {
+		return 1, false
+	}
+
+	hitsAt := func(t float32) bool {
+		return near.overlaps(b.Moved(delta.MulScalar(t)))
+	}
+	if hitsAt(0) {
+		return 0, true
+	}
+
+	steps := max(1, int(math.Ceil(float64(delta.Norm()/sweepStep))))
+	for i := 1; i <= steps; i++ {
+		t := float32(i) / float32(steps)
+		if hitsAt(t) {
+			// Find the contact point between the last free step and this one.
+			free, blocked := float32(i-1)/float32(steps), t
+			for range 10 {
+				mid := (free + blocked) / 2
+				if hitsAt(mid) {
+					blocked = mid
+				} else {
+					free = mid
+				}
+			}
+			return free, true
+		}
+	}
+	return 1, false
+}
+
+// liftOut moves a box that overlaps the mesh up until it no longer does, by
+// at most maxLift. It returns how far the box was lifted and false if the box
+// does not overlap the mesh or cannot be lifted out of it.
+func (c *meshCollider) liftOut(b m.AABB, maxLift float32) (float32, bool) {
+	if !c.overlaps(b) {
+		return 0, false
+	}
+	raised := b.Moved(m.Vec3{0, maxLift, 0})
+	t, _ := c.sweep(raised, m.Vec3{0, -maxLift, 0})
+	if t == 0 {
+		return 0, false
+	}
+	return maxLift - t*maxLift, true
+}
+
+// triangleOverlapsBox uses the separating axis test from Tomas Akenine-Möller's
+// "Fast 3D Triangle-Box Overlap Testing". The triangle and box overlap unless
+// one of 13 axes separates them: the box's 3 face normals, the triangle's
+// normal and the 9 cross products of the box's and the triangle's edges.
+func triangleOverlapsBox(t [3]m.Vec3, center, half m.Vec3) bool {
+	// Move everything so the box is centered at the origin.
+	v0 := t[0].Sub(center)
+	v1 := t[1].Sub(center)
+	v2 := t[2].Sub(center)
+
+	separates := func(axis m.Vec3) bool {
+		p0, p1, p2 := axis.Dot(v0), axis.Dot(v1), axis.Dot(v2)
+		r := half[0]*abs(axis[0]) + half[1]*abs(axis[1]) + half[2]*abs(axis[2])
+		return min(p0, p1, p2) > r || max(p0, p1, p2) < -r
+	}
+
+	for _, e := range [3]m.Vec3{v1.Sub(v0), v2.Sub(v1), v0.Sub(v2)} {
+		// These are the cross products of the X, Y and Z axes with e.
+		if separates(m.Vec3{0, -e[2], e[1]}) ||
+			separates(m.Vec3{e[2], 0, -e[0]}) ||
+			separates(m.Vec3{-e[1], e[0], 0}) {
+			return false
+		}
+	}
+
+	for i := range 3 {
+		if min(v0[i], v1[i], v2[i]) > half[i] || max(v0[i], v1[i], v2[i]) < -half[i] {
+			return false
+		}
+	}
+
+	return !separates(v1.Sub(v0).Cross(v2.Sub(v0)))
+}
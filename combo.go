@@ -0,0 +1,93 @@
+package main
+
+import "time"
+
+// comboDetector watches the button states of a controller and calls back when
+// a registered sequence of states was entered. It is used for cheats and
+// special moves.
+//
+// A sequence lists every state that the buttons go through, so pressing A and
+// then B is {A, 0, B, 0}, with the releases in between. The sequence matches
+// if it is the most recent part of the history, earlier button presses do not
+// matter.
+type comboDetector struct {
+	combos  []combo
+	last    uint16
+	history []buttonChange
+}
+
+type combo struct {
+	states []uint16
+	// timeout is the longest time allowed between two consecutive states, 0
+	// means there is no limit.
+	timeout    time.Duration
+	onComplete func()
+}
+
+type buttonChange struct {
+	buttons uint16
+	at      time.Time
+}
+
+func newComboDetector() *comboDetector {
+	return &comboDetector{}
+}
+
+// register adds a sequence of button states that calls onComplete once it was
+// entered.
+func (d *comboDetector) register(states []uint16, timeout time.Duration, onComplete func()) {
+	d.combos = append(d.combos, combo{
+		states:     states,
+		timeout:    timeout,
+		onComplete: onComplete,
+	})
+}
+
+// update is called every frame with the current button state.
+func (d *comboDetector) update(buttons uint16, now time.Time) {
+	if buttons == d.last {
+		return
+	}
+	d.last = buttons
+
+	// We only need to remember as many changes as the longest combo has.
+	maxLen := 0
+	for _, c := range d.combos {
+		maxLen = max(maxLen, len(c.states))
+	}
+	if len(d.history) >= maxLen && len(d.history) > 0 {
+		copy(d.history, d.history[1:])
+		d.history = d.history[:len(d.history)-1]
+	}
+	d.history = append(d.history, buttonChange{buttons: buttons, at: now})
+
+	for _, c := range d.combos {
+		if d.matches(c) {
+			// Start over so the same presses do not complete another combo.
+			d.history = d.history[:0]
+			c.onComplete()
+			return
+		}
+	}
+}
+
+func (d *comboDetector) matches(c combo) bool {
+	if len(c.states) == 0 || len(c.states) > len(d.history) {
+		return false
+	}
+	recent := d.history[len(d.history)-len(c.states):]
+	for i, s := range c.states {
+		if recent[i].buttons != s {
+			return false
+		}
+		if i > 0 && c.timeout > 0 && recent[i].at.Sub(recent[i-1].at) > c.timeout {
+			return false
+		}
+	}
+	return true
+}
+
+// reset forgets the button history, e.g. when switching to another screen.
+func (d *comboDetector) reset() {
+	d.history = d.history[:0]
+}
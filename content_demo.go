@@ -0,0 +1,11 @@
+//go:build demo
+
+package main
+
+// Build with "go build -tags demo" for the small downloadable demo. It has the
+// first level only and plays the music loop without its intro. The embedded
+// asset pack leaves out the files that the demo does not use, see
+// demo_assets.txt.
+const demoContent = true
+
+var levels = allLevels[:1]
@@ -0,0 +1,9 @@
+//go:build !demo
+
+package main
+
+// The full game has all levels and all music, see content_demo.go for the
+// demo.
+const demoContent = false
+
+var levels = allLevels
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"strconv"
+
+	m "github.com/gonutz/d3dmath/column_major/d3dmath"
+	"github.com/gonutz/w32/v2"
+)
+
+// controllerTest is a diagnostics screen that shows every controller as the
+// game reads it: the raw values next to what is left after our dead zones.
+// When players report that their gamepad does not work, it tells whether the
+// gamepad reaches the game at all.
+type controllerTest struct {
+	// devices are the DirectInput game controllers, used tells which of them
+	// is our joystick. We list them when the screen opens, enumerating them
+	// every frame would be too slow.
+	devices []gameController
+	used    []bool
+	// buf is reused for formatting numbers without allocating every frame.
+	buf []byte
+}
+
+// Colors of the controller test screen. Raw values are white, the values
+// that the game uses are yellow.
+var (
+	testPanelColor    = m.Vec4{0.15, 0.15, 0.15, 1}
+	testStickColor    = m.Vec4{0.3, 0.3, 0.3, 1}
+	testDeadZoneColor = m.Vec4{0.45, 0.15, 0.15, 1}
+	testOffColor      = m.Vec4{0.4, 0.4, 0.4, 1}
+	testRawColor      = m.Vec4{1, 1, 1, 1}
+	testGameColor     = m.Vec4{1, 0.8, 0.1, 1}
+)
+
+var xinputButtons = [...]struct {
+	name string
+	mask uint16
+}{
+	{"A", w32.XINPUT_GAMEPAD_A},
+	{"B", w32.XINPUT_GAMEPAD_B},
+	{"X", w32.XINPUT_GAMEPAD_X},
+	{"Y", w32.XINPUT_GAMEPAD_Y},
+	{"LB", w32.XINPUT_GAMEPAD_LEFT_SHOULDER},
+	{"RB", w32.XINPUT_GAMEPAD_RIGHT_SHOULDER},
+	{"Bk", w32.XINPUT_GAMEPAD_BACK},
+	{"St", w32.XINPUT_GAMEPAD_START},
+	{"LS", w32.XINPUT_GAMEPAD_LEFT_THUMB},
+	{"RS", w32.XINPUT_GAMEPAD_RIGHT_THUMB},
+	{"Up", w32.XINPUT_GAMEPAD_DPAD_UP},
+	{"Dn", w32.XINPUT_GAMEPAD_DPAD_DOWN},
+	{"Lt", w32.XINPUT_GAMEPAD_DPAD_LEFT},
+	{"Rt", w32.XINPUT_GAMEPAD_DPAD_RIGHT},
+}
+
+var (
+	xinputPadNames      = [...]string{"XInput 1", "XInput 2", "XInput 3", "XInput 4"}
+	joystickButtonNames = [...]string{"1", "2", "3", "4", "5", "6", "7", "8"}
+)
+
+// listControllerChoices returns the names of the controllers that player 1 can
+// pick and the matching choices for setPlayer1Controller. The first one lets
+// player 1 use all controllers. XBox controllers are only listed by their
+// XInput slot, through DirectInput the triggers would be one axis.
+func listControllerChoices(input inputSource) (names, choices []string) {
+	names = append(names, "All controllers")
+	choices = append(choices, allControllers)
+	for i, pad := range input.state().xinputPads {
+		if pad.connected {
+			names = append(names, "XBox controller "+strconv.Itoa(i+1))
+			choices = append(choices, xinputChoice(i))
+		}
+	}
+	for _, c := range input.gameControllers() {
+		if c.xinput {
+			continue
+		}
+		names = append(names, c.name)
+		choices = append(choices, formatGUID(c.guid))
+	}
+	return names, choices
+}
+
+// refresh lists the DirectInput controllers again, e.g. when the screen
+// opens.
+func (t *controllerTest) refresh(input inputSource) {
+	t.devices = input.gameControllers()
+	t.used = t.used[:0]
+	for _, c := range t.devices {
+		t.used = append(t.used, input.usesController(c))
+	}
+}
+
+// draw shows the four XInput slots and the joystick in a grid of panels, with
+// a list of all DirectInput controllers in the last one.
+func (t *controllerTest) draw(h *hud, in *inputState, screenW, screenH float32) {
+	const (
+		margin = 20
+		top    = 100
+		bottom = 80
+	)
+	panelW := (screenW - 4*margin) / 3
+	panelH := (screenH - top - bottom - margin) / 2
+	panel := func(i int) (x, y float32) {
+		return margin + float32(i%3)*(panelW+margin),
+			top + float32(i/3)*(panelH+margin)
+	}
+	for i := range in.xinputPads {
+		x, y := panel(i)
+		h.rect(x, y, panelW, panelH, testPanelColor)
+		t.drawXInputPad(h, xinputPadNames[i], &in.xinputPads[i], x+10, y+10)
+	}
+	x, y := panel(4)
+	h.rect(x, y, panelW, panelH, testPanelColor)
+	t.drawJoystick(h, in, x+10, y+10)
+	x, y = panel(5)
+	h.rect(x, y, panelW, panelH, testPanelColor)
+	t.drawDevices(h, x+10, y+10)
+}
+
+func (t *controllerTest) drawXInputPad(h *hud, name string, pad *xinputPad, x, y float32) {
+	const headerSize = 28
+	h.text(x, y, headerSize, name, testRawColor)
+	if !pad.connected {
+		h.text(x, y+headerSize, headerSize, "not connected", testOffColor)
+		return
+	}
+	g := &pad.gamepad
+	lx, ly := float32(g.ThumbLX)/32768, -float32(g.ThumbLY)/32768
+	rx, ry := float32(g.ThumbRX)/32768, -float32(g.ThumbRY)/32768
+	drawTestStick(h, x+60, y+100, lx, ly, gameAxis(lx), gameAxis(ly))
+	drawTestStick(h, x+190, y+100, rx, ry, gameAxis(rx), gameAxis(ry))
+	drawTestBar(h, x+270, y+45, float32(g.LeftTrigger)/255)
+	drawTestBar(h, x+305, y+45, float32(g.RightTrigger)/255)
+
+	for i, b := range xinputButtons {
+		bx := x + float32(i%7)*38
+		by := y + 170 + float32(i/7)*36
+		drawTestButton(h, bx, by, b.name, g.Buttons&b.mask != 0)
+	}
+
+	const textSize = 20
+	t.buf = append(t.buf[:0], "LX "...)
+	t.buf = strconv.AppendInt(t.buf, int64(g.ThumbLX), 10)
+	t.buf = append(t.buf, "  LY "...)
+	t.buf = strconv.AppendInt(t.buf, int64(g.ThumbLY), 10)
+	t.buf = append(t.buf, "  RX "...)
+	t.buf = strconv.AppendInt(t.buf, int64(g.ThumbRX), 10)
+	t.buf = append(t.buf, "  RY "...)
+	t.buf = strconv.AppendInt(t.buf, int64(g.ThumbRY), 10)
+	h.textBytes(x, y+250, textSize, t.buf, testRawColor)
+	t.buf = append(t.buf[:0], "LT "...)
+	t.buf = strconv.AppendInt(t.buf, int64(g.LeftTrigger), 10)
+	t.buf = append(t.buf, "  RT "...)
+	t.buf = strconv.AppendInt(t.buf, int64(g.RightTrigger), 10)
+	t.buf = append(t.buf, "  Buttons 0x"...)
+	t.buf = strconv.AppendUint(t.buf, uint64(g.Buttons), 16)
+	h.textBytes(x, y+250+textSize, textSize, t.buf, testRawColor)
+}
+
+func (t *controllerTest) drawJoystick(h *hud, in *inputState, x, y float32) {
+	const headerSize = 28
+	h.text(x, y, headerSize, "Joystick", testRawColor)
+	if !in.joystickConnected {
+		h.text(x, y+headerSize, headerSize, "not connected", testOffColor)
+		return
+	}
+	raw := &in.joystickRaw
+	j := &in.joystick
+	// DirectInput applies the dead zone for the joystick, see
+	// connectJoystick, so its raw values already have it.
+	drawTestStick(h, x+60, y+100,
+		float32(raw.X)/10000, float32(raw.Y)/10000, j.xAxis, j.yAxis)
+	drawTestBar(h, x+140, y+45, j.wheel)
+
+	for i, name := range joystickButtonNames {
+		bx := x + float32(i%7)*38
+		by := y + 170 + float32(i/7)*36
+		drawTestButton(h, bx, by, name, raw.Buttons[i]&0x80 != 0)
+	}
+
+	const textSize = 20
+	t.buf = append(t.buf[:0], "X "...)
+	t.buf = strconv.AppendInt(t.buf, int64(raw.X), 10)
+	t.buf = append(t.buf, "  Y "...)
+	t.buf = strconv.AppendInt(t.buf, int64(raw.Y), 10)
+	t.buf = append(t.buf, "  RZ "...)
+	t.buf = strconv.AppendInt(t.buf, int64(raw.Rz), 10)
+	h.textBytes(x, y+250, textSize, t.buf, testRawColor)
+	t.buf = append(t.buf[:0], "POV "...)
+	if raw.POV[0] > 36000 {
+		t.buf = append(t.buf, "centered"...)
+	} else {
+		t.buf = strconv.AppendUint(t.buf, uint64(raw.POV[0]/100), 10)
+		t.buf = append(t.buf, " degrees"...)
+	}
+	h.textBytes(x, y+250+textSize, textSize, t.buf, testRawColor)
+}
+
+func (t *controllerTest) drawDevices(h *hud, x, y float32) {
+	const (
+		headerSize = 28
+		textSize   = 24
+	)
+	h.text(x, y, headerSize, "DirectInput devices", testRawColor)
+	y += headerSize + 6
+	if len(t.devices) == 0 {
+		h.text(x, y, textSize, "none", testOffColor)
+	}
+	for i, c := range t.devices {
+		color := testRawColor
+		if t.used[i] {
+			// Our joystick is the one that the game reads.
+			color = testGameColor
+		}
+		h.text(x, y, textSize, c.name, color)
+		y += textSize
+	}
+}
+
+// gameAxis is what the game makes of a raw XBox controller stick axis, see
+// clampAxis and relativeAxis.
+func gameAxis(raw float32) float32 {
+	return relativeAxis(clampAxis(raw))
+}
+
+// drawTestStick shows the range of a stick centered at x,y with its dead zone
+// in red. The white dot is where the stick is, the yellow dot where the game
+// thinks it is.
+func drawTestStick(h *hud, x, y, rawX, rawY, gameX, gameY float32) {
+	const (
+		radius    = 55
+		dotRadius = 6
+	)
+	circle := func(x, y, r float32, color m.Vec4) {
+		h.sprite(spriteCircle, x-r, y-r, 2*r, 2*r, color)
+	}
+	circle(x, y, radius, testStickColor)
+	circle(x, y, axisMin*radius, testDeadZoneColor)
+	circle(x+rawX*radius, y+rawY*radius, dotRadius, testRawColor)
+	circle(x+gameX*radius, y+gameY*radius, dotRadius, testGameColor)
+}
+
+// drawTestBar shows a value from 0 to 1, like a trigger, as a bar that fills
+// up from the bottom.
+func drawTestBar(h *hud, x, y, value float32) {
+	const w, height = 24, 110
+	fill := max(0, min(1, value)) * height
+	h.rect(x, y, w, height, testStickColor)
+	h.rect(x, y+height-fill, w, fill, testRawColor)
+}
+
+// drawTestButton is a circle that lights up while the button is down.
+func drawTestButton(h *hud, x, y float32, name string, down bool) {
+	const size = 32
+	color, textColor := testStickColor, testRawColor
+	if down {
+		color, textColor = testGameColor, m.Vec4{0, 0, 0, 1}
+	}
+	h.sprite(spriteCircle, x, y, size, size, color)
+	const textSize = 18
+	h.text(x+(size-h.textWidth(name, textSize))/2, y+(size-textSize)/2, textSize, name, textColor)
+}
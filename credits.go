@@ -0,0 +1,43 @@
+package main
+
+// creditsLine is a line on the credits screen. Headings are drawn bigger and
+// in a different color than the names below them.
+type creditsLine struct {
+	text    string
+	heading bool
+}
+
+// credits scroll up over the rotating XBox controller, from the bottom of the
+// screen until the last line has left the top.
+var credits = []creditsLine{
+	{"Demo Time", true},
+	{"", false},
+	{"Programming", true},
+	{"gonutz", false},
+	{"", false},
+	{"Graphics", true},
+	{"Direct3D 9", false},
+	{"", false},
+	{"Audio", true},
+	{"DirectSound 8 and a custom mixer", false},
+	{"", false},
+	{"Input", true},
+	{"XInput and DirectInput 8", false},
+	{"", false},
+	{"Written in", true},
+	{"Go", false},
+	{"", false},
+	{"", false},
+	{"Thanks for playing!", true},
+}
+
+// creditsScrollSpeed is how many pixels the credits move up per frame when
+// nobody touches the controls. Holding the stick down makes them faster,
+// holding it up slows them down and eventually scrolls them back.
+const creditsScrollSpeed = 1.5
+
+// creditsSpeedFactor maps the stick's vertical axis, from -1 (up) to 1 (down),
+// to a factor for creditsScrollSpeed.
+func creditsSpeedFactor(axis float32) float32 {
+	return 1 + 4*axis
+}
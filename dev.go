@@ -0,0 +1,21 @@
+//go:build dev
+
+package main
+
+import (
+	"io/fs"
+	"os"
+)
+
+// Build with "go build -tags dev" and run the game from the repository's root
+// directory to read the assets from disk. Changed textures, models, sounds and
+// dialogues are reloaded while the game is running.
+const hotReloadAssets = true
+
+// Dev builds check all assets at startup, see validateAssets. Release builds
+// embed assets that were checked before packing them.
+const validateAssetsAtStartup = true
+
+func openAssets(externalPacks []string) (fs.FS, error) {
+	return withExternalPacks(os.DirFS("."), externalPacks)
+}
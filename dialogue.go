@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// dialogue is a conversation with an NPC. It is a graph of lines, each line
+// either has choices for the player, which lead to other lines, or it simply
+// continues with the next line. The dialogues are defined in
+// assets/dialogue.json.
+type dialogue struct {
+	Speaker string                  `json:"speaker"`
+	Start   string                  `json:"start"`
+	Lines   map[string]dialogueLine `json:"lines"`
+}
+
+type dialogueLine struct {
+	Text    string           `json:"text"`
+	Choices []dialogueChoice `json:"choices"`
+	// Next is the line that follows if there are no choices. The dialogue
+	// ends after a line without choices and without Next.
+	Next string `json:"next"`
+}
+
+type dialogueChoice struct {
+	Text string `json:"text"`
+	// Next is the line that follows when choosing this. If it is empty, the
+	// dialogue ends.
+	Next string `json:"next"`
+}
+
+// loadDialogues reads the dialogues from the given asset file and makes sure
+// that all lines that they refer to exist.
+func loadDialogues(path string) (map[string]*dialogue, error) {
+	data, err := readAsset(path)
+	if err != nil {
+		return nil, err
+	}
+	dialogues, err := parseDialogues(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return dialogues, nil
+}
+
+// parseDialogues decodes the JSON data and makes sure that all lines and
+// choices lead to existing lines.
+func parseDialogues(data []byte) (map[string]*dialogue, error) {
+	var dialogues map[string]*dialogue
+	if err := json.Unmarshal(data, &dialogues); err != nil {
+		return nil, err
+	}
+
+	for id, d := range dialogues {
+		exists := func(line string) bool {
+			_, ok := d.Lines[line]
+			return ok
+		}
+		if !exists(d.Start) {
+			return nil, fmt.Errorf("dialogue %q starts with unknown line %q", id, d.Start)
+		}
+		for name, line := range d.Lines {
+			if line.Next != "" && !exists(line.Next) {
+				return nil, fmt.Errorf("line %q of dialogue %q continues with unknown line %q", name, id, line.Next)
+			}
+			for _, c := range line.Choices {
+				if c.Next != "" && !exists(c.Next) {
+					return nil, fmt.Errorf("choice %q in dialogue %q leads to unknown line %q", c.Text, id, c.Next)
+				}
+			}
+		}
+	}
+
+	return dialogues, nil
+}
+
+// dialogueBox is an open conversation. The player moves the selection through
+// the current line's choices and confirms one to go on.
+type dialogueBox struct {
+	dialogue *dialogue
+	line     string
+	choice   int
+	// wrapped is the current line's text split into rows of wrappedWidth
+	// pixels. We only wrap it again when the line or the width changes.
+	wrapped      []string
+	wrappedLine  string
+	wrappedWidth float32
+}
+
+func newDialogueBox(d *dialogue) *dialogueBox {
+	return &dialogueBox{dialogue: d, line: d.Start}
+}
+
+func (b *dialogueBox) current() dialogueLine {
+	return b.dialogue.Lines[b.line]
+}
+
+// update handles the menu input and returns false once the dialogue is over.
+func (b *dialogueBox) update(in menuInput) bool {
+	line := b.current()
+	if n := len(line.Choices); n > 0 {
+		if in.up {
+			b.choice = (b.choice + n - 1) % n
+		}
+		if in.down {
+			b.choice = (b.choice + 1) % n
+		}
+	}
+
+	if in.back {
+		return false
+	}
+	if !in.confirm {
+		return true
+	}
+
+	next := line.Next
+	if len(line.Choices) > 0 {
+		next = line.Choices[b.choice].Next
+	}
+	if next == "" {
+		return false
+	}
+	b.line = next
+	b.choice = 0
+	return true
+}
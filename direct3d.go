@@ -0,0 +1,558 @@
+package main
+
+import (
+	"errors"
+	"unsafe"
+
+	"github.com/gonutz/d3d9"
+	m "github.com/gonutz/d3dmath/column_major/d3dmath"
+	"github.com/gonutz/w32/v2"
+)
+
+// errDeviceLost is returned while another window is in front of ours in a
+// fullscreen display mode. We cannot render then, see graphicsSystem.restore.
+var errDeviceLost = errors.New("the graphics device is lost")
+
+// graphicsSystem is our renderer with Direct3D 9. It owns the device and all
+// textures and meshes, handles are indices into its tables, plus 1 so the zero
+// handle is invalid.
+type graphicsSystem struct {
+	device *d3d9.Device
+	window w32.HWND
+	pp     d3d9.PRESENT_PARAMETERS
+
+	objectVertexShader *d3d9.VertexShader
+	objectPixelShader  *d3d9.PixelShader
+	texturedVertex     *d3d9.VertexDeclaration
+	// We set the shader constants by name, the compiler decides on their
+	// registers.
+	mvpRegister             uint
+	normalTransformRegister uint
+	colorFactorRegister     uint
+	lightDirectionRegister  uint
+	lightColorRegister      uint
+	ambientColorRegister    uint
+	lightParametersRegister uint
+
+	hudVertexShader    *d3d9.VertexShader
+	hudPixelShader     *d3d9.PixelShader
+	hudVertex          *d3d9.VertexDeclaration
+	screenSizeRegister uint
+
+	textures []*d3d9.Texture
+	meshes   []direct3DMesh
+	// boundMesh is the mesh in the vertex streams and objectsBound tells if
+	// the object shaders are set, so drawing many parts of one mesh does not
+	// set them again every time.
+	boundMesh    meshHandle
+	objectsBound bool
+}
+
+// direct3DMesh has a vertex buffer for each stream of the texturedVertex
+// declaration. A released mesh has nil buffers.
+type direct3DMesh struct {
+	vertices, colors *d3d9.VertexBuffer
+	bytes            int
+}
+
+// newGraphicsSystem creates the device for the window on the adapter and
+// switches to the display mode.
+func newGraphicsSystem(
+	d3d *d3d9.Direct3D,
+	adapter uint,
+	window w32.HWND,
+	mode displayMode,
+) (*graphicsSystem, error) {
+	objectVertexShaderCode, err := loadShader("object.vs")
+	if err != nil {
+		return nil, err
+	}
+	objectPixelShaderCode, err := loadShader("object.ps")
+	if err != nil {
+		return nil, err
+	}
+	hudVertexShaderCode, err := loadShader("hud.vs")
+	if err != nil {
+		return nil, err
+	}
+	hudPixelShaderCode, err := loadShader("hud.ps")
+	if err != nil {
+		return nil, err
+	}
+
+	g := &graphicsSystem{
+		window: window,
+		pp:     presentParameters(window, mode),
+	}
+
+	vertexRegisters, err := shaderRegisters(
+		objectVertexShaderCode,
+		"mvp",
+		"normalTransform",
+	)
+	if err != nil {
+		return nil, err
+	}
+	g.mvpRegister = vertexRegisters[0]
+	g.normalTransformRegister = vertexRegisters[1]
+	pixelRegisters, err := shaderRegisters(
+		objectPixelShaderCode,
+		"colorFactor",
+		"lightDirection",
+		"lightColor",
+		"ambientColor",
+		"lightParameters",
+	)
+	if err != nil {
+		return nil, err
+	}
+	g.colorFactorRegister = pixelRegisters[0]
+	g.lightDirectionRegister = pixelRegisters[1]
+	g.lightColorRegister = pixelRegisters[2]
+	g.ambientColorRegister = pixelRegisters[3]
+	g.lightParametersRegister = pixelRegisters[4]
+	hudRegisters, err := shaderRegisters(hudVertexShaderCode, "screenSize")
+	if err != nil {
+		return nil, err
+	}
+	g.screenSizeRegister = hudRegisters[0]
+
+	createFlags := uint32(d3d9.CREATE_SOFTWARE_VERTEXPROCESSING)
+	caps, err := d3d.GetDeviceCaps(adapter, d3d9.DEVTYPE_HAL)
+	if err == nil &&
+		caps.DevCaps&d3d9.DEVCAPS_HWTRANSFORMANDLIGHT != 0 {
+		createFlags = d3d9.CREATE_HARDWARE_VERTEXPROCESSING
+	}
+
+	device, _, err := d3d.CreateDevice(
+		adapter,
+		d3d9.DEVTYPE_HAL,
+		d3d9.HWND(window),
+		createFlags,
+		g.pp,
+	)
+	if err != nil {
+		return nil, errNoDirect3DDevice(err)
+	}
+	g.device = device
+
+	g.objectVertexShader, err = device.CreateVertexShaderFromBytes(objectVertexShaderCode)
+	if err != nil {
+		g.close()
+		return nil, err
+	}
+
+	g.objectPixelShader, err = device.CreatePixelShaderFromBytes(objectPixelShaderCode)
+	if err != nil {
+		g.close()
+		return nil, err
+	}
+
+	g.texturedVertex, err = device.CreateVertexDeclaration([]d3d9.VERTEXELEMENT{
+		{Offset: 0, Type: d3d9.DECLTYPE_FLOAT3, Usage: d3d9.DECLUSAGE_POSITION},
+		{Offset: 3 * 4, Type: d3d9.DECLTYPE_FLOAT3, Usage: d3d9.DECLUSAGE_NORMAL},
+		{Offset: 6 * 4, Type: d3d9.DECLTYPE_FLOAT2, Usage: d3d9.DECLUSAGE_TEXCOORD},
+		// Vertex colors are optional so they live in their own stream, see
+		// createMesh.
+		{Stream: 1, Offset: 0, Type: d3d9.DECLTYPE_D3DCOLOR, Usage: d3d9.DECLUSAGE_COLOR},
+		d3d9.DeclEnd(),
+	})
+	if err != nil {
+		g.close()
+		return nil, err
+	}
+
+	g.hudVertexShader, err = device.CreateVertexShaderFromBytes(hudVertexShaderCode)
+	if err != nil {
+		g.close()
+		return nil, err
+	}
+
+	g.hudPixelShader, err = device.CreatePixelShaderFromBytes(hudPixelShaderCode)
+	if err != nil {
+		g.close()
+		return nil, err
+	}
+
+	g.hudVertex, err = device.CreateVertexDeclaration([]d3d9.VERTEXELEMENT{
+		{Offset: 0, Type: d3d9.DECLTYPE_FLOAT2, Usage: d3d9.DECLUSAGE_POSITION},
+		{Offset: 2 * 4, Type: d3d9.DECLTYPE_FLOAT2, Usage: d3d9.DECLUSAGE_TEXCOORD},
+		{Offset: 4 * 4, Type: d3d9.DECLTYPE_FLOAT4, Usage: d3d9.DECLUSAGE_COLOR},
+		d3d9.DeclEnd(),
+	})
+	if err != nil {
+		g.close()
+		return nil, err
+	}
+
+	if err := g.setRenderStates(); err != nil {
+		g.close()
+		return nil, err
+	}
+
+	return g, nil
+}
+
+// close releases all textures and meshes that are left and the device.
+func (g *graphicsSystem) close() {
+	for i := range g.textures {
+		g.releaseTexture(textureHandle(i + 1))
+	}
+	for i := range g.meshes {
+		g.releaseMesh(meshHandle(i + 1))
+	}
+	if g.hudVertex != nil {
+		g.hudVertex.Release()
+	}
+	if g.hudPixelShader != nil {
+		g.hudPixelShader.Release()
+	}
+	if g.hudVertexShader != nil {
+		g.hudVertexShader.Release()
+	}
+	if g.texturedVertex != nil {
+		g.texturedVertex.Release()
+	}
+	if g.objectPixelShader != nil {
+		g.objectPixelShader.Release()
+	}
+	if g.objectVertexShader != nil {
+		g.objectVertexShader.Release()
+	}
+	g.device.Release()
+}
+
+// setRenderStates sets what differs from the Direct3D defaults. A reset sets
+// them back to the defaults.
+func (g *graphicsSystem) setRenderStates() error {
+	return g.device.SetRenderState(d3d9.RS_CULLMODE, uint32(d3d9.CULL_CCW))
+}
+
+func (g *graphicsSystem) createTexture(width, height int, pixels []byte) (textureHandle, error) {
+	texture, err := g.device.CreateTexture(
+		uint(width),
+		uint(height),
+		1,
+		0,
+		d3d9.FMT_A8R8G8B8,
+		d3d9.POOL_MANAGED,
+		0,
+	)
+	if err != nil {
+		return invalidTexture, err
+	}
+
+	r, err := texture.LockRect(0, nil, 0)
+	if err != nil {
+		texture.Release()
+		return invalidTexture, err
+	}
+	r.SetAllBytes(pixels, width*4)
+	err = texture.UnlockRect(0)
+	if err != nil {
+		texture.Release()
+		return invalidTexture, err
+	}
+
+	for i, t := range g.textures {
+		if t == nil {
+			g.textures[i] = texture
+			return textureHandle(i + 1), nil
+		}
+	}
+	g.textures = append(g.textures, texture)
+	return textureHandle(len(g.textures)), nil
+}
+
+func (g *graphicsSystem) releaseTexture(t textureHandle) {
+	if t <= 0 || int(t) > len(g.textures) || g.textures[t-1] == nil {
+		return
+	}
+	g.textures[t-1].Release()
+	g.textures[t-1] = nil
+}
+
+func (g *graphicsSystem) createMesh(vertices []float32, colors []uint32) (meshHandle, error) {
+	vertexBuffer, err := g.createVertexBuffer(len(vertices) * 4)
+	if err != nil {
+		return invalidMesh, err
+	}
+	if err := g.fillVertexBuffer(vertexBuffer, 0, vertices); err != nil {
+		vertexBuffer.Release()
+		return invalidMesh, err
+	}
+
+	colorSize := len(colors) * 4
+	colorBuffer, err := g.createVertexBuffer(colorSize)
+	if err != nil {
+		vertexBuffer.Release()
+		return invalidMesh, err
+	}
+	mem, err := colorBuffer.Lock(0, uint(colorSize), 0)
+	if err != nil {
+		vertexBuffer.Release()
+		colorBuffer.Release()
+		return invalidMesh, err
+	}
+	mem.SetUint32s(0, colors)
+	if err := colorBuffer.Unlock(); err != nil {
+		vertexBuffer.Release()
+		colorBuffer.Release()
+		return invalidMesh, err
+	}
+
+	mesh := direct3DMesh{
+		vertices: vertexBuffer,
+		colors:   colorBuffer,
+		bytes:    len(vertices)*4 + colorSize,
+	}
+	for i := range g.meshes {
+		if g.meshes[i].vertices == nil {
+			g.meshes[i] = mesh
+			return meshHandle(i + 1), nil
+		}
+	}
+	g.meshes = append(g.meshes, mesh)
+	return meshHandle(len(g.meshes)), nil
+}
+
+func (g *graphicsSystem) createDynamicMesh(vertexCount int) (meshHandle, error) {
+	// The vertices are written later, we only need the buffer's size here.
+	vertices := make([]float32, vertexCount*float32sPerTexturedVertex)
+	return g.createMesh(vertices, appendWhiteVertices(nil, vertexCount))
+}
+
+func (g *graphicsSystem) createVertexBuffer(size int) (*d3d9.VertexBuffer, error) {
+	return g.device.CreateVertexBuffer(
+		uint(size), d3d9.USAGE_WRITEONLY, 0, d3d9.POOL_MANAGED, 0,
+	)
+}
+
+// fillVertexBuffer copies the vertices into the buffer, offset is in floats.
+func (g *graphicsSystem) fillVertexBuffer(buffer *d3d9.VertexBuffer, offset int, vertices []float32) error {
+	if len(vertices) == 0 {
+		return nil
+	}
+	mem, err := buffer.Lock(uint(offset*4), uint(len(vertices)*4), 0)
+	if err != nil {
+		return err
+	}
+	mem.SetFloat32s(0, vertices)
+	return buffer.Unlock()
+}
+
+func (g *graphicsSystem) updateMesh(mesh meshHandle, offset int, vertices []float32) error {
+	return g.fillVertexBuffer(g.meshes[mesh-1].vertices, offset, vertices)
+}
+
+func (g *graphicsSystem) releaseMesh(mesh meshHandle) {
+	if mesh <= 0 || int(mesh) > len(g.meshes) || g.meshes[mesh-1].vertices == nil {
+		return
+	}
+	g.meshes[mesh-1].vertices.Release()
+	g.meshes[mesh-1].colors.Release()
+	g.meshes[mesh-1] = direct3DMesh{}
+	if g.boundMesh == mesh {
+		g.boundMesh = invalidMesh
+	}
+}
+
+func (g *graphicsSystem) meshMemory() (count, bytes int) {
+	for _, mesh := range g.meshes {
+		if mesh.vertices != nil {
+			count++
+			bytes += mesh.bytes
+		}
+	}
+	return
+}
+
+func (g *graphicsSystem) beginFrame(background uint8) error {
+	err := g.device.Clear(
+		nil,
+		d3d9.CLEAR_TARGET|d3d9.CLEAR_ZBUFFER,
+		d3d9.ColorRGB(background, background, background),
+		1,
+		0,
+	)
+	if err != nil {
+		return err
+	}
+	return g.device.BeginScene()
+}
+
+func (g *graphicsSystem) endFrame() error {
+	if err := g.device.EndScene(); err != nil {
+		return err
+	}
+	err := g.device.Present(nil, nil, 0, nil)
+	if err != nil && err.Code() == d3d9.ERR_DEVICELOST {
+		return errDeviceLost
+	}
+	return err
+}
+
+func (g *graphicsSystem) restore() error {
+	// We can only reset the device once our window is back in front.
+	err := g.device.TestCooperativeLevel()
+	if err == nil {
+		return nil
+	}
+	if err.Code() == d3d9.ERR_DEVICENOTRESET {
+		return g.reset()
+	}
+	return errDeviceLost
+}
+
+func (g *graphicsSystem) setDisplayMode(mode displayMode) error {
+	g.pp = presentParameters(g.window, mode)
+	return g.reset()
+}
+
+// reset applies pp. All our vertex buffers and textures are in the managed
+// pool, which Direct3D restores by itself, only the render states are back to
+// their defaults.
+func (g *graphicsSystem) reset() error {
+	params, err := g.device.Reset(g.pp)
+	if err != nil {
+		if err.Code() == d3d9.ERR_DEVICELOST {
+			return errDeviceLost
+		}
+		return err
+	}
+	g.pp = params
+	g.boundMesh = invalidMesh
+	g.objectsBound = false
+	return g.setRenderStates()
+}
+
+func (g *graphicsSystem) setViewport(x, y, width, height float32) error {
+	w, h := float32(g.pp.BackBufferWidth), float32(g.pp.BackBufferHeight)
+	return g.device.SetViewport(d3d9.VIEWPORT{
+		X:      uint32(x * w),
+		Y:      uint32(y * h),
+		Width:  uint32(width * w),
+		Height: uint32(height * h),
+		MaxZ:   1,
+	})
+}
+
+func (g *graphicsSystem) setLight(light *lightingPreset) error {
+	if err := g.device.SetPixelShaderConstantF(g.lightDirectionRegister, light.direction[:]); err != nil {
+		return err
+	}
+	if err := g.device.SetPixelShaderConstantF(g.lightColorRegister, light.color[:]); err != nil {
+		return err
+	}
+	return g.device.SetPixelShaderConstantF(g.ambientColorRegister, light.ambient[:])
+}
+
+func (g *graphicsSystem) setColor(color m.Vec4) error {
+	return g.device.SetPixelShaderConstantF(g.colorFactorRegister, color[:])
+}
+
+func (g *graphicsSystem) setMaterial(mat material) error {
+	params := [4]float32{mat.specularStrength, mat.specularExponent, mat.ambient, mat.emissive}
+	return g.device.SetPixelShaderConstantF(g.lightParametersRegister, params[:])
+}
+
+func (g *graphicsSystem) setTexture(t textureHandle) error {
+	return g.device.SetTexture(0, g.textures[t-1])
+}
+
+func (g *graphicsSystem) setTransform(mvp, normalTransform m.Mat4) error {
+	if err := g.device.SetVertexShaderConstantF(g.mvpRegister, mvp[:]); err != nil {
+		return err
+	}
+	return g.device.SetVertexShaderConstantF(g.normalTransformRegister, normalTransform[:])
+}
+
+func (g *graphicsSystem) drawMesh(mesh meshHandle, firstVertex, triangleCount int) error {
+	if !g.objectsBound {
+		if err := g.device.SetVertexDeclaration(g.texturedVertex); err != nil {
+			return err
+		}
+		if err := g.device.SetVertexShader(g.objectVertexShader); err != nil {
+			return err
+		}
+		if err := g.device.SetPixelShader(g.objectPixelShader); err != nil {
+			return err
+		}
+		g.objectsBound = true
+	}
+	if g.boundMesh != mesh {
+		const vertexSize = float32sPerTexturedVertex * 4
+		if err := g.device.SetStreamSource(0, g.meshes[mesh-1].vertices, 0, vertexSize); err != nil {
+			return err
+		}
+		if err := g.device.SetStreamSource(1, g.meshes[mesh-1].colors, 0, 4); err != nil {
+			return err
+		}
+		g.boundMesh = mesh
+	}
+	return g.device.DrawPrimitive(d3d9.PT_TRIANGLELIST, uint(firstVertex), uint(triangleCount))
+}
+
+// hudStates are the render states that the HUD changes, with the values for
+// the HUD and for the 3D scene.
+var hudStates = [...]struct {
+	state      d3d9.RENDERSTATETYPE
+	hud, scene uint32
+}{
+	{d3d9.RS_ZENABLE, d3d9.ZB_FALSE, d3d9.ZB_TRUE},
+	{d3d9.RS_CULLMODE, uint32(d3d9.CULL_NONE), uint32(d3d9.CULL_CCW)},
+	{d3d9.RS_ALPHABLENDENABLE, 1, 0},
+	{d3d9.RS_SRCBLEND, d3d9.BLEND_SRCALPHA, d3d9.BLEND_ONE},
+	{d3d9.RS_DESTBLEND, d3d9.BLEND_INVSRCALPHA, d3d9.BLEND_ZERO},
+}
+
+func (g *graphicsSystem) beginHUD(screenWidth, screenHeight float32) error {
+	for _, s := range hudStates {
+		if err := g.device.SetRenderState(s.state, s.hud); err != nil {
+			return err
+		}
+	}
+	// The HUD's vertices are not in a mesh, drawing them unbinds our
+	// streams.
+	g.objectsBound = false
+	g.boundMesh = invalidMesh
+	if err := g.device.SetVertexDeclaration(g.hudVertex); err != nil {
+		return err
+	}
+	if err := g.device.SetVertexShader(g.hudVertexShader); err != nil {
+		return err
+	}
+	if err := g.device.SetPixelShader(g.hudPixelShader); err != nil {
+		return err
+	}
+	screenSize := [4]float32{screenWidth, screenHeight, 0, 0}
+	if err := g.device.SetVertexShaderConstantF(g.screenSizeRegister, screenSize[:]); err != nil {
+		return err
+	}
+	if err := g.device.SetSamplerState(0, d3d9.SAMP_MINFILTER, d3d9.TEXF_LINEAR); err != nil {
+		return err
+	}
+	return g.device.SetSamplerState(0, d3d9.SAMP_MAGFILTER, d3d9.TEXF_LINEAR)
+}
+
+func (g *graphicsSystem) drawHUD(texture textureHandle, vertices []float32) error {
+	if err := g.setTexture(texture); err != nil {
+		return err
+	}
+	return g.device.DrawPrimitiveUP(
+		d3d9.PT_TRIANGLELIST,
+		uint(len(vertices)/(3*float32sPerHUDVertex)),
+		uintptr(unsafe.Pointer(&vertices[0])),
+		float32sPerHUDVertex*4,
+	)
+}
+
+func (g *graphicsSystem) endHUD() error {
+	var firstErr error
+	for _, s := range hudStates {
+		if err := g.device.SetRenderState(s.state, s.scene); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
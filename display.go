@@ -0,0 +1,98 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+
+	"github.com/gonutz/d3d9"
+	"github.com/gonutz/w32/v2"
+)
+
+// displayMode is a fullscreen resolution and refresh rate. The zero mode means
+// that we leave the monitor as it is and cover it with our window instead,
+// which is the default.
+type displayMode struct {
+	Width       uint32 `json:"width"`
+	Height      uint32 `json:"height"`
+	RefreshRate uint32 `json:"refreshRate"`
+}
+
+func (d displayMode) isDesktop() bool {
+	return d == displayMode{}
+}
+
+func (d displayMode) String() string {
+	if d.isDesktop() {
+		return "Desktop"
+	}
+	return fmt.Sprintf("%dx%d %d Hz", d.Width, d.Height, d.RefreshRate)
+}
+
+// displayModeFormat is the back buffer format in fullscreen modes. Every
+// Direct3D 9 card supports it.
+const displayModeFormat = d3d9.FMT_X8R8G8B8
+
+// adapterOf returns the adapter that drives the monitor. If Direct3D does not
+// know the monitor, we use the default adapter.
+func adapterOf(d3d *d3d9.Direct3D, monitor w32.HMONITOR) uint {
+	for i := range d3d.GetAdapterCount() {
+		if uintptr(d3d.GetAdapterMonitor(i)) == uintptr(monitor) {
+			return i
+		}
+	}
+	return d3d9.ADAPTER_DEFAULT
+}
+
+// listDisplayModes returns the desktop mode followed by all fullscreen modes of
+// the adapter, sorted by resolution and then refresh rate.
+func listDisplayModes(d3d *d3d9.Direct3D, adapter uint) []displayMode {
+	modes := []displayMode{{}}
+	count := d3d.GetAdapterModeCount(adapter, displayModeFormat)
+	for i := range count {
+		mode, err := d3d.EnumAdapterModes(adapter, displayModeFormat, i)
+		if err == nil {
+			modes = append(modes, displayMode{
+				Width:       mode.Width,
+				Height:      mode.Height,
+				RefreshRate: mode.RefreshRate,
+			})
+		}
+	}
+	slices.SortFunc(modes[1:], func(a, b displayMode) int {
+		return cmp.Or(
+			cmp.Compare(a.Width, b.Width),
+			cmp.Compare(a.Height, b.Height),
+			cmp.Compare(a.RefreshRate, b.RefreshRate),
+		)
+	})
+	return slices.Compact(modes)
+}
+
+// presentParameters returns the parameters to create or reset the device with
+// for the display mode.
+func presentParameters(window w32.HWND, mode displayMode) d3d9.PRESENT_PARAMETERS {
+	pp := d3d9.PRESENT_PARAMETERS{
+		Windowed:      1,
+		HDeviceWindow: d3d9.HWND(window),
+		// SWAPEFFECT_COPY lets Present define the rectangle.
+		SwapEffect: d3d9.SWAPEFFECT_COPY,
+		// We use 2048 by 2048 which gets scaled to the monitor resolution on
+		// Present.
+		BackBufferWidth:        2048,
+		BackBufferHeight:       2048,
+		BackBufferFormat:       d3d9.FMT_UNKNOWN,
+		BackBufferCount:        1,
+		EnableAutoDepthStencil: 1,
+		AutoDepthStencilFormat: d3d9.FMT_D24X8,
+	}
+	if !mode.isDesktop() {
+		// In fullscreen, the back buffer is the screen.
+		pp.Windowed = 0
+		pp.BackBufferWidth = mode.Width
+		pp.BackBufferHeight = mode.Height
+		pp.BackBufferFormat = displayModeFormat
+		pp.FullScreen_RefreshRateInHz = mode.RefreshRate
+	}
+	return pp
+}
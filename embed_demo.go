@@ -0,0 +1,13 @@
+//go:build !dev && demo
+
+package main
+
+import _ "embed"
+
+// The demo's pack only contains the assets listed in demo_assets.txt. Run
+// "go generate -tags demo" to update it, which compiles the shaders first.
+//
+//go:generate go run ./cmd/compileshaders assets/shaders
+//go:generate go run ./cmd/packassets -o assets_demo.pack -manifest demo_assets.txt assets
+//go:embed assets_demo.pack
+var embeddedAssets []byte
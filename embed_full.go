@@ -0,0 +1,13 @@
+//go:build !dev && !demo
+
+package main
+
+import _ "embed"
+
+// The shaders are compiled before packing, go generate runs the lines in
+// order.
+//
+//go:generate go run ./cmd/compileshaders assets/shaders
+//go:generate go run ./cmd/packassets -o assets.pack assets
+//go:embed assets.pack
+var embeddedAssets []byte
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/gonutz/w32/v2"
+)
+
+const errorDialogCaption = "The Game"
+
+// initError is returned when the game cannot start because some part of the
+// system is missing or not supported. message is shown to the user, err is the
+// underlying technical reason.
+type initError struct {
+	message string
+	err     error
+}
+
+func (e *initError) Error() string {
+	if e.err == nil {
+		return e.message
+	}
+	return e.message + ": " + e.err.Error()
+}
+
+func (e *initError) Unwrap() error {
+	return e.err
+}
+
+func errDirect3DMissing(err error) error {
+	return &initError{
+		message: "d3d9.dll missing.\n\n" +
+			"Direct3D 9 is not installed on this system. Please install the " +
+			"DirectX End-User Runtime and try again.",
+		err: err,
+	}
+}
+
+func errNoDirect3DDevice(err error) error {
+	return &initError{
+		message: "No compatible Direct3D 9 device found.\n\n" +
+			"Please make sure that your graphics card drivers are up to date.",
+		err: err,
+	}
+}
+
+func errShaderCompilerMissing(err error) error {
+	return &initError{
+		message: "D3DCompiler_XX.dll missing.\n\n" +
+			"The shader compiler is not installed on this system. Please " +
+			"install the DirectX End-User Runtime and try again.",
+		err: err,
+	}
+}
+
+func errDirectInputMissing(err error) error {
+	return &initError{
+		message: "dinput8.dll missing.\n\n" +
+			"DirectInput 8 is not installed on this system. Please install " +
+			"the DirectX End-User Runtime and try again.",
+		err: err,
+	}
+}
+
+func errNoSoundDevice(err error) error {
+	return &initError{
+		message: "No sound device found.\n\n" +
+			"Please make sure that your speakers or headphones are connected " +
+			"and enabled.",
+		err: err,
+	}
+}
+
+// requireDLL makes sure that the given system DLL can be loaded. The DirectX
+// wrappers load their DLLs lazily and panic when a function is called on a
+// missing DLL, so we check for them up front.
+func requireDLL(name string, makeErr func(error) error) error {
+	if err := syscall.NewLazyDLL(name).Load(); err != nil {
+		return makeErr(err)
+	}
+	return nil
+}
+
+// requireShaderCompiler makes sure that any version of the D3DCompiler DLL is
+// installed, this is the same search that dxc does when compiling a shader.
+func requireShaderCompiler() error {
+	var err error
+	for i := 47; i >= 0; i-- {
+		err = syscall.NewLazyDLL(fmt.Sprintf("D3DCompiler_%02d.dll", i)).Load()
+		if err == nil {
+			return nil
+		}
+	}
+	return errShaderCompilerMissing(err)
+}
+
+// reportFatalError is deferred at the very start of main. check panics on any
+// error, which unwinds main and runs all the other deferred Release calls
+// first. Once everything is cleaned up, we get here and tell the user what
+// went wrong in a message box instead of leaving them with a stack trace.
+func reportFatalError() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	mainLoopWatchdog.stop()
+
+	var message string
+	var initErr *initError
+	if err, ok := r.(error); ok && errors.As(err, &initErr) {
+		message = initErr.message
+	} else {
+		message = fmt.Sprintf("The game crashed unexpectedly.\n\n%v", r)
+	}
+
+	w32.ShowCursor(true)
+	w32.MessageBox(0, message, errorDialogCaption, w32.MB_OK|w32.MB_ICONERROR)
+	os.Exit(1)
+}
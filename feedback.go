@@ -0,0 +1,155 @@
+package main
+
+import (
+	"math"
+
+	m "github.com/gonutz/d3dmath/column_major/d3dmath"
+)
+
+// feedbackEvent is something that happens to a player which they should feel
+// through the controller's rumble motors and see as camera shake.
+type feedbackEvent int
+
+const (
+	feedbackStep feedbackEvent = iota
+	feedbackLand
+	feedbackDamage
+	feedbackCombo
+	feedbackDash
+
+	feedbackEventCount
+)
+
+// feedbackPattern describes the rumble and camera shake for an event. The
+// strength rises linearly over attack frames, stays for hold frames and falls
+// back to 0 over release frames.
+type feedbackPattern struct {
+	// low and high are the speeds of the low and high frequency motors at
+	// full strength, from 0 to 1. The low frequency motor gives heavy thuds,
+	// the high frequency motor a light buzz.
+	low, high float32
+	// shake is how far, in world units, the camera moves at full strength.
+	shake                 float32
+	attack, hold, release int
+}
+
+// feedbackPatterns is where all the rumble and shake is tuned. The game code
+// only says which event happened.
+var feedbackPatterns = [feedbackEventCount]feedbackPattern{
+	feedbackStep:   {high: 0.15, hold: 2, release: 3},
+	feedbackLand:   {low: 0.45, high: 0.2, shake: 0.04, hold: 3, release: 8},
+	feedbackDamage: {low: 1, high: 0.6, shake: 0.2, hold: 8, release: 16},
+	feedbackCombo:  {low: 0.2, high: 0.8, attack: 6, hold: 6, release: 12},
+	feedbackDash:   {low: 0.3, high: 0.3, attack: 2, hold: 4, release: 8},
+}
+
+func (p *feedbackPattern) frames() int {
+	return p.attack + p.hold + p.release
+}
+
+// strength is the envelope's value in the given frame after the event.
+func (p *feedbackPattern) strength(frame int) float32 {
+	switch {
+	case frame < p.attack:
+		return float32(frame+1) / float32(p.attack+1)
+	case frame < p.attack+p.hold:
+		return 1
+	case frame < p.frames():
+		return float32(p.frames()-frame) / float32(p.release+1)
+	}
+	return 0
+}
+
+// maxFeedbacks is how many events a player can feel at the same time. If more
+// happen, they replace the oldest. This keeps feedback free of allocations.
+const maxFeedbacks = 4
+
+type activeFeedback struct {
+	event feedbackEvent
+	frame int
+}
+
+type playerFeedback struct {
+	active [maxFeedbacks]activeFeedback
+	count  int
+	// low and high are the motor speeds last sent to the controller.
+	low, high float32
+	shake     float32
+}
+
+// feedback plays the rumble and shake patterns for both players. The motor
+// speeds go to the input backend, which only XBox controllers act on.
+type feedback struct {
+	players [2]playerFeedback
+	// frame only drives the direction of the camera shake.
+	frame int
+}
+
+// trigger starts the pattern for the event on the player's controller and
+// camera.
+func (f *feedback) trigger(player int, e feedbackEvent) {
+	p := &f.players[player]
+	if p.count == maxFeedbacks {
+		copy(p.active[:], p.active[1:])
+		p.count--
+	}
+	p.active[p.count] = activeFeedback{event: e}
+	p.count++
+}
+
+// update advances all patterns by one frame and sends the new motor speeds to
+// the input backend, but only if they changed.
+func (f *feedback) update(input inputSource) {
+	f.frame++
+	for i := range f.players {
+		p := &f.players[i]
+		var low, high, shake float32
+		n := 0
+		for _, a := range p.active[:p.count] {
+			pattern := &feedbackPatterns[a.event]
+			s := pattern.strength(a.frame)
+			low = max(low, s*pattern.low)
+			high = max(high, s*pattern.high)
+			shake = max(shake, s*pattern.shake)
+			a.frame++
+			if a.frame < pattern.frames() {
+				p.active[n] = a
+				n++
+			}
+		}
+		p.count = n
+		p.shake = shake
+		if low != p.low || high != p.high {
+			p.low, p.high = low, high
+			input.rumble(i, low, high)
+		}
+	}
+}
+
+// stop ends all patterns and turns the motors off, e.g. when pausing.
+func (f *feedback) stop(input inputSource) {
+	for i := range f.players {
+		p := &f.players[i]
+		p.count = 0
+		p.shake = 0
+		if p.low != 0 || p.high != 0 {
+			p.low, p.high = 0, 0
+			input.rumble(i, 0, 0)
+		}
+	}
+}
+
+// shakeOffset is how far to move the player's camera this frame. It uses no
+// randomness so replays with the same seed stay the same.
+func (f *feedback) shakeOffset(player int) m.Vec3 {
+	s := f.players[player].shake
+	if s == 0 {
+		return m.Vec3{}
+	}
+	t := float64(f.frame)
+	return m.Vec3{
+		s * float32(math.Sin(t*2.1)),
+		s * float32(math.Sin(t*2.9+1)),
+		s * float32(math.Sin(t*2.5+2)),
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+// The field of view is a setting, in degrees. It is the vertical field of
+// view of the level's cameras. The controller scenes show the controllers up
+// close with a wider angle, they add controllerFOVOffset to keep their
+// framing. Each scene clamps the result to what still looks right: narrower
+// hides too much of the level around the joker, wider distorts the corners.
+const (
+	defaultFieldOfView  = 50
+	minFieldOfView      = 35
+	maxFieldOfView      = 90
+	fieldOfViewStep     = 5
+	controllerFOVOffset = 30
+	minControllerFOV    = 60
+	maxControllerFOV    = 100
+)
+
+// levelFieldOfView is the field of view for the level, in degrees.
+func levelFieldOfView(setting float64) float32 {
+	return float32(max(minFieldOfView, min(maxFieldOfView, setting)))
+}
+
+// controllerFieldOfView is the field of view for the XBox controller and
+// joystick scenes, in degrees.
+func controllerFieldOfView(setting float64) float32 {
+	fov := setting + controllerFOVOffset
+	return float32(max(minControllerFOV, min(maxControllerFOV, fov)))
+}
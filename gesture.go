@@ -0,0 +1,82 @@
+package main
+
+import "time"
+
+const (
+	// A double tap must be completed in this time, from the first press to
+	// the second.
+	doubleTapWindow = 300 * time.Millisecond
+	// A quarter circle must be completed in this time.
+	quarterCircleWindow = 400 * time.Millisecond
+)
+
+// gestures are the moves that were completed in this frame.
+type gestures struct {
+	// doubleTapForward is pushing the stick forward twice quickly.
+	doubleTapForward bool
+	// quarterCircle is rolling the stick from back to the left or right side,
+	// going through the diagonal in between.
+	quarterCircle bool
+}
+
+// gestureDetector recognizes gestures in the directions that a stick or D-pad
+// points to over time.
+type gestureDetector struct {
+	last    directions
+	history []directionChange
+}
+
+type directionChange struct {
+	dir directions
+	at  time.Time
+}
+
+// The history only needs to be as long as the longest gesture.
+const gestureHistoryLen = 4
+
+// update is called every frame with the current direction.
+func (g *gestureDetector) update(d directions, now time.Time) gestures {
+	if d == g.last {
+		return gestures{}
+	}
+	g.last = d
+
+	if len(g.history) == gestureHistoryLen {
+		copy(g.history, g.history[1:])
+		g.history = g.history[:len(g.history)-1]
+	}
+	g.history = append(g.history, directionChange{dir: d, at: now})
+
+	var found gestures
+	forward := directions{up: true}
+	if g.matches(doubleTapWindow, forward, directions{}, forward) {
+		found.doubleTapForward = true
+	}
+	back := directions{down: true}
+	if g.matches(quarterCircleWindow,
+		back, directions{down: true, left: true}, directions{left: true}) ||
+		g.matches(quarterCircleWindow,
+			back, directions{down: true, right: true}, directions{right: true}) {
+		found.quarterCircle = true
+	}
+	if found != (gestures{}) {
+		// Start over so the same input does not trigger twice.
+		g.history = g.history[:0]
+	}
+	return found
+}
+
+// matches is true if the most recent direction changes are the given sequence
+// and the whole sequence took at most window.
+func (g *gestureDetector) matches(window time.Duration, sequence ...directions) bool {
+	if len(sequence) > len(g.history) {
+		return false
+	}
+	recent := g.history[len(g.history)-len(sequence):]
+	for i, d := range sequence {
+		if recent[i].dir != d {
+			return false
+		}
+	}
+	return recent[len(recent)-1].at.Sub(recent[0].at) <= window
+}
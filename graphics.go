@@ -2,11 +2,15 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"image"
 	"image/draw"
 	"math"
+	"path"
+	"path/filepath"
 
-	"github.com/gonutz/d3d9"
+	m "github.com/gonutz/d3dmath/column_major/d3dmath"
+	"github.com/gonutz/dxc"
 	"github.com/gonutz/obj"
 )
 
@@ -15,29 +19,47 @@ type model []modelPart
 // modelPart is a 3D modelPart with some meta data.
 type modelPart struct {
 	name        string
+	material    string
 	firstVertex int
 	endVertex   int
-	box         aabb
+	box         m.AABB
 }
 
-type minMax struct {
-	min float32
-	max float32
+// float32sPerTexturedVertex is the size of our model vertices: position,
+// normal and texture coordinate. Their colors are in a separate stream.
+const float32sPerTexturedVertex = 8
+
+// whiteVertex is the vertex color of models without vertex colors, it leaves
+// their textures unchanged.
+const whiteVertex = 0xFFFFFFFF
+
+// vertexColor converts an RGB color with components in [0..1] to a D3DCOLOR.
+func vertexColor(c [3]float32) uint32 {
+	toByte := func(f float32) uint32 {
+		return uint32(max(0, min(1, f))*255 + 0.5)
+	}
+	return 0xFF000000 | toByte(c[0])<<16 | toByte(c[1])<<8 | toByte(c[2])
 }
 
-var emptyMinMax = minMax{
-	min: float32(math.Inf(1)),
-	max: float32(math.Inf(-1)),
+func appendWhiteVertices(colors []uint32, count int) []uint32 {
+	for range count {
+		colors = append(colors, whiteVertex)
+	}
+	return colors
 }
 
-type aabb struct {
-	x, y, z minMax
+// drawTriangles draws a triangle list from the mesh and counts it for the
+// -profile counters and the F3 overlay.
+func drawTriangles(gfx renderer, mesh meshHandle, firstVertex, triangleCount int) error {
+	counters.drawCalls++
+	counters.triangles += triangleCount
+	return gfx.drawMesh(mesh, firstVertex, triangleCount)
 }
 
-var emptyAABB = aabb{
-	x: emptyMinMax,
-	y: emptyMinMax,
-	z: emptyMinMax,
+// drawPart draws the model part from the mesh that holds the model.
+func drawPart(gfx renderer, mesh meshHandle, part modelPart) error {
+	vertexCount := (part.endVertex - part.firstVertex) / float32sPerTexturedVertex
+	return drawTriangles(gfx, mesh, part.firstVertex/float32sPerTexturedVertex, vertexCount/3)
 }
 
 func color(c uint32) float32 {
@@ -73,48 +95,234 @@ func decodeRGBA(data []byte) (*image.RGBA, error) {
 	return rgba, nil
 }
 
-func loadTexture(device *d3d9.Device, path string) (*d3d9.Texture, error) {
-	data, err := assetFiles.ReadFile(path)
+func loadTexture(gfx renderer, path string) (textureHandle, error) {
+	data, err := readAsset(path)
 	if err != nil {
-		return nil, err
+		return invalidTexture, err
 	}
 
 	img, err := readImage(data)
 	if err != nil {
-		return nil, err
+		return invalidTexture, err
+	}
+
+	return gfx.createTexture(img.Bounds().Dx(), img.Bounds().Dy(), img.Pix)
+}
+
+// createWhiteTexture creates a 1 by 1 white texture. It is used for models
+// that have no texture, their color comes from renderer.setColor alone.
+func createWhiteTexture(gfx renderer) (textureHandle, error) {
+	return gfx.createTexture(1, 1, []byte{255, 255, 255, 255})
+}
+
+// gemVertices returns the triangles of an octahedron that is twice as high as
+// it is wide, centered at the origin and reaching from -1 to 1 in Y. Each
+// vertex has a position, normal and texture coordinate, like the vertices of
+// models loaded from obj files.
+func gemVertices() []float32 {
+	top := [3]float32{0, 1, 0}
+	bottom := [3]float32{0, -1, 0}
+	ring := [4][3]float32{
+		{0.5, 0, 0},
+		{0, 0, 0.5},
+		{-0.5, 0, 0},
+		{0, 0, -0.5},
+	}
+
+	var vertices []float32
+	addTriangle := func(a, b, c [3]float32) {
+		// The flat normal is the cross product of two of the triangle's edges.
+		u := [3]float32{b[0] - a[0], b[1] - a[1], b[2] - a[2]}
+		v := [3]float32{c[0] - a[0], c[1] - a[1], c[2] - a[2]}
+		n := [3]float32{
+			u[1]*v[2] - u[2]*v[1],
+			u[2]*v[0] - u[0]*v[2],
+			u[0]*v[1] - u[1]*v[0],
+		}
+		length := float32(math.Sqrt(float64(n[0]*n[0] + n[1]*n[1] + n[2]*n[2])))
+		for _, p := range [3][3]float32{a, b, c} {
+			vertices = append(vertices,
+				p[0], p[1], p[2],
+				n[0]/length, n[1]/length, n[2]/length,
+				0, 0,
+			)
+		}
+	}
+
+	// We cull counter-clockwise triangles, so we list them clockwise as seen
+	// from the outside.
+	for i := range ring {
+		a, b := ring[i], ring[(i+1)%len(ring)]
+		addTriangle(top, b, a)
+		addTriangle(bottom, a, b)
+	}
+
+	return vertices
+}
+
+// tileVertices creates a flat quad of size 1 by 1, facing up. It extends from
+// the origin along positive X and negative Z, just like a level tile.
+func tileVertices() []float32 {
+	return []float32{
+		0, 0, 0, 0, 1, 0, 0, 0,
+		1, 0, 0, 0, 1, 0, 0, 0,
+		1, 0, -1, 0, 1, 0, 0, 0,
+
+		0, 0, 0, 0, 1, 0, 0, 0,
+		1, 0, -1, 0, 1, 0, 0, 0,
+		0, 0, -1, 0, 1, 0, 0, 0,
+	}
+}
+
+// boxVertices creates a box of size 1 by 1 by 1. Like a level tile, it extends
+// from the origin along positive X and negative Z, and it goes up along
+// positive Y.
+func boxVertices() []float32 {
+	var vertices []float32
+	// The corners of each face are listed clockwise as seen from the outside.
+	addQuad := func(n [3]float32, corners [4][3]float32) {
+		for _, i := range [6]int{0, 1, 2, 0, 2, 3} {
+			p := corners[i]
+			vertices = append(vertices,
+				p[0], p[1], p[2],
+				n[0], n[1], n[2],
+				0, 0,
+			)
+		}
+	}
+	addQuad([3]float32{0, 1, 0}, [4][3]float32{{0, 1, 0}, {1, 1, 0}, {1, 1, -1}, {0, 1, -1}})
+	addQuad([3]float32{0, -1, 0}, [4][3]float32{{0, 0, 0}, {0, 0, -1}, {1, 0, -1}, {1, 0, 0}})
+	addQuad([3]float32{-1, 0, 0}, [4][3]float32{{0, 0, 0}, {0, 1, 0}, {0, 1, -1}, {0, 0, -1}})
+	addQuad([3]float32{1, 0, 0}, [4][3]float32{{1, 0, 0}, {1, 0, -1}, {1, 1, -1}, {1, 1, 0}})
+	addQuad([3]float32{0, 0, 1}, [4][3]float32{{0, 0, 0}, {1, 0, 0}, {1, 1, 0}, {0, 1, 0}})
+	addQuad([3]float32{0, 0, -1}, [4][3]float32{{0, 0, -1}, {0, 1, -1}, {1, 1, -1}, {1, 0, -1}})
+	return vertices
+}
+
+// rampVertices creates a wedge that fits into a level tile. It rises from
+// height 0 at Z=0 to height 1 at Z=-1, so walking along negative Z goes up.
+// It has no bottom face, it always sits on the floor.
+func rampVertices() []float32 {
+	var vertices []float32
+	// addTriangle maps each corner's texture coordinates into uv, the
+	// function st gives a corner's position in the face, in [0..1].
+	addTriangle := func(n [3]float32, uv [4]float32, st func(p [3]float32) (s, t float32), a, b, c [3]float32) {
+		for _, p := range [3][3]float32{a, b, c} {
+			s, t := st(p)
+			vertices = append(vertices,
+				p[0], p[1], p[2],
+				n[0], n[1], n[2],
+				uv[0]+s*(uv[2]-uv[0]), uv[1]+t*(uv[3]-uv[1]),
+			)
+		}
 	}
+	alongSlope := func(p [3]float32) (float32, float32) { return p[0], -p[2] }
+	acrossWall := func(p [3]float32) (float32, float32) { return p[0], 1 - p[1] }
+	alongSide := func(p [3]float32) (float32, float32) { return -p[2], 1 - p[1] }
+
+	// The slope's normal points up and back, towards positive Z.
+	s := float32(math.Sqrt(0.5))
+	addTriangle([3]float32{0, s, s}, floorUV, alongSlope, [3]float32{0, 0, 0}, [3]float32{1, 1, -1}, [3]float32{0, 1, -1})
+	addTriangle([3]float32{0, s, s}, floorUV, alongSlope, [3]float32{0, 0, 0}, [3]float32{1, 0, 0}, [3]float32{1, 1, -1})
+	// The high end is a wall.
+	addTriangle([3]float32{0, 0, -1}, blockUV, acrossWall, [3]float32{0, 0, -1}, [3]float32{0, 1, -1}, [3]float32{1, 1, -1})
+	addTriangle([3]float32{0, 0, -1}, blockUV, acrossWall, [3]float32{0, 0, -1}, [3]float32{1, 1, -1}, [3]float32{1, 0, -1})
+	// The triangular sides.
+	addTriangle([3]float32{-1, 0, 0}, blockUV, alongSide, [3]float32{0, 0, 0}, [3]float32{0, 1, -1}, [3]float32{0, 0, -1})
+	addTriangle([3]float32{1, 0, 0}, blockUV, alongSide, [3]float32{1, 0, 0}, [3]float32{1, 0, -1}, [3]float32{1, 1, -1})
+
+	return vertices
+}
 
-	texture, err := device.CreateTexture(
-		uint(img.Bounds().Dx()),
-		uint(img.Bounds().Dy()),
-		1,
-		0,
-		d3d9.FMT_A8R8G8B8,
-		d3d9.POOL_MANAGED,
-		0,
-	)
+func loadObj(path string) (*obj.File, error) {
+	data, err := readAsset(path)
 	if err != nil {
 		return nil, err
 	}
-
-	r, err := texture.LockRect(0, nil, d3d9.LOCK_DISCARD)
+	options := obj.DecodeOptions{Validate: true}
+	var f *obj.File
+	if dir, dirErr := dataDir(); dirErr == nil {
+		// Parsing the big models takes a while, we keep binary copies of them
+		// in our data directory.
+		cache := obj.Cache{Dir: filepath.Join(dir, "model_cache")}
+		f, err = cache.Decode(data, options)
+	} else {
+		f, err = obj.DecodeWithOptions(bytes.NewReader(data), options)
+	}
 	if err != nil {
 		return nil, err
 	}
-	r.SetAllBytes(img.Pix, img.Stride)
-	err = texture.UnlockRect(0)
+	// Our shaders need normals for lighting, exporters do not always write
+	// them.
+	if f.HasMissingNormals() {
+		f.GenerateNormals(obj.SmoothNormals)
+	}
+	return f, nil
+}
+
+// loadShader returns the bytecode for the shader assets/shaders/<name>.hlsl,
+// where name ends in .vs for vertex shaders and .ps for pixel shaders. Release
+// builds use the precompiled assets/shaders/<name>.fxo, see
+// cmd/compileshaders. A pack without it was built wrong, we do not hide that by
+// compiling at start-up. Dev builds compile the HLSL function main so changes
+// to the source take effect.
+func loadShader(name string) ([]byte, error) {
+	base := path.Join("assets/shaders", name)
+	if !hotReloadAssets {
+		code, err := readAsset(base + ".fxo")
+		if err != nil {
+			return nil, fmt.Errorf("shader %s was not compiled into the asset pack: %w", name, err)
+		}
+		return code, nil
+	}
+
+	var target string
+	switch path.Ext(name) {
+	case ".vs":
+		target = "vs_3_0"
+	case ".ps":
+		target = "ps_3_0"
+	default:
+		return nil, fmt.Errorf("shader %s is neither .vs nor .ps", name)
+	}
+	code, err := readAsset(base + ".hlsl")
 	if err != nil {
 		return nil, err
 	}
+	if err := requireShaderCompiler(); err != nil {
+		return nil, err
+	}
 
-	return texture, nil
+	// Compiling takes a noticeable part of our start-up time so we keep the
+	// bytecode in our data directory. Shaders can #include the shared headers
+	// in assets/shaders.
+	const flags = dxc.WARNINGS_ARE_ERRORS
+	include := func(name string, system bool) ([]byte, error) {
+		return readAsset(path.Join("assets/shaders", name))
+	}
+	if dir, err := dataDir(); err == nil {
+		cache := dxc.Cache{Dir: filepath.Join(dir, "shader_cache")}
+		return cache.CompileWithInclude(code, "main", target, nil, include, flags, 0)
+	}
+	return dxc.CompileWithInclude(code, "main", target, nil, include, flags, 0)
 }
 
-func loadObj(path string) (*obj.File, error) {
-	data, err := assetFiles.ReadFile(path)
+// shaderRegisters returns the first register of each of the named constants in
+// the compiled shader code, in the same order. This way our HLSL code does not
+// need to hard-code the registers. The compiler removes unused constants, we
+// return an error if a name is missing.
+func shaderRegisters(code []byte, names ...string) ([]uint, error) {
+	table, err := dxc.Reflect(code)
 	if err != nil {
 		return nil, err
 	}
-	return obj.Decode(bytes.NewReader(data))
-
+	registers := make([]uint, len(names))
+	for i, name := range names {
+		c, ok := table.Find(name)
+		if !ok {
+			return nil, fmt.Errorf("shader constant %q not found in %s shader", name, table.Target)
+		}
+		registers[i] = uint(c.RegisterIndex)
+	}
+	return registers, nil
 }
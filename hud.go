@@ -0,0 +1,434 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	m "github.com/gonutz/d3dmath/column_major/d3dmath"
+	"github.com/gonutz/w32/v2"
+)
+
+const (
+	// The font atlas holds the ASCII characters 32 to 127 in a grid of 16 by 6
+	// cells. Character 127 (DEL) is not printable, we fill its cell with solid
+	// white and use it for drawing rectangles. Below the characters are the
+	// sprites, see hudSprite.
+	fontFirstChar   = 32
+	fontCharCount   = 96
+	fontColumns     = 16
+	fontCellWidth   = 32
+	fontCellHeight  = 40
+	fontPixelHeight = 30
+	fontAtlasWidth  = fontColumns * fontCellWidth
+	fontAtlasHeight = 512
+	solidChar       = 127
+	// Sprites are square cells of spriteSize pixels in the row below the
+	// characters.
+	spriteSize = fontCellHeight
+	spriteRowY = fontCharCount / fontColumns * fontCellHeight
+
+	// A HUD vertex has a 2D position in pixels, a texture coordinate and an
+	// RGBA color.
+	float32sPerHUDVertex = 8
+)
+
+// hud draws 2D overlays like text and rectangles on top of the 3D scene.
+// Positions and sizes are in pixels of the window's client area, the origin is
+// the top-left corner. All calls to rect and text are collected and drawn at
+// once when calling draw.
+type hud struct {
+	gfx    renderer
+	font   textureHandle
+	glyphs [fontCharCount]glyph
+	// vertices are collected during the frame and cleared after drawing. We
+	// keep the slice around to not allocate it anew every frame.
+	vertices []float32
+	// batches split the vertices into runs that use the same texture, in the
+	// order in which they were added.
+	batches []hudBatch
+}
+
+type hudBatch struct {
+	texture textureHandle
+	// firstVertex is the index of the batch's first float in vertices.
+	firstVertex int
+}
+
+// hudSprite is a white shape in the font atlas that is drawn tinted, e.g. as
+// the background of a button prompt.
+type hudSprite int
+
+const (
+	// spriteCircle is a filled circle, like the buttons on a controller.
+	spriteCircle hudSprite = iota
+	// spriteKey is a rounded square, like a key on the keyboard.
+	spriteKey
+
+	spriteCount
+)
+
+// glyph is a character's place in the font atlas, in texture coordinates, and
+// its width in pixels when drawn at the atlas' font size.
+type glyph struct {
+	u0, v0, u1, v1 float32
+	width          float32
+}
+
+func newHUD(gfx renderer) (*hud, error) {
+	h := &hud{
+		gfx:      gfx,
+		vertices: make([]float32, 0, 4096),
+		batches:  make([]hudBatch, 0, 8),
+	}
+
+	var err error
+	h.font, h.glyphs, err = createFontAtlas(gfx)
+	if err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+func (h *hud) release() {
+	h.gfx.releaseTexture(h.font)
+}
+
+// rect adds a filled rectangle at x,y (top-left corner) with size w,h.
+func (h *hud) rect(x, y, w, height float32, color m.Vec4) {
+	g := h.glyphs[solidChar-fontFirstChar]
+	// Sample the center of the white cell so filtering does not bleed in the
+	// neighboring characters.
+	u := (g.u0 + g.u1) / 2
+	v := (g.v0 + g.v1) / 2
+	h.useTexture(h.font)
+	h.quad(x, y, x+w, y+height, u, v, u, v, color)
+}
+
+// text adds a line of text with its top-left corner at x,y. size is the line
+// height in pixels.
+func (h *hud) text(x, y, size float32, text string, color m.Vec4) {
+	h.useTexture(h.font)
+	for _, r := range text {
+		x += h.char(x, y, size, r, color)
+	}
+}
+
+// textBytes is like text for a byte buffer. The HUD formats changing numbers
+// into a reused buffer, which unlike fmt.Sprintf does not allocate every
+// frame.
+func (h *hud) textBytes(x, y, size float32, text []byte, color m.Vec4) {
+	h.useTexture(h.font)
+	// Ranging over the converted string does not copy the bytes.
+	for _, r := range string(text) {
+		x += h.char(x, y, size, r, color)
+	}
+}
+
+// char adds the quad for a single character and returns its width.
+func (h *hud) char(x, y, size float32, r rune, color m.Vec4) float32 {
+	g := h.glyphFor(r)
+	w := g.width * size / fontCellHeight
+	h.quad(x, y, x+w, y+size, g.u0, g.v0, g.u0+g.width/fontAtlasWidth, g.v1, color)
+	return w
+}
+
+// sprite adds the sprite, tinted with color, with its top-left corner at x,y.
+// If it is wider than high, only its middle is stretched so the rounded ends
+// keep their shape.
+func (h *hud) sprite(s hudSprite, x, y, w, height float32, color m.Vec4) {
+	u0 := float32(int(s)*spriteSize) / fontAtlasWidth
+	u1 := float32(int(s+1)*spriteSize) / fontAtlasWidth
+	v0 := float32(spriteRowY) / fontAtlasHeight
+	v1 := float32(spriteRowY+spriteSize) / fontAtlasHeight
+	h.useTexture(h.font)
+	if w <= height {
+		h.quad(x, y, x+w, y+height, u0, v0, u1, v1, color)
+		return
+	}
+	uMid := (u0 + u1) / 2
+	end := height / 2
+	h.quad(x, y, x+end, y+height, u0, v0, uMid, v1, color)
+	h.quad(x+end, y, x+w-end, y+height, uMid, v0, uMid, v1, color)
+	h.quad(x+w-end, y, x+w, y+height, uMid, v0, u1, v1, color)
+}
+
+// image adds a rectangle at x,y (top-left corner) with size w,h that shows
+// part of the given texture. uvs are the texture coordinates for the corners
+// top-left, top-right, bottom-left and bottom-right, which allows rotating or
+// mirroring the image.
+func (h *hud) image(texture textureHandle, x, y, w, height float32, uvs [4][2]float32) {
+	h.useTexture(texture)
+	c := m.Vec4{1, 1, 1, 1}
+	x1, y1 := x+w, y+height
+	h.vertices = append(h.vertices,
+		x, y, uvs[0][0], uvs[0][1], c[0], c[1], c[2], c[3],
+		x1, y, uvs[1][0], uvs[1][1], c[0], c[1], c[2], c[3],
+		x, y1, uvs[2][0], uvs[2][1], c[0], c[1], c[2], c[3],
+
+		x, y1, uvs[2][0], uvs[2][1], c[0], c[1], c[2], c[3],
+		x1, y, uvs[1][0], uvs[1][1], c[0], c[1], c[2], c[3],
+		x1, y1, uvs[3][0], uvs[3][1], c[0], c[1], c[2], c[3],
+	)
+}
+
+func (h *hud) useTexture(t textureHandle) {
+	if len(h.batches) == 0 || h.batches[len(h.batches)-1].texture != t {
+		h.batches = append(h.batches, hudBatch{
+			texture:     t,
+			firstVertex: len(h.vertices),
+		})
+	}
+}
+
+// wrapText splits the text into lines that are at most width pixels wide
+// when drawn at the given size. Lines are only broken between words.
+func (h *hud) wrapText(text string, size, width float32) []string {
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(text) {
+		if line == "" {
+			line = word
+		} else if h.textWidth(line+" "+word, size) <= width {
+			line += " " + word
+		} else {
+			lines = append(lines, line)
+			line = word
+		}
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// textWidth returns the width in pixels of the given text when drawn at the
+// given size.
+func (h *hud) textWidth(text string, size float32) float32 {
+	var w float32
+	for _, r := range text {
+		w += h.glyphFor(r).width
+	}
+	return w * size / fontCellHeight
+}
+
+// textBytesWidth is textWidth for a byte buffer, see textBytes.
+func (h *hud) textBytesWidth(text []byte, size float32) float32 {
+	var w float32
+	for _, r := range string(text) {
+		w += h.glyphFor(r).width
+	}
+	return w * size / fontCellHeight
+}
+
+func (h *hud) glyphFor(r rune) glyph {
+	if r < fontFirstChar || r >= solidChar {
+		r = '?'
+	}
+	return h.glyphs[r-fontFirstChar]
+}
+
+func (h *hud) quad(x0, y0, x1, y1, u0, v0, u1, v1 float32, c m.Vec4) {
+	h.vertices = append(h.vertices,
+		x0, y0, u0, v0, c[0], c[1], c[2], c[3],
+		x1, y0, u1, v0, c[0], c[1], c[2], c[3],
+		x0, y1, u0, v1, c[0], c[1], c[2], c[3],
+
+		x0, y1, u0, v1, c[0], c[1], c[2], c[3],
+		x1, y0, u1, v0, c[0], c[1], c[2], c[3],
+		x1, y1, u1, v1, c[0], c[1], c[2], c[3],
+	)
+}
+
+// draw renders everything that was added since the last draw on top of the
+// current scene. It must be called between renderer.beginFrame and endFrame.
+func (h *hud) draw(screenWidth, screenHeight float32) error {
+	if len(h.vertices) == 0 {
+		return nil
+	}
+	defer func() {
+		h.vertices = h.vertices[:0]
+		h.batches = h.batches[:0]
+	}()
+
+	if err := h.gfx.beginHUD(screenWidth, screenHeight); err != nil {
+		h.gfx.endHUD()
+		return err
+	}
+	for i, b := range h.batches {
+		end := len(h.vertices)
+		if i+1 < len(h.batches) {
+			end = h.batches[i+1].firstVertex
+		}
+		if end == b.firstVertex {
+			continue
+		}
+		counters.drawCalls++
+		counters.triangles += (end - b.firstVertex) / (3 * float32sPerHUDVertex)
+		if err := h.gfx.drawHUD(b.texture, h.vertices[b.firstVertex:end]); err != nil {
+			h.gfx.endHUD()
+			return err
+		}
+	}
+	return h.gfx.endHUD()
+}
+
+// formatLevelTime formats a duration as minutes, seconds and tenths of a
+// second, e.g. "01:23.4".
+func formatLevelTime(d time.Duration) string {
+	return string(appendLevelTime(nil, d))
+}
+
+// appendLevelTime appends the formatLevelTime of d to buf.
+func appendLevelTime(buf []byte, d time.Duration) []byte {
+	tenths := int(d / (100 * time.Millisecond))
+	buf = appendTwoDigits(buf, tenths/600)
+	buf = append(buf, ':')
+	buf = appendTwoDigits(buf, tenths/10%60)
+	buf = append(buf, '.')
+	return strconv.AppendInt(buf, int64(tenths%10), 10)
+}
+
+// appendTwoDigits appends n with a leading zero if it has only one digit.
+func appendTwoDigits(buf []byte, n int) []byte {
+	if 0 <= n && n < 10 {
+		buf = append(buf, '0')
+	}
+	return strconv.AppendInt(buf, int64(n), 10)
+}
+
+// formatPlayTime shows longer durations in hours, minutes and seconds.
+func formatPlayTime(d time.Duration) string {
+	seconds := int(d / time.Second)
+	return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+}
+
+var gdiFlush = syscall.NewLazyDLL("gdi32.dll").NewProc("GdiFlush")
+
+// createFontAtlas renders the printable ASCII characters with GDI into a
+// bitmap and copies it into a texture. The texture is white with the glyph
+// coverage in the alpha channel.
+func createFontAtlas(gfx renderer) (textureHandle, [fontCharCount]glyph, error) {
+	var glyphs [fontCharCount]glyph
+
+	dc := w32.CreateCompatibleDC(0)
+	if dc == 0 {
+		return invalidTexture, glyphs, errors.New("CreateCompatibleDC failed")
+	}
+	defer w32.DeleteDC(dc)
+
+	info := w32.BITMAPINFO{BmiHeader: w32.BITMAPINFOHEADER{
+		BiSize:     uint32(unsafe.Sizeof(w32.BITMAPINFOHEADER{})),
+		BiWidth:    fontAtlasWidth,
+		BiHeight:   -fontAtlasHeight, // Negative means top-down.
+		BiPlanes:   1,
+		BiBitCount: 32,
+	}}
+	var bits unsafe.Pointer
+	bitmap := w32.CreateDIBSection(dc, &info, w32.DIB_RGB_COLORS, &bits, 0, 0)
+	if bitmap == 0 {
+		return invalidTexture, glyphs, errors.New("CreateDIBSection failed")
+	}
+	defer w32.DeleteObject(w32.HGDIOBJ(bitmap))
+	w32.SelectObject(dc, w32.HGDIOBJ(bitmap))
+
+	logFont := w32.LOGFONT{
+		Height:  -fontPixelHeight,
+		Weight:  w32.FW_BOLD,
+		Quality: w32.ANTIALIASED_QUALITY,
+	}
+	copy(logFont.FaceName[:w32.LF_FACESIZE-1], syscall.StringToUTF16("Arial"))
+	font := w32.CreateFontIndirect(&logFont)
+	if font == 0 {
+		return invalidTexture, glyphs, errors.New("CreateFontIndirect failed")
+	}
+	defer w32.DeleteObject(w32.HGDIOBJ(font))
+	w32.SelectObject(dc, w32.HGDIOBJ(font))
+
+	w32.SetBkMode(dc, w32.TRANSPARENT)
+	w32.SetTextColor(dc, 0xFFFFFF)
+
+	for i := range glyphs {
+		x := (i % fontColumns) * fontCellWidth
+		y := (i / fontColumns) * fontCellHeight
+		glyphs[i] = glyph{
+			u0:    float32(x) / fontAtlasWidth,
+			v0:    float32(y) / fontAtlasHeight,
+			u1:    float32(x+fontCellWidth) / fontAtlasWidth,
+			v1:    float32(y+fontCellHeight) / fontAtlasHeight,
+			width: fontCellWidth,
+		}
+
+		c := fontFirstChar + i
+		if c == solidChar {
+			w32.FillRect(dc, &w32.RECT{
+				Left:   int32(x),
+				Top:    int32(y),
+				Right:  int32(x + fontCellWidth),
+				Bottom: int32(y + fontCellHeight),
+			}, w32.HBRUSH(w32.GetStockObject(w32.WHITE_BRUSH)))
+			continue
+		}
+
+		w32.TextOut(dc, x, y, string(rune(c)))
+		if size, ok := w32.GetTextExtentPoint32(dc, string(rune(c))); ok {
+			glyphs[i].width = float32(min(size.CX, fontCellWidth))
+		}
+	}
+	gdiFlush.Call()
+
+	// The DIB is BGRA with the text drawn in white on black. We want white
+	// pixels with the coverage (any of the color channels) as the alpha value.
+	pixels := unsafe.Slice((*byte)(bits), fontAtlasWidth*fontAtlasHeight*4)
+	for i := 0; i < len(pixels); i += 4 {
+		pixels[i+3] = pixels[i]
+		pixels[i+0] = 255
+		pixels[i+1] = 255
+		pixels[i+2] = 255
+	}
+	drawSprites(pixels)
+
+	texture, err := gfx.createTexture(fontAtlasWidth, fontAtlasHeight, pixels)
+	return texture, glyphs, err
+}
+
+// drawSprites puts the hudSprites into the atlas' pixels, which are white with
+// the alpha channel still 0 below the characters. The edges are anti-aliased.
+func drawSprites(pixels []byte) {
+	const (
+		center = spriteSize / 2
+		// We leave a pixel of space to the neighboring cells so texture
+		// filtering does not blend them together.
+		radius       = center - 1
+		cornerRadius = spriteSize / 4
+	)
+	for s := range spriteCount {
+		for y := range spriteSize {
+			for x := range spriteSize {
+				// We measure from the pixel centers.
+				dx := abs(float32(x) + 0.5 - center)
+				dy := abs(float32(y) + 0.5 - center)
+				var distance float32
+				switch s {
+				case spriteCircle:
+					distance = float32(math.Hypot(float64(dx), float64(dy))) - radius
+				case spriteKey:
+					// A rounded rectangle is a smaller rectangle, grown by the
+					// corner radius.
+					dx = max(0, dx-(radius-cornerRadius))
+					dy = max(0, dy-(radius-cornerRadius))
+					distance = float32(math.Hypot(float64(dx), float64(dy))) - cornerRadius
+				}
+				coverage := min(1, max(0, 0.5-distance))
+				i := ((spriteRowY+y)*fontAtlasWidth + int(s)*spriteSize + x) * 4
+				pixels[i+3] = byte(coverage * 255)
+			}
+		}
+	}
+}
@@ -1,6 +1,12 @@
 package main
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
 	"github.com/gonutz/di8"
 	"github.com/gonutz/w32/v2"
 )
@@ -10,13 +16,57 @@ const (
 	axisMax = 0.95
 )
 
+// inputSystem owns the DirectInput devices. The game loop and the window
+// procedure, which reconnects the joystick, both run on the main goroutine, so
+// the devices do not need a di8.SyncDevice.
 type inputSystem struct {
 	dinput         *di8.DirectInput
-	joystickDevice *di8.Device
+	joystickDevice *di8.Controller
+	joystickGuid   di8.GUID
+	// keyboardDevice is the DirectInput system keyboard, keyboard is its state
+	// for the current frame.
+	keyboardDevice *di8.Device
+	input          inputState
+	// xboxIndices are the XInput user indices of the XBox controllers of
+	// players 1 and 2, -1 if they have none.
+	xboxIndices [2]int
+	// player1Pad is the XInput slot that player 1 picked, -1 for the first
+	// one that is connected. player1Joystick is the GUID of the DirectInput
+	// controller that player 1 picked as the joystick, "" for our known
+	// joystick. See setPlayer1Controller.
+	player1Pad      int
+	player1Joystick string
+}
+
+// inputState is what the game sees of the controllers in the current frame.
+type inputState struct {
+	keyboard       di8.KEYBOARDSTATE
 	xboxController xboxControllerState
-	joystick       joystickState
+	// secondXBoxController is used by player 2 in local co-op.
+	secondXBoxController xboxControllerState
+	joystick             joystickState
+	// joystickConnected is false if there is no joystick, joystick is not
+	// updated then.
+	joystickConnected bool
+	// xinputPads are all four XInput slots as XInput reports them, and
+	// joystickRaw is the joystick's DirectInput state before we normalize it.
+	// The controller test screen shows them next to what the game uses.
+	xinputPads  [4]xinputPad
+	joystickRaw di8.JOYSTATE2
+	// lastDevice is the device that was used most recently. On-screen button
+	// prompts show its buttons.
+	lastDevice inputDevice
 }
 
+// inputDevice is a kind of controller that the game can be played with.
+type inputDevice int
+
+const (
+	deviceXBoxController inputDevice = iota
+	deviceJoystick
+	deviceKeyboard
+)
+
 type xboxControllerState struct {
 	connected bool
 	// buttons is a bitmask with buttons A, B, X, Y, Back, Start, LB, RB, left
@@ -78,8 +128,25 @@ func (s *xboxControllerState) rightAxisDown() bool {
 	return s.buttons&w32.XINPUT_GAMEPAD_RIGHT_THUMB != 0
 }
 
+// xinputPad is the raw state of one XInput slot.
+type xinputPad struct {
+	connected bool
+	gamepad   w32.XINPUT_GAMEPAD
+}
+
+// gameController is a DirectInput game controller that is plugged in. XBox
+// controllers show up here as well as in XInput, xinput is set for them.
+type gameController struct {
+	name   string
+	guid   di8.GUID
+	xinput bool
+}
+
 // joystickState represents the state of our very specific, known joystick.
 type joystickState struct {
+	// Axes are in the range [-1..1] with the dead zone already applied by
+	// DirectInput, so unlike the XBox controller axes they do not need
+	// relativeAxis.
 	xAxis      float32
 	yAxis      float32
 	buttonDown [8]bool
@@ -92,20 +159,37 @@ type joystickState struct {
 }
 
 func initInputSystem() (*inputSystem, error) {
+	if err := requireDLL("dinput8.dll", errDirectInputMissing); err != nil {
+		return nil, err
+	}
+
 	dinput, err := di8.Create(di8.HINSTANCE(w32.GetModuleHandle("")))
 	if err != nil {
-		return nil, err
+		return nil, errDirectInputMissing(err)
 	}
 
 	s := &inputSystem{
-		dinput: dinput,
+		dinput:      dinput,
+		xboxIndices: [2]int{-1, -1},
+		player1Pad:  -1,
 	}
 	s.connectJoystick()
 	return s, nil
 }
 
+func (s *inputSystem) state() *inputState {
+	return &s.input
+}
+
 func (s *inputSystem) close() {
+	for player := range s.xboxIndices {
+		s.rumble(player, 0, 0)
+	}
 	s.closeJoystick()
+	if s.keyboardDevice != nil {
+		s.keyboardDevice.Unacquire()
+		s.keyboardDevice.Release()
+	}
 	s.dinput.Release()
 }
 
@@ -114,6 +198,8 @@ func (s *inputSystem) connectJoystick() {
 		return // We are already connected with the joystick.
 	}
 
+	// The controller that player 1 picked wins over our known joystick, which
+	// we use if it is not plugged in.
 	var (
 		joystickFound bool
 		joystickGuid  di8.GUID
@@ -121,11 +207,17 @@ func (s *inputSystem) connectJoystick() {
 	s.dinput.EnumDevices(
 		di8.DEVCLASS_GAMECTRL,
 		func(device *di8.DEVICEINSTANCE, _ uintptr) uintptr {
-			if device.GetProductName() == "Generic   USB  Joystick  " {
+			if s.player1Joystick != "" &&
+				formatGUID(device.GuidInstance) == s.player1Joystick {
 				joystickFound = true
 				joystickGuid = device.GuidInstance
 				return di8.ENUM_STOP
 			}
+			if !joystickFound &&
+				device.GetProductName() == "Generic   USB  Joystick  " {
+				joystickFound = true
+				joystickGuid = device.GuidInstance
+			}
 			return di8.ENUM_CONTINUE
 		},
 		0,
@@ -136,81 +228,351 @@ func (s *inputSystem) connectJoystick() {
 		return
 	}
 
-	if joy, err := s.dinput.CreateDevice(joystickGuid); err == nil {
-		if joy.SetDataFormat(&di8.Joystick2) != nil {
-			joy.Release()
-		} else if joy.SetProperty(
+	device, err := s.dinput.CreateDevice(joystickGuid)
+	if err != nil {
+		return
+	}
+	joy, err := di8.NewController(device)
+	if err != nil {
+		device.Release()
+		return
+	}
+	// The stick gets the same dead zone as the XBox controller sticks, see
+	// clampAxis and relativeAxis.
+	if joy.SetDeadZone(di8.JOFS_X, axisMin, axisMax) != nil ||
+		joy.SetDeadZone(di8.JOFS_Y, axisMin, axisMax) != nil ||
+		device.SetProperty(
 			di8.PROP_BUFFERSIZE,
 			di8.NewPropDWord(0, di8.PH_DEVICE, 32),
-		) != nil {
-			joy.Release()
-		} else if joy.Acquire() != nil {
-			joy.Release()
-		} else {
-			s.joystickDevice = joy
+		) != nil ||
+		device.Acquire() != nil {
+		device.Release()
+		return
+	}
+	s.joystickDevice = joy
+	s.joystickGuid = joystickGuid
+	s.input.joystickConnected = true
+}
+
+// gameControllers lists the DirectInput game controllers that are plugged in.
+// Enumerating devices is slow, do not call it every frame.
+func (s *inputSystem) gameControllers() []gameController {
+	var list []gameController
+	xinputProducts := xinputProductIDs()
+	s.dinput.EnumDevices(
+		di8.DEVCLASS_GAMECTRL,
+		func(device *di8.DEVICEINSTANCE, _ uintptr) uintptr {
+			list = append(list, gameController{
+				name:   strings.TrimSpace(device.GetProductName()),
+				guid:   device.GuidInstance,
+				xinput: xinputProducts[device.GuidProduct.Data1],
+			})
+			return di8.ENUM_CONTINUE
+		},
+		0,
+		di8.EDFL_ATTACHEDONLY,
+	)
+	return list
+}
+
+var (
+	getRawInputDeviceList = syscall.NewLazyDLL("user32.dll").NewProc("GetRawInputDeviceList")
+	getRawInputDeviceInfo = syscall.NewLazyDLL("user32.dll").NewProc("GetRawInputDeviceInfoW")
+)
+
+// rawInputDevice is the Win32 RAWINPUTDEVICELIST.
+type rawInputDevice struct {
+	handle uintptr
+	kind   uint32
+}
+
+const ridiDeviceName = 0x20000007
+
+// xinputProductIDs returns the product IDs of the XInput devices that are
+// plugged in, in the format of the first part of DirectInput's product GUIDs:
+// the product ID in the high and the vendor ID in the low 16 bits. Windows
+// puts "IG_" in the device path of XInput devices, which is how Microsoft
+// recommends telling them apart from other controllers.
+func xinputProductIDs() map[uint32]bool {
+	ids := map[uint32]bool{}
+	var count uint32
+	size := unsafe.Sizeof(rawInputDevice{})
+	getRawInputDeviceList.Call(0, uintptr(unsafe.Pointer(&count)), size)
+	if count == 0 {
+		return ids
+	}
+	devices := make([]rawInputDevice, count)
+	n, _, _ := getRawInputDeviceList.Call(
+		uintptr(unsafe.Pointer(&devices[0])),
+		uintptr(unsafe.Pointer(&count)),
+		size,
+	)
+	if int32(n) < 0 {
+		// A device was plugged in just now, we miss it this time.
+		return ids
+	}
+	for _, d := range devices[:n] {
+		if d.kind != w32.RIM_TYPEHID {
+			continue
+		}
+		var length uint32
+		getRawInputDeviceInfo.Call(d.handle, ridiDeviceName, 0, uintptr(unsafe.Pointer(&length)))
+		if length == 0 {
+			continue
+		}
+		name := make([]uint16, length)
+		getRawInputDeviceInfo.Call(
+			d.handle,
+			ridiDeviceName,
+			uintptr(unsafe.Pointer(&name[0])),
+			uintptr(unsafe.Pointer(&length)),
+		)
+		path := strings.ToUpper(syscall.UTF16ToString(name))
+		if !strings.Contains(path, "IG_") {
+			continue
+		}
+		vendor, vendorOK := hexAfter(path, "VID_")
+		product, productOK := hexAfter(path, "PID_")
+		if vendorOK && productOK {
+			ids[product<<16|vendor] = true
+		}
+	}
+	return ids
+}
+
+// hexAfter parses the 4 hex digits after prefix in s.
+func hexAfter(s, prefix string) (uint32, bool) {
+	i := strings.Index(s, prefix)
+	if i == -1 || i+len(prefix)+4 > len(s) {
+		return 0, false
+	}
+	start := i + len(prefix)
+	n, err := strconv.ParseUint(s[start:start+4], 16, 16)
+	return uint32(n), err == nil
+}
+
+// usesController tells whether the game reads the controller.
+func (s *inputSystem) usesController(c gameController) bool {
+	return s.joystickDevice != nil && c.guid == s.joystickGuid
+}
+
+// Player 1's controller is stored in the settings as a string. DirectInput
+// controllers are stored by their instance GUID. XInput controllers have no
+// GUID, XInput only knows the slots 0 to 3, so they are stored as "xinput:"
+// followed by the slot. allControllers means that player 1 uses all
+// controllers, which is also what happens before a choice is made.
+const (
+	xinputChoicePrefix = "xinput:"
+	allControllers     = "all"
+)
+
+func xinputChoice(slot int) string {
+	return xinputChoicePrefix + strconv.Itoa(slot)
+}
+
+// formatGUID formats the GUID the way Windows does, e.g.
+// {6F1D2B61-D5A0-11CF-BFC7-444553540000}.
+func formatGUID(g di8.GUID) string {
+	return fmt.Sprintf("{%08X-%04X-%04X-%02X%02X-%02X%02X%02X%02X%02X%02X}",
+		g.Data1, g.Data2, g.Data3,
+		g.Data4[0], g.Data4[1], g.Data4[2], g.Data4[3],
+		g.Data4[4], g.Data4[5], g.Data4[6], g.Data4[7],
+	)
+}
+
+// setPlayer1Controller makes the chosen controller player 1's: an XInput slot
+// becomes player 1's XBox controller, a DirectInput controller becomes the
+// joystick.
+func (s *inputSystem) setPlayer1Controller(choice string) {
+	s.player1Pad = -1
+	s.player1Joystick = ""
+	if slot, ok := strings.CutPrefix(choice, xinputChoicePrefix); ok {
+		if i, err := strconv.Atoi(slot); err == nil && 0 <= i && i < len(s.input.xinputPads) {
+			s.player1Pad = i
 		}
+	} else if choice != allControllers {
+		s.player1Joystick = choice
+	}
+	// Connect again in case the joystick changes.
+	s.closeJoystick()
+	s.connectJoystick()
+}
+
+// connectKeyboard creates the keyboard device. It needs the game window, so
+// unlike the joystick it is connected after creating the window. Playing
+// without keyboard is fine, so errors are ignored.
+func (s *inputSystem) connectKeyboard(window w32.HWND) {
+	keyboard, err := s.dinput.CreateKeyboard(
+		di8.HWND(window),
+		di8.SCL_NONEXCLUSIVE|di8.SCL_FOREGROUND,
+	)
+	if err == nil {
+		s.keyboardDevice = keyboard
+		// This fails if the window is not in the foreground yet, update will
+		// try again.
+		keyboard.Acquire()
 	}
 }
 
+// runControlPanel opens the Windows control panel for the joystick so the user
+// can calibrate it. Without a joystick, it opens the game controller overview.
+func (s *inputSystem) runControlPanel(owner w32.HWND) error {
+	if s.joystickDevice != nil {
+		return s.joystickDevice.Device.RunControlPanel(di8.HWND(owner))
+	}
+	return s.dinput.RunControlPanel(di8.HWND(owner))
+}
+
 func (s *inputSystem) closeJoystick() {
 	if s.joystickDevice == nil {
 		return
 	}
 
-	s.joystickDevice.Unacquire()
-	s.joystickDevice.Release()
+	s.joystickDevice.Close()
 	s.joystickDevice = nil
+	s.input.joystickConnected = false
 }
 
 func (s *inputSystem) update() {
-	// Reset the controller in case it got lost, we will fill in the data
-	// below and overwrite them if it is still connected.
-	s.xboxController.connected = false
-	s.xboxController.buttons = 0
-	s.xboxController.leftXAxis = 0
-	s.xboxController.leftYAxis = 0
-	s.xboxController.rightXAxis = 0
-	s.xboxController.rightYAxis = 0
-	s.xboxController.dpad = 0xFFFF
-	s.xboxController.leftTrigger = 0
-	s.xboxController.rightTrigger = 0
-
-	// We query the first XBox controller that we find.
-	for i := 0; i < 4; i++ {
+	// Reset the controllers in case they got lost, we will fill in the data
+	// below and overwrite them if they are still connected.
+	s.input.xboxController = disconnectedXBoxController()
+	s.input.secondXBoxController = disconnectedXBoxController()
+	s.xboxIndices = [2]int{-1, -1}
+
+	for i := range s.input.xinputPads {
 		state, err := w32.XInputGetState(i)
-		if err == nil {
-			s.xboxController.connected = true
-			s.xboxController.buttons = state.Gamepad.Buttons
-			s.xboxController.leftXAxis = clampAxis(float32(state.Gamepad.ThumbLX) / 32768)
-			s.xboxController.leftYAxis = clampAxis(-float32(state.Gamepad.ThumbLY) / 32768)
-			s.xboxController.rightXAxis = clampAxis(float32(state.Gamepad.ThumbRX) / 32768)
-			s.xboxController.rightYAxis = clampAxis(-float32(state.Gamepad.ThumbRY) / 32768)
-			up := state.Gamepad.Buttons&w32.XINPUT_GAMEPAD_DPAD_UP != 0
-			right := state.Gamepad.Buttons&w32.XINPUT_GAMEPAD_DPAD_RIGHT != 0
-			down := state.Gamepad.Buttons&w32.XINPUT_GAMEPAD_DPAD_DOWN != 0
-			left := state.Gamepad.Buttons&w32.XINPUT_GAMEPAD_DPAD_LEFT != 0
-			s.xboxController.dpad = dpadTo100Degrees(up, right, down, left)
-			s.xboxController.leftTrigger = float32(state.Gamepad.LeftTrigger) / 255
-			s.xboxController.rightTrigger = float32(state.Gamepad.RightTrigger) / 255
-			break
+		s.input.xinputPads[i] = xinputPad{
+			connected: err == nil,
+			gamepad:   state.Gamepad,
+		}
+	}
+
+	// The XBox controller that player 1 picked is theirs. Otherwise the first
+	// one that we find is for player 1, the next one is for player 2.
+	found := 0
+	if p := s.player1Pad; p != -1 && s.input.xinputPads[p].connected {
+		s.assignPad(found, p)
+		found++
+	}
+	for i, pad := range s.input.xinputPads {
+		if pad.connected && found < 2 && i != s.xboxIndices[0] {
+			s.assignPad(found, i)
+			found++
 		}
 	}
 
 	if s.joystickDevice != nil {
-		var joyState di8.JOYSTATE2
-		disconnected := s.joystickDevice.GetDeviceState(&joyState) != nil
+		j := s.joystickDevice
+		disconnected := j.Update() != nil
+		s.input.joystickRaw = *j.State()
 		if disconnected {
 			s.closeJoystick()
 		} else {
-			s.joystick.xAxis = clampAxis(float32(joyState.X-32768) / 32768)
-			s.joystick.yAxis = clampAxis(float32(joyState.Y-32768) / 32768)
-			for i := range s.joystick.buttonDown {
-				s.joystick.buttonDown[i] = joyState.Buttons[i] != 0
+			s.input.joystick.xAxis = j.X()
+			s.input.joystick.yAxis = j.Y()
+			for i := range s.input.joystick.buttonDown {
+				s.input.joystick.buttonDown[i] = j.Button(i)
 			}
-			s.joystick.dpad = joyState.POV[0]
-			s.joystick.wheel = 1 - float32(joyState.Rz)/0xFFFF
+			s.input.joystick.dpad = j.POV(0)
+			s.input.joystick.wheel = (1 - j.RZ()) / 2
+		}
+	}
+
+	if s.keyboardDevice != nil {
+		if s.keyboardDevice.GetDeviceState(&s.input.keyboard) != nil {
+			// We lose the keyboard whenever our window goes to the background
+			// and get it back once it is active again.
+			s.input.keyboard = di8.KEYBOARDSTATE{}
+			s.keyboardDevice.Acquire()
+		}
+	}
+
+	s.input.lastDevice = s.input.mostRecentDevice()
+}
+
+// assignPad makes the XInput slot the XBox controller of the player.
+func (s *inputSystem) assignPad(player, slot int) {
+	c := &s.input.xboxController
+	if player == 1 {
+		c = &s.input.secondXBoxController
+	}
+	g := &s.input.xinputPads[slot].gamepad
+	c.connected = true
+	s.xboxIndices[player] = slot
+	c.buttons = g.Buttons
+	c.leftXAxis = clampAxis(float32(g.ThumbLX) / 32768)
+	c.leftYAxis = clampAxis(-float32(g.ThumbLY) / 32768)
+	c.rightXAxis = clampAxis(float32(g.ThumbRX) / 32768)
+	c.rightYAxis = clampAxis(-float32(g.ThumbRY) / 32768)
+	up := g.Buttons&w32.XINPUT_GAMEPAD_DPAD_UP != 0
+	right := g.Buttons&w32.XINPUT_GAMEPAD_DPAD_RIGHT != 0
+	down := g.Buttons&w32.XINPUT_GAMEPAD_DPAD_DOWN != 0
+	left := g.Buttons&w32.XINPUT_GAMEPAD_DPAD_LEFT != 0
+	c.dpad = dpadTo100Degrees(up, right, down, left)
+	c.leftTrigger = float32(g.LeftTrigger) / 255
+	c.rightTrigger = float32(g.RightTrigger) / 255
+}
+
+// mostRecentDevice returns the device that is being used right now. While
+// several are used at the same time, we stay with the last one so the button
+// prompts do not flicker. If none is used, the last one stays as well.
+func (s *inputState) mostRecentDevice() inputDevice {
+	active := [...]bool{
+		deviceXBoxController: s.xboxController.active() ||
+			s.secondXBoxController.active(),
+		deviceJoystick: s.joystickConnected && s.joystick.active(),
+		deviceKeyboard: s.keyboard.AnyDown(),
+	}
+	if active[s.lastDevice] {
+		return s.lastDevice
+	}
+	for device, used := range active {
+		if used {
+			return inputDevice(device)
+		}
+	}
+	return s.lastDevice
+}
+
+// active is true if any button is pressed or a stick or trigger is pushed at
+// least half way.
+func (s *xboxControllerState) active() bool {
+	const threshold = 0.5
+	return s.connected && (s.buttons != 0 ||
+		abs(s.leftXAxis) > threshold || abs(s.leftYAxis) > threshold ||
+		abs(s.rightXAxis) > threshold || abs(s.rightYAxis) > threshold ||
+		s.leftTrigger > threshold || s.rightTrigger > threshold ||
+		s.dpad <= 31500)
+}
+
+// active is true if any button is pressed or the stick is pushed at least half
+// way. The wheel stays where the user left it, moving it does not count.
+func (s *joystickState) active() bool {
+	const threshold = 0.5
+	if abs(s.xAxis) > threshold || abs(s.yAxis) > threshold || s.dpad <= 31500 {
+		return true
+	}
+	for _, down := range s.buttonDown {
+		if down {
+			return true
 		}
 	}
+	return false
+}
+
+func (s *inputSystem) rumble(player int, low, high float32) {
+	if i := s.xboxIndices[player]; i != -1 {
+		// The left motor is the low frequency one.
+		w32.XInputSetState(i, w32.XINPUT_VIBRATION{
+			LeftMotorSpeed:  uint16(low * 0xFFFF),
+			RightMotorSpeed: uint16(high * 0xFFFF),
+		})
+	}
+}
+
+func disconnectedXBoxController() xboxControllerState {
+	return xboxControllerState{dpad: 0xFFFF}
 }
 
 func clampAxis(rel float32) float32 {
@@ -279,3 +641,98 @@ func dpadTo100Degrees(up, right, down, left bool) uint32 {
 		15: 0xFFFF,
 	}[x]
 }
+
+// menuInput holds the buttons that were pressed since the last frame for
+// navigating menus and dialogues.
+type menuInput struct {
+	up, down, left, right bool
+	confirm, back         bool
+}
+
+func (a menuInput) or(b menuInput) menuInput {
+	return menuInput{
+		up:      a.up || b.up,
+		down:    a.down || b.down,
+		left:    a.left || b.left,
+		right:   a.right || b.right,
+		confirm: a.confirm || b.confirm,
+		back:    a.back || b.back,
+	}
+}
+
+// directions tells where a stick and D-pad point to. The stick counts if it is
+// pushed at least half way.
+type directions struct {
+	up, down, left, right bool
+}
+
+func pointingTo(xAxis, yAxis float32, dpad uint32) directions {
+	const threshold = 0.5
+	d := directions{
+		up:    yAxis < -threshold,
+		down:  yAxis > threshold,
+		left:  xAxis < -threshold,
+		right: xAxis > threshold,
+	}
+	if dpad < 36000 {
+		d.up = d.up || dpad >= 31500 || dpad <= 4500
+		d.right = d.right || 4500 <= dpad && dpad <= 13500
+		d.down = d.down || 13500 <= dpad && dpad <= 22500
+		d.left = d.left || 22500 <= dpad && dpad <= 31500
+	}
+	return d
+}
+
+func menuDirections(now, last directions) menuInput {
+	return menuInput{
+		up:    now.up && !last.up,
+		down:  now.down && !last.down,
+		left:  now.left && !last.left,
+		right: now.right && !last.right,
+	}
+}
+
+// xboxMenuInput uses the left stick or D-pad to navigate, A to confirm and B
+// to go back.
+func xboxMenuInput(c, last *xboxControllerState) menuInput {
+	in := menuDirections(
+		pointingTo(c.leftXAxis, c.leftYAxis, c.dpad),
+		pointingTo(last.leftXAxis, last.leftYAxis, last.dpad),
+	)
+	in.confirm = c.buttonADown() && !last.buttonADown()
+	in.back = c.buttonBDown() && !last.buttonBDown()
+	return in
+}
+
+// keyboardMenuInput navigates with the arrow keys or WASD, confirms with Enter
+// or Space and goes back with Backspace. Escape is not used, it quits the game.
+func keyboardMenuInput(k, last *di8.KEYBOARDSTATE) menuInput {
+	pointing := func(k *di8.KEYBOARDSTATE) directions {
+		return directions{
+			up:    k.IsDown(di8.K_UP) || k.IsDown(di8.K_W),
+			down:  k.IsDown(di8.K_DOWN) || k.IsDown(di8.K_S),
+			left:  k.IsDown(di8.K_LEFT) || k.IsDown(di8.K_A),
+			right: k.IsDown(di8.K_RIGHT) || k.IsDown(di8.K_D),
+		}
+	}
+	pressed := func(key byte) bool {
+		return k.IsDown(key) && !last.IsDown(key)
+	}
+	in := menuDirections(pointing(k), pointing(last))
+	in.confirm = pressed(di8.K_RETURN) || pressed(di8.K_NUMPADENTER) ||
+		pressed(di8.K_SPACE)
+	in.back = pressed(di8.K_BACK)
+	return in
+}
+
+// joystickMenuInput uses the stick or hat switch to navigate, the trigger to
+// confirm and the second button to go back.
+func joystickMenuInput(j, last *joystickState) menuInput {
+	in := menuDirections(
+		pointingTo(j.xAxis, j.yAxis, j.dpad),
+		pointingTo(last.xAxis, last.yAxis, last.dpad),
+	)
+	in.confirm = j.buttonDown[0] && !last.buttonDown[0]
+	in.back = j.buttonDown[1] && !last.buttonDown[1]
+	return in
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+
+	m "github.com/gonutz/d3dmath/column_major/d3dmath"
+)
+
+// itemKind is something the players can pick up and carry in their
+// inventory.
+type itemKind int
+
+const (
+	// Keys open locked doors, one key per door.
+	itemKey itemKind = iota
+	// Hearts are used to restore one health point.
+	itemHeart
+	itemKindCount
+)
+
+// itemNames are used in the save file.
+var itemNames = [itemKindCount]string{
+	itemKey:   "key",
+	itemHeart: "heart",
+}
+
+// itemColors tint the items in the level and their icons in the HUD.
+var itemColors = [itemKindCount]m.Vec4{
+	itemKey:   {0.3, 0.7, 1, 1},
+	itemHeart: {1, 0.15, 0.2, 1},
+}
+
+// inventory counts the items that the players carry. In local co-op, the
+// players share one inventory, just like the collectibles.
+type inventory struct {
+	counts [itemKindCount]int
+}
+
+func (inv *inventory) pickUp(item itemKind) {
+	inv.counts[item]++
+}
+
+func (inv *inventory) count(item itemKind) int {
+	return inv.counts[item]
+}
+
+// consume removes one of the given items from the inventory. It returns false
+// if there is none.
+func (inv *inventory) consume(item itemKind) bool {
+	if inv.counts[item] <= 0 {
+		return false
+	}
+	inv.counts[item]--
+	return true
+}
+
+// MarshalJSON writes the inventory as an object of item names to counts, e.g.
+// {"key":1,"heart":2}.
+func (inv inventory) MarshalJSON() ([]byte, error) {
+	m := make(map[string]int)
+	for item, n := range inv.counts {
+		if n > 0 {
+			m[itemNames[item]] = n
+		}
+	}
+	return json.Marshal(m)
+}
+
+// UnmarshalJSON reads what MarshalJSON writes. Unknown items are ignored.
+func (inv *inventory) UnmarshalJSON(data []byte) error {
+	var m map[string]int
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	*inv = inventory{}
+	for item, name := range itemNames {
+		inv.counts[item] = max(0, m[name])
+	}
+	return nil
+}
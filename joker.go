@@ -0,0 +1,142 @@
+package main
+
+import (
+	m "github.com/gonutz/d3dmath/column_major/d3dmath"
+)
+
+// joker is the state of one player's character in the level.
+type joker struct {
+	pos m.Vec3
+	// rot is the rotation about the Y axis, in turns.
+	rot    float32
+	speed  float64
+	speedY float32
+	// limbRot animates arms and legs while walking. It is in the range [0..1)
+	// and 0 and 0.5 are the standing positions.
+	limbRot      float64
+	wasOnGround  bool
+	stepCoolDown int
+	health       int
+	// hurtCoolDown is the number of frames that the joker cannot be hurt
+	// again after taking damage. The joker flickers during this time.
+	hurtCoolDown int
+	// knockback is the horizontal velocity that pushes the joker away after
+	// getting hurt, it fades out quickly.
+	knockback m.Vec3
+	// flash is the opacity of the red overlay on this player's view after
+	// getting hurt.
+	flash float32
+	// fallStartY is the highest point since the joker last stood on the
+	// ground, it determines the fall damage when landing.
+	fallStartY float32
+	// deadFrames counts down after dying, the joker respawns when it reaches
+	// 0 again.
+	deadFrames int
+	// dashFrames counts down while dashing, dashCoolDown until the joker can
+	// dash again.
+	dashFrames   int
+	dashCoolDown int
+	// spinFrames counts down while the joker spins around.
+	spinFrames int
+	// onMesh is true while the joker stands on the level's collision mesh
+	// instead of a grid tile.
+	onMesh bool
+}
+
+const (
+	maxJokerHealth = 3
+	// A fall higher than this hurts the joker, it loses one health point for
+	// every started unit beyond it.
+	safeFallHeight   = 3.5
+	hurtCoolDownTime = 60
+	respawnTime      = 90
+	knockbackSpeed   = 0.12
+	knockbackHop     = 0.06
+	dashSpeed        = 0.12
+	dashTime         = 12
+	dashCoolDownTime = 45
+	spinTime         = 30
+	// jokerHeight is the height of the joker's collision box.
+	jokerHeight = 1.3
+	// meshStepHeight is how high the joker can step up when walking on the
+	// collision mesh, e.g. onto a ramp.
+	meshStepHeight = 0.3
+)
+
+func newJoker(pos m.Vec3, rot float32) joker {
+	return joker{
+		pos:         pos,
+		rot:         rot,
+		wasOnGround: true,
+		health:      maxJokerHealth,
+		fallStartY:  pos[1],
+	}
+}
+
+// box is the joker's collision box. Its bottom is lifted by the given amount,
+// which lets the joker step up onto low geometry when moving horizontally.
+func (j *joker) box(lift float32) m.AABB {
+	return m.AABB{
+		Min: m.Vec3{j.pos[0] - 0.25, j.pos[1] + lift, j.pos[2] - 0.25},
+		Max: m.Vec3{j.pos[0] + 0.25, j.pos[1] + jokerHeight, j.pos[2] + 0.25},
+	}
+}
+
+func (j *joker) dead() bool {
+	return j.deadFrames > 0
+}
+
+// flickering is true in every other few frames while the joker cannot be hurt
+// again, to show that it is invulnerable.
+func (j *joker) flickering() bool {
+	return j.hurtCoolDown > 0 && j.hurtCoolDown/4%2 == 0
+}
+
+// hurt takes the damage from the joker's health unless it was hurt only
+// recently. It returns true if the damage was taken.
+func (j *joker) hurt(damage int) bool {
+	if j.hurtCoolDown > 0 || j.dead() {
+		return false
+	}
+	j.health = max(0, j.health-damage)
+	j.hurtCoolDown = hurtCoolDownTime
+	return true
+}
+
+// playerInput is what a player wants their joker to do in this frame. It is
+// gathered from whatever controller the player uses.
+type playerInput struct {
+	// Axes are in the range [-1..1], negative yAxis means forward.
+	xAxis float32
+	yAxis float32
+	jump  bool
+	// toggleCamera switches between the corner camera and the one following
+	// the joker.
+	toggleCamera bool
+	// useItem uses a heart from the inventory to restore health.
+	useItem bool
+	// interact talks to a nearby NPC.
+	interact bool
+	// dash and spin are triggered by gestures, see gestureDetector.
+	dash bool
+	spin bool
+	// dpad is in 100 degrees, see xboxControllerState.dpad.
+	dpad uint32
+}
+
+// followCamera is a player's view of the level. It either sits in one of the
+// level's corners or follows the joker from behind.
+type followCamera struct {
+	pos          m.Vec3
+	targetCorner m.Vec3
+	inCorner     bool
+}
+
+func newFollowCamera(l *level) followCamera {
+	corner := l.cameraCorners()[5]
+	return followCamera{
+		pos:          corner,
+		targetCorner: corner,
+		inCorner:     true,
+	}
+}
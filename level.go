@@ -0,0 +1,615 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	m "github.com/gonutz/d3dmath/column_major/d3dmath"
+)
+
+// level is a grid of square floor tiles, each 1 by 1 unit large. The grid
+// starts at the world origin and extends along positive X (columns) and
+// negative Z (rows). Every tile has an integer floor height, 0 being the
+// ground level.
+type level struct {
+	name string
+	// modelPath is the obj file with the level's geometry. If it is empty, the
+	// geometry is generated from the floor heights, see meshVertices.
+	modelPath    string
+	floorHeights [][]int
+	// jokerStart is the position where player 1 starts, jokerStartRot their
+	// rotation about the Y axis, in turns.
+	jokerStart    m.Vec3
+	jokerStartRot float32
+	// collectibles are placed on these tiles, floating above the floor.
+	collectibles []tilePos
+	// exit is the tile that completes the level when a joker reaches it.
+	exit tilePos
+	// hazards hurt the joker when standing on them.
+	hazards []hazard
+	// items lie on these tiles, waiting to be picked up.
+	items []levelItem
+	// doors block their tiles until a player opens them with a key.
+	doors []tilePos
+	// npcs stand on their tiles and talk to the players.
+	npcs []npc
+	// collisionParts are the names of the parts in the level's model that
+	// use mesh-accurate collision. All other parts are only decoration, the
+	// joker collides with the grid of floor heights instead.
+	collisionParts []string
+	// props are extra models placed in the level.
+	props []prop
+	// triggers are invisible boxes that do something when a joker walks in
+	// or out of them.
+	triggers []trigger
+	// teleports take the jokers to one of the bonusLevels.
+	teleports []teleport
+	// cameraRails take over a joker's camera while it is in their area.
+	cameraRails []cameraRail
+	// timeLimit is only set for bonus levels, which are timed challenges to
+	// get all collectibles. They have no exit.
+	timeLimit time.Duration
+}
+
+// teleport is a tile that takes the jokers to a bonus level. After the
+// challenge, they come back to the teleport, which then stays inactive.
+type teleport struct {
+	tile tilePos
+	// bonus is the index into bonusLevels.
+	bonus int
+}
+
+// trigger is an invisible box in the level. Its enter event fires when a
+// joker walks into it, its exit event when the joker leaves it again.
+type trigger struct {
+	box         m.AABB
+	enter, exit triggerEvent
+	// once triggers fire their enter event only for the first joker that
+	// walks in, and their exit event only when that joker leaves again.
+	// Triggers are shared by the players, it does not matter which of them
+	// walks in first.
+	once bool
+}
+
+// triggerEvent is what happens when a trigger fires. All parts are optional.
+type triggerEvent struct {
+	sound    string
+	music    musicIntensity
+	tutorial string
+	cutscene *cutscene
+}
+
+type musicIntensity int
+
+const (
+	musicUnchanged musicIntensity = iota
+	musicCalm
+	musicNormal
+	musicIntense
+)
+
+// cutscene takes the camera away from the players to show them a place in
+// the level, with a line of text.
+type cutscene struct {
+	camera, target m.Vec3
+	text           string
+	duration       time.Duration
+	// ease is the name of the easing curve for the camera flight to and from
+	// the cutscene's view, see ease.ByName. It defaults to inOutCubic.
+	ease string
+}
+
+// cameraRail is a path for the camera in a cinematic section of the level. It
+// is a Catmull-Rom spline through its points. While a joker is inside area,
+// its camera leaves the corner or follow mode and moves along the rail,
+// staying at the point that is closest to the joker when seen from above.
+type cameraRail struct {
+	area   m.AABB
+	points []m.Vec3
+}
+
+// closestTo returns the point on the rail that is closest to p, ignoring the
+// height.
+func (r *cameraRail) closestTo(p m.Vec3) m.Vec3 {
+	// Rails are short, trying a fixed number of points along them is precise
+	// enough for the camera, which smooths its movement anyway.
+	const samples = 64
+	var closest m.Vec3
+	closestDist := float32(math.Inf(1))
+	for i := range samples + 1 {
+		pos, _ := m.CatmullRom(r.points, float32(i)/samples)
+		dx, dz := pos[0]-p[0], pos[2]-p[2]
+		if d := dx*dx + dz*dz; d < closestDist {
+			closest, closestDist = pos, d
+		}
+	}
+	return closest
+}
+
+// tileArea is a trigger box covering all tiles between the two corner tiles,
+// from the bottom of the pits up to the ceiling.
+func tileArea(from, to tilePos) m.AABB {
+	return m.AABB{
+		Min: m.Vec3{
+			float32(min(from.col, to.col)),
+			pit,
+			-float32(max(from.row, to.row) + 1),
+		},
+		Max: m.Vec3{
+			float32(max(from.col, to.col) + 1),
+			levelWallHeight,
+			-float32(min(from.row, to.row)),
+		},
+	}
+}
+
+// prop is a model that is placed on a level tile but that is not part of the
+// level's grid. Solid props use mesh-accurate collision, so they can have any
+// shape, e.g. a ramp.
+type prop struct {
+	// model is the name of a generated model, see propModels in main.
+	model string
+	tile  tilePos
+	// rot is the rotation about the tile's center, in turns.
+	rot   float32
+	solid bool
+}
+
+// transform places the prop's model, which spans one tile starting at the
+// origin, on its tile in the level.
+func (p prop) transform(l *level) m.Mat4 {
+	floor := float32(l.floorHeights[p.tile.row][p.tile.col])
+	return m.Mul4(
+		m.Translate(-0.5, 0, 0.5),
+		m.RotateRightHandY(p.rot),
+		m.Translate(float32(p.tile.col)+0.5, floor, -float32(p.tile.row)-0.5),
+	)
+}
+
+// npc is a friendly joker that starts a dialogue when a player talks to it.
+type npc struct {
+	tile tilePos
+	// rot is the rotation about the Y axis, in turns, like the joker's.
+	rot float32
+	// dialogue is the key into the dialogues in assets/dialogue.json.
+	dialogue string
+}
+
+type levelItem struct {
+	tile tilePos
+	kind itemKind
+}
+
+type tilePos struct {
+	col, row int
+}
+
+type hazard struct {
+	tile tilePos
+	kind hazardKind
+}
+
+type hazardKind int
+
+const (
+	// Spikes cost the joker one health point.
+	hazardSpikes hazardKind = iota + 1
+	// Lava kills the joker right away.
+	hazardLava
+)
+
+// pit is the floor height of a bottomless tile. The joker dies when falling
+// below fallDeathHeight, long before reaching the bottom.
+const (
+	pit             = -20
+	fallDeathHeight = -5
+)
+
+// allLevels are the levels of the full game, demo builds only play some of
+// them, see levels.
+var allLevels = []level{
+	{
+		name:      "The Hall",
+		modelPath: "assets/level.obj",
+		floorHeights: [][]int{
+			{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			{0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			{0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0, 0},
+			{0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+			{0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0},
+			{0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, -1, -1, 0, 0, 0, 0, 0},
+			{0, 0, 0, 0, 0, 1, 1, 1, 0, 0, 0, -1, -1, 0, 0, 0, 0, 0},
+			{0, 0, 0, 0, 0, 1, 2, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			{0, 0, 0, 0, 0, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		},
+		jokerStart:    m.Vec3{9.4, 0, -7.6},
+		jokerStartRot: 0.57,
+		collectibles: []tilePos{
+			{8, 4},
+			{6, 12},
+			{11, 10},
+			{1, 1},
+			{16, 1},
+			{16, 16},
+			{1, 16},
+			{14, 8},
+		},
+		exit: tilePos{9, 16},
+		teleports: []teleport{
+			{tile: tilePos{2, 15}, bonus: 0},
+		},
+		triggers: []trigger{
+			{
+				box:   tileArea(tilePos{7, 7}, tilePos{9, 9}),
+				enter: triggerEvent{tutorial: "Press {jump} to jump"},
+				once:  true,
+			},
+			{
+				box: tileArea(tilePos{10, 9}, tilePos{13, 12}),
+				enter: triggerEvent{
+					sound:    "assets/blip.ogg",
+					tutorial: "Careful, the pits are bottomless",
+				},
+				once: true,
+			},
+			// The music gets louder close to the lava in front of the exit.
+			{
+				box:   tileArea(tilePos{6, 13}, tilePos{12, 16}),
+				enter: triggerEvent{music: musicIntense},
+				exit:  triggerEvent{music: musicNormal},
+			},
+		},
+		hazards: []hazard{
+			{tilePos{3, 4}, hazardSpikes},
+			{tilePos{4, 4}, hazardSpikes},
+			{tilePos{13, 13}, hazardSpikes},
+			{tilePos{14, 13}, hazardSpikes},
+			{tilePos{8, 14}, hazardLava},
+			{tilePos{9, 14}, hazardLava},
+			{tilePos{10, 14}, hazardLava},
+		},
+		items: []levelItem{
+			{tilePos{3, 9}, itemKey},
+			{tilePos{13, 4}, itemHeart},
+		},
+		npcs: []npc{
+			{tile: tilePos{12, 6}, rot: 0.6, dialogue: "guide"},
+		},
+	},
+	{
+		name: "The Stairs",
+		floorHeights: [][]int{
+			{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 3, 3, 3, 0},
+			{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 3, 3, 3, 0},
+			{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, levelWallHeight, 3, levelWallHeight, 0},
+			{0, 0, 1, 1, 0, 0, 0, 0, 0, 0, 2, 2, 0, 0},
+			{0, 0, 1, 2, 0, 0, -1, -1, -1, 0, 0, 2, 0, 0},
+			{0, 0, 0, 0, 0, 0, pit, pit, pit, 0, 0, 1, 0, 0},
+			{0, 0, 0, 0, 0, 0, -1, -1, -1, 0, 0, 1, 0, 0},
+			{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			{0, 0, 0, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+			{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		},
+		jokerStart:    m.Vec3{2.5, 0, -12.5},
+		jokerStartRot: 0,
+		collectibles: []tilePos{
+			{3, 5},
+			{7, 5},
+			{5, 10},
+			{12, 4},
+			{1, 1},
+			{13, 13},
+		},
+		exit: tilePos{11, 2},
+		hazards: []hazard{
+			{tilePos{4, 12}, hazardLava},
+			{tilePos{5, 12}, hazardLava},
+			{tilePos{6, 12}, hazardLava},
+			{tilePos{11, 8}, hazardSpikes},
+			{tilePos{12, 8}, hazardSpikes},
+		},
+		items: []levelItem{
+			{tilePos{12, 12}, itemKey},
+			{tilePos{9, 5}, itemHeart},
+		},
+		// The only way up to the exit is through this door, the tiles next
+		// to it are pillars that go up to the ceiling.
+		doors: []tilePos{{11, 3}},
+		teleports: []teleport{
+			{tile: tilePos{0, 5}, bonus: 1},
+		},
+		// Right at the start, we show the players where they need to go.
+		triggers: []trigger{
+			{
+				box: tileArea(tilePos{1, 11}, tilePos{3, 13}),
+				enter: triggerEvent{cutscene: &cutscene{
+					camera:   m.Vec3{7, 6, -8},
+					target:   m.Vec3{11.5, 3.5, -3.5},
+					text:     "The exit is up behind a locked door",
+					duration: 4 * time.Second,
+				}},
+				once: true,
+			},
+		},
+		npcs: []npc{
+			{tile: tilePos{13, 4}, rot: 0.4, dialogue: "keeper"},
+		},
+		// The ramp lets the joker walk up onto the low wall without jumping.
+		props: []prop{
+			{model: "ramp", tile: tilePos{5, 9}, solid: true},
+		},
+		// Around the pit, the camera swings low along its south side so the
+		// players can judge the jump.
+		cameraRails: []cameraRail{
+			{
+				area: tileArea(tilePos{5, 4}, tilePos{9, 8}),
+				points: []m.Vec3{
+					{3.5, 3.5, -9.5},
+					{6, 2.5, -10.5},
+					{9, 2.5, -10.5},
+					{11.5, 3.5, -9.5},
+				},
+			},
+		},
+	},
+}
+
+// bonusLevels are small challenge rooms, reached through the teleports in the
+// normal levels. Collect all gems in time to win a heart.
+var bonusLevels = []level{
+	{
+		name: "The Vault",
+		floorHeights: [][]int{
+			{0, 0, 0, 0, 0, 0, 0, 0},
+			{0, 1, 1, 0, 0, 1, 1, 0},
+			{0, 1, 2, 0, 0, 2, 1, 0},
+			{0, 0, 0, 0, 0, 0, 0, 0},
+			{0, 0, 0, 0, 0, 0, 0, 0},
+			{0, 1, 2, 0, 0, 2, 1, 0},
+			{0, 1, 1, 0, 0, 1, 1, 0},
+			{0, 0, 0, 0, 0, 0, 0, 0},
+		},
+		jokerStart:    m.Vec3{4, 0, -4},
+		jokerStartRot: 0.25,
+		collectibles: []tilePos{
+			{0, 0},
+			{7, 0},
+			{2, 2},
+			{5, 2},
+			{2, 5},
+			{5, 5},
+			{0, 7},
+			{7, 7},
+		},
+		timeLimit: 25 * time.Second,
+	},
+	{
+		name: "The Steps",
+		floorHeights: [][]int{
+			{3, 3, 3, 3, 3, 3},
+			{2, 2, 2, 2, 2, 2},
+			{1, 1, 1, 1, 1, 1},
+			{0, 0, 0, 0, 0, 0},
+			{0, 0, pit, pit, 0, 0},
+			{0, 0, 0, 0, 0, 0},
+		},
+		jokerStart:    m.Vec3{3, 0, -5.5},
+		jokerStartRot: 0.25,
+		collectibles: []tilePos{
+			{0, 5},
+			{5, 5},
+			{0, 2},
+			{5, 2},
+			{2, 1},
+			{0, 0},
+			{5, 0},
+		},
+		timeLimit: 20 * time.Second,
+	},
+}
+
+func (l *level) width() int {
+	return len(l.floorHeights[0])
+}
+
+func (l *level) height() int {
+	return len(l.floorHeights)
+}
+
+func (l *level) floorHeightAt(x, z float32) int {
+	if x < 0 || z > 0 {
+		return 999
+	}
+	tx, ty := int(x), int(-z)
+	if 0 <= tx && tx < l.width() &&
+		0 <= ty && ty < l.height() {
+		return l.floorHeights[ty][tx]
+	}
+	return 999
+}
+
+// hazardAt returns the kind of hazard on the tile at x,z or 0 if there is
+// none.
+func (l *level) hazardAt(x, z float32) hazardKind {
+	if x < 0 || z > 0 {
+		return 0
+	}
+	t := tilePos{int(x), int(-z)}
+	for _, h := range l.hazards {
+		if h.tile == t {
+			return h.kind
+		}
+	}
+	return 0
+}
+
+// tileCenter returns the world position at the center of the given tile, on
+// top of its floor.
+func (l *level) tileCenter(t tilePos) m.Vec3 {
+	return m.Vec3{
+		float32(t.col) + 0.5,
+		float32(l.floorHeights[t.row][t.col]),
+		-float32(t.row) - 0.5,
+	}
+}
+
+// cameraCorners are the camera positions high up in the corners and at the
+// centers of the level's walls. They are in the order of the D-pad directions,
+// starting with up and going clockwise.
+func (l *level) cameraCorners() [8]m.Vec3 {
+	const y = 5.5
+	right := float32(l.width()) - 0.5
+	bottom := -float32(l.height()) + 0.5
+	centerX := float32(l.width()) / 2
+	centerZ := -float32(l.height()) / 2
+	return [8]m.Vec3{
+		{centerX, y, -0.5},
+		{right, y, -0.5},
+		{right, y, centerZ},
+		{right, y, bottom},
+		{centerX, y, bottom},
+		{0.5, y, bottom},
+		{0.5, y, centerZ},
+		{0.5, y, -0.5},
+	}
+}
+
+// These are the regions of the level texture for the different kinds of
+// faces, given as u0, v0, u1, v1.
+var (
+	floorUV   = [4]float32{0.001767, 0.658249, 0.342415, 0.998897}
+	blockUV   = [4]float32{0.345784, 0.659915, 0.682969, 0.997100}
+	wallUV    = [4]float32{0.005638, 0.264171, 0.393231, 0.651765}
+	ceilingUV = [4]float32{0.424675, 0.219966, 0.845311, 0.640602}
+)
+
+const levelWallHeight = 6
+
+// meshVertices builds the level geometry from its floor heights, for levels
+// that do not come with their own model. It looks like the modelled levels:
+// every tile is a textured quad and the level is surrounded by walls and
+// covered by a ceiling. The vertices have the same layout as those of our obj
+// models: position, normal and texture coordinate.
+func (l *level) meshVertices() []float32 {
+	return l.meshVerticesIn(0, 0, l.width(), l.height())
+}
+
+// meshVerticesIn builds the geometry of the tiles in the columns col0 to
+// col1-1 and the rows row0 to row1-1, like meshVertices does for the whole
+// level. Large levels are built in chunks this way, see levelStream.
+func (l *level) meshVerticesIn(col0, row0, col1, row1 int) []float32 {
+	var vertices []float32
+
+	// addQuad adds two triangles for the corners p0 to p3, which go around the
+	// quad. Our triangles are clockwise when seen from the front, we flip the
+	// order if necessary to make the quad face along the normal n.
+	addQuad := func(p0, p1, p2, p3, n m.Vec3, uv [4]float32) {
+		if p1.Sub(p0).Cross(p2.Sub(p0)).Dot(n) < 0 {
+			p1, p3 = p3, p1
+		}
+		corners := [4]m.Vec3{p0, p1, p2, p3}
+		uvs := [4][2]float32{
+			{uv[0], uv[1]},
+			{uv[2], uv[1]},
+			{uv[2], uv[3]},
+			{uv[0], uv[3]},
+		}
+		for _, i := range [6]int{0, 1, 2, 0, 2, 3} {
+			p := corners[i]
+			vertices = append(vertices,
+				p[0], p[1], p[2],
+				n[0], n[1], n[2],
+				uvs[i][0], uvs[i][1],
+			)
+		}
+	}
+
+	// addWall adds a vertical face between the given corners, from the bottom
+	// to the top height, in steps of 1 so the texture is not stretched.
+	addWall := func(x0, z0, x1, z1 float32, bottom, top int, n m.Vec3, wall bool) {
+		for y := bottom; y < top; y++ {
+			uv := blockUV
+			if wall {
+				uv = wallUV
+			} else if y < 0 {
+				uv = floorUV
+			}
+			y0, y1 := float32(y), float32(y+1)
+			addQuad(
+				m.Vec3{x0, y0, z0},
+				m.Vec3{x1, y0, z1},
+				m.Vec3{x1, y1, z1},
+				m.Vec3{x0, y1, z0},
+				n,
+				uv,
+			)
+		}
+	}
+
+	for row := row0; row < row1; row++ {
+		for col := col0; col < col1; col++ {
+			h := l.floorHeights[row][col]
+			x0, x1 := float32(col), float32(col+1)
+			z0, z1 := -float32(row+1), -float32(row)
+			y := float32(h)
+
+			topUV := floorUV
+			if h > 0 {
+				topUV = blockUV
+			}
+			addQuad(
+				m.Vec3{x0, y, z0},
+				m.Vec3{x1, y, z0},
+				m.Vec3{x1, y, z1},
+				m.Vec3{x0, y, z1},
+				m.Vec3{0, 1, 0},
+				topUV,
+			)
+
+			addQuad(
+				m.Vec3{x0, levelWallHeight, z0},
+				m.Vec3{x1, levelWallHeight, z0},
+				m.Vec3{x1, levelWallHeight, z1},
+				m.Vec3{x0, levelWallHeight, z1},
+				m.Vec3{0, -1, 0},
+				ceilingUV,
+			)
+
+			// Add the sides where this tile is higher than its neighbor. At the
+			// border of the level, the outer walls go up to the ceiling.
+			neighbors := []struct {
+				col, row       int
+				x0, z0, x1, z1 float32
+				normal         m.Vec3
+			}{
+				{col - 1, row, x0, z0, x0, z1, m.Vec3{-1, 0, 0}},
+				{col + 1, row, x1, z0, x1, z1, m.Vec3{1, 0, 0}},
+				{col, row - 1, x0, z1, x1, z1, m.Vec3{0, 0, 1}},
+				{col, row + 1, x0, z0, x1, z0, m.Vec3{0, 0, -1}},
+			}
+			for _, n := range neighbors {
+				if n.col < 0 || n.col >= l.width() || n.row < 0 || n.row >= l.height() {
+					// The wall faces back into the level.
+					addWall(n.x0, n.z0, n.x1, n.z1, h, levelWallHeight, n.normal.MulScalar(-1), true)
+				} else if other := l.floorHeights[n.row][n.col]; other < h {
+					addWall(n.x0, n.z0, n.x1, n.z1, other, h, n.normal, false)
+				}
+			}
+		}
+	}
+
+	return vertices
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+const (
+	// The joker can jump up one unit and fall down this far without getting
+	// hurt, see safeFallHeight.
+	maxStepUp   = 1
+	maxStepDown = 3
+	// maxGeneratedHeight keeps generated floors well below the ceiling.
+	maxGeneratedHeight = 3
+)
+
+// levelParams control the level generator.
+type levelParams struct {
+	// width and height are the number of columns and rows.
+	width, height int
+	// roughness in the range [0..1] controls how many hills and dips there
+	// are, 0 means a flat level.
+	roughness float64
+	// collectibles is the number of collectibles to place.
+	collectibles int
+}
+
+func defaultLevelParams() levelParams {
+	return levelParams{
+		width:        16,
+		height:       16,
+		roughness:    0.5,
+		collectibles: 6,
+	}
+}
+
+// generateLevel creates a random level from the given seed. The same seed and
+// parameters always create the same level. The exit is placed on the tile
+// that is the furthest walk away from the start, so it is always reachable,
+// and so are all collectibles.
+func generateLevel(seed int64, p levelParams) level {
+	r := rand.New(rand.NewSource(seed))
+	w, h := max(4, p.width), max(4, p.height)
+
+	heights := make([][]int, h)
+	for row := range heights {
+		heights[row] = make([]int, w)
+	}
+
+	// Raise hills and dig dips in random rectangles. Overlapping hills make
+	// higher ones.
+	bumps := int(p.roughness * float64(w*h) / 6)
+	for range bumps {
+		bw, bh := 1+r.Intn(4), 1+r.Intn(4)
+		col, row := r.Intn(w-bw+1), r.Intn(h-bh+1)
+		d := 1
+		if r.Intn(5) == 0 {
+			d = -1
+		}
+		for y := row; y < row+bh; y++ {
+			for x := col; x < col+bw; x++ {
+				heights[y][x] = max(-1, min(maxGeneratedHeight, heights[y][x]+d))
+			}
+		}
+	}
+
+	// The start is in the bottom-left corner, it is always kept flat so the
+	// players do not start inside a wall.
+	start := tilePos{1, h - 2}
+	for y := start.row - 1; y <= start.row+1; y++ {
+		for x := start.col - 1; x <= start.col+1; x++ {
+			heights[y][x] = 0
+		}
+	}
+
+	l := level{
+		name:          fmt.Sprintf("Random Level %d", seed),
+		floorHeights:  heights,
+		jokerStartRot: 0,
+	}
+	l.jokerStart = l.tileCenter(start)
+
+	reachable := l.walkDistances(start)
+	var candidates []tilePos
+	l.exit = start
+	for row := range h {
+		for col := range w {
+			t := tilePos{col, row}
+			d := reachable[row][col]
+			if d < 0 {
+				continue
+			}
+			if d > reachable[l.exit.row][l.exit.col] {
+				l.exit = t
+			}
+			if d > 2 {
+				candidates = append(candidates, t)
+			}
+		}
+	}
+
+	r.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	for _, t := range candidates {
+		if len(l.collectibles) >= p.collectibles {
+			break
+		}
+		if t != l.exit {
+			l.collectibles = append(l.collectibles, t)
+		}
+	}
+
+	return l
+}
+
+// walkDistances returns the number of steps it takes to walk from the start to
+// every tile, -1 for tiles that cannot be reached. A step goes to a
+// neighboring tile that is at most maxStepUp higher or maxStepDown lower.
+func (l *level) walkDistances(start tilePos) [][]int {
+	dist := make([][]int, l.height())
+	for row := range dist {
+		dist[row] = make([]int, l.width())
+		for col := range dist[row] {
+			dist[row][col] = -1
+		}
+	}
+
+	dist[start.row][start.col] = 0
+	queue := []tilePos{start}
+	for len(queue) > 0 {
+		t := queue[0]
+		queue = queue[1:]
+		from := l.floorHeights[t.row][t.col]
+		for _, n := range [4]tilePos{
+			{t.col - 1, t.row},
+			{t.col + 1, t.row},
+			{t.col, t.row - 1},
+			{t.col, t.row + 1},
+		} {
+			if n.col < 0 || n.col >= l.width() || n.row < 0 || n.row >= l.height() ||
+				dist[n.row][n.col] != -1 {
+				continue
+			}
+			to := l.floorHeights[n.row][n.col]
+			if to-from > maxStepUp || from-to > maxStepDown {
+				continue
+			}
+			dist[n.row][n.col] = dist[t.row][t.col] + 1
+			queue = append(queue, n)
+		}
+	}
+
+	return dist
+}
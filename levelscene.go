@@ -0,0 +1,397 @@
+package main
+
+import (
+	"math"
+
+	m "github.com/gonutz/d3dmath/column_major/d3dmath"
+)
+
+// jokerBaseRot is the rotation of the joker model in its obj file, it faces
+// along positive X.
+const jokerBaseRot = -0.25
+
+// levelScene is what drawLevel needs to draw a level with everything in it.
+// The game fills it in from its state for every frame.
+type levelScene struct {
+	// mesh holds all models. A random level's geometry is in randomLevelMesh
+	// or, for a streamed level, in stream.
+	mesh                   meshHandle
+	randomLevelMesh        meshHandle
+	randomLevelVertexCount int
+	stream                 *levelStream
+
+	levelTexture textureHandle
+	whiteTexture textureHandle
+	jokerTexture textureHandle
+
+	// levelModel is nil for a random level.
+	levelModel model
+	gem        model
+	box        model
+	tile       model
+	joker      model
+	props      map[string]model
+	// jokerArmJoint and jokerLegJoint are the points in the joker model that
+	// the arms and legs rotate about.
+	jokerArmJoint m.Vec3
+	jokerLegJoint m.Vec3
+
+	level        *level
+	collected    []bool
+	pickedUp     []bool
+	doorOpen     []bool
+	teleportUsed []bool
+	// jokers are the players' jokers, dead ones are not drawn.
+	jokers []joker
+	// remote is the other player in a network game, it is only drawn if
+	// showRemote is set.
+	remote     playerState
+	showRemote bool
+	// brightness tints the whole level, it is high while a level fades in.
+	brightness float32
+	// spin animates the collectibles, items, exit and glowing tiles, in turns.
+	spin        float64
+	light       *lightingPreset
+	fieldOfView float32
+}
+
+// collectiblePos is where the level's collectible i floats above its tile.
+// It bobs up and down with spin, see levelScene.spin.
+func collectiblePos(l *level, i int, spin float64) m.Vec3 {
+	p := l.tileCenter(l.collectibles[i])
+	p[1] += 0.6 + 0.1*float32(math.Sin(m.TurnsToRad*spin))
+	return p
+}
+
+// drawModel draws all parts of the model, transformed into the world.
+func drawModel(gfx renderer, mesh meshHandle, parts model, transform, viewProjection m.Mat4) error {
+	normalTransform := transform.NormalMatrix()
+	mvp := m.Mul4(transform, viewProjection)
+	if err := gfx.setTransform(mvp, normalTransform); err != nil {
+		return err
+	}
+	for _, o := range parts {
+		if err := drawPart(gfx, mesh, o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drawLevel draws the level as seen through the view matrix, aspect is the
+// width of the viewport divided by its height. It must not allocate, it runs
+// for every player in every frame.
+func drawLevel(gfx renderer, s *levelScene, view m.Mat4, aspect float32) error {
+	l := s.level
+	projection := m.Perspective(m.DegToRad*s.fieldOfView, aspect, 0.1, 1000.0)
+	viewProjection := m.Mul4(view, projection)
+
+	lightColor := m.Vec4{s.brightness, s.brightness, s.brightness, 1}
+	if err := gfx.setColor(lightColor); err != nil {
+		return err
+	}
+	if err := gfx.setLight(s.light); err != nil {
+		return err
+	}
+	if err := gfx.setMaterial(material{0.1, 2, 0.6, 0}); err != nil {
+		return err
+	}
+
+	if err := gfx.setTexture(s.levelTexture); err != nil {
+		return err
+	}
+	if err := gfx.setTransform(viewProjection, m.Identity4()); err != nil {
+		return err
+	}
+	if s.levelModel != nil {
+		// The level model is made of many small parts in world space, we
+		// skip those that are out of view.
+		frustum := m.FrustumFromMatrix(viewProjection)
+		for _, o := range s.levelModel {
+			if !frustum.IntersectsAABB(o.box.Min, o.box.Max) {
+				continue
+			}
+			if err := drawPart(gfx, s.mesh, o); err != nil {
+				return err
+			}
+		}
+	} else if s.stream.active() {
+		if err := s.stream.draw(viewProjection); err != nil {
+			return err
+		}
+	} else {
+		err := drawTriangles(gfx, s.randomLevelMesh, 0, s.randomLevelVertexCount/3)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Draw the hazards, lava is a glowing tile and spikes are four thin
+	// gems sticking out of the floor.
+	if err := gfx.setTexture(s.whiteTexture); err != nil {
+		return err
+	}
+	for _, h := range l.hazards {
+		p := l.tileCenter(h.tile)
+		if h.kind == hazardLava {
+			glow := 1.5 + 0.3*float32(math.Sin(3*m.TurnsToRad*s.spin))
+			if err := gfx.setColor(m.Vec4{glow, 0.4 * glow, 0.05, 1}); err != nil {
+				return err
+			}
+			// Lava glows by itself, it is not lit.
+			if err := gfx.setMaterial(material{0, 1, 1, 1}); err != nil {
+				return err
+			}
+			transform := m.Translate(p[0]-0.5, p[1]+0.01, p[2]+0.5)
+			if err := drawModel(gfx, s.mesh, s.tile, transform, viewProjection); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := gfx.setColor(m.Vec4{0.7, 0.7, 0.75, 1}); err != nil {
+			return err
+		}
+		if err := gfx.setMaterial(material{0.6, 32, 0.5, 0}); err != nil {
+			return err
+		}
+		for _, d := range [4]m.Vec3{
+			{-0.25, 0, -0.25},
+			{0.25, 0, -0.25},
+			{-0.25, 0, 0.25},
+			{0.25, 0, 0.25},
+		} {
+			transform := m.Mul4(
+				m.Scale(0.2, 0.35, 0.2),
+				m.TranslateV(p.Add(d)),
+			)
+			if err := drawModel(gfx, s.mesh, s.gem, transform, viewProjection); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Draw the collectibles that are still left.
+	if err := gfx.setColor(m.Vec4{1, 0.8, 0.1, 1}); err != nil {
+		return err
+	}
+	if err := gfx.setMaterial(material{0.9, 32, 0.4, 0}); err != nil {
+		return err
+	}
+	for i := range l.collectibles {
+		if s.collected[i] {
+			continue
+		}
+		transform := m.Mul4(
+			m.ScaleUniform(0.25),
+			m.RotateRightHandY(float32(s.spin)),
+			m.TranslateV(collectiblePos(l, i, s.spin)),
+		)
+		if err := drawModel(gfx, s.mesh, s.gem, transform, viewProjection); err != nil {
+			return err
+		}
+	}
+
+	// Draw the items that were not yet picked up as small gems and the
+	// closed doors as boxes going up to the ceiling.
+	for i, item := range l.items {
+		if s.pickedUp[i] {
+			continue
+		}
+		if err := gfx.setColor(itemColors[item.kind]); err != nil {
+			return err
+		}
+		p := l.tileCenter(item.tile)
+		p[1] += 0.4
+		transform := m.Mul4(
+			m.Scale(0.3, 0.2, 0.3),
+			m.RotateRightHandY(-float32(s.spin)),
+			m.TranslateV(p),
+		)
+		if err := drawModel(gfx, s.mesh, s.gem, transform, viewProjection); err != nil {
+			return err
+		}
+	}
+
+	if err := gfx.setColor(m.Vec4{0.55, 0.35, 0.2, 1}); err != nil {
+		return err
+	}
+	if err := gfx.setMaterial(material{0.2, 8, 0.4, 0}); err != nil {
+		return err
+	}
+	for i, door := range l.doors {
+		if s.doorOpen[i] {
+			continue
+		}
+		floor := float32(l.floorHeights[door.row][door.col])
+		transform := m.Mul4(
+			m.Scale(1, levelWallHeight-floor, 1),
+			m.Translate(float32(door.col), floor, -float32(door.row)),
+		)
+		if err := drawModel(gfx, s.mesh, s.box, transform, viewProjection); err != nil {
+			return err
+		}
+	}
+
+	if err := gfx.setTexture(s.levelTexture); err != nil {
+		return err
+	}
+	if err := gfx.setColor(lightColor); err != nil {
+		return err
+	}
+	if err := gfx.setMaterial(material{0.1, 2, 0.6, 0}); err != nil {
+		return err
+	}
+	for _, p := range l.props {
+		err := drawModel(gfx, s.mesh, s.props[p.model], p.transform(l), viewProjection)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Draw teleports as glowing purple tiles, used ones are dark.
+	if err := gfx.setMaterial(material{0, 1, 1, 1}); err != nil {
+		return err
+	}
+	for i, t := range l.teleports {
+		glow := 1.2 + 0.4*float32(math.Sin(4*m.TurnsToRad*s.spin))
+		if s.teleportUsed[i] {
+			glow = 0.25
+		}
+		if err := gfx.setColor(m.Vec4{0.7 * glow, 0.2 * glow, glow, 1}); err != nil {
+			return err
+		}
+		p := l.tileCenter(t.tile)
+		transform := m.Translate(p[0]-0.5, p[1]+0.01, p[2]+0.5)
+		if err := drawModel(gfx, s.mesh, s.tile, transform, viewProjection); err != nil {
+			return err
+		}
+	}
+	if err := gfx.setMaterial(material{0.9, 32, 0.4, 0}); err != nil {
+		return err
+	}
+
+	// Draw the exit as a large, pulsing gem. Bonus levels have no exit.
+	if l.timeLimit == 0 {
+		pulse := 0.75 + 0.25*float32(math.Sin(2*m.TurnsToRad*s.spin))
+		if err := gfx.setColor(m.Vec4{0.2 * pulse, pulse, 0.4 * pulse, 1}); err != nil {
+			return err
+		}
+		transform := m.Mul4(
+			m.Scale(0.4, 0.5, 0.4),
+			m.RotateRightHandY(-2*float32(s.spin)),
+			m.TranslateV(l.tileCenter(l.exit).Add(m.Vec3{0, 0.5, 0})),
+		)
+		if err := drawModel(gfx, s.mesh, s.gem, transform, viewProjection); err != nil {
+			return err
+		}
+	}
+
+	// Draw the jokers. While a joker is invulnerable after getting hurt,
+	// it flickers in a bright red.
+	if err := gfx.setTexture(s.jokerTexture); err != nil {
+		return err
+	}
+	if err := gfx.setMaterial(material{0.7, 128, 0.2, 0}); err != nil {
+		return err
+	}
+	jokerTints := [2]m.Vec4{
+		{1, 1, 1, 1},
+		{1.4, 0.8, 0.6, 1},
+	}
+	for i := range s.jokers {
+		j := &s.jokers[i]
+		if j.dead() {
+			continue
+		}
+		tint := jokerTints[i]
+		if j.flickering() {
+			tint = m.Vec4{3, 0.8, 0.8, 1}
+		}
+		if err := drawJoker(gfx, s, viewProjection, j.pos, j.rot, j.limbRot, tint); err != nil {
+			return err
+		}
+	}
+
+	for _, n := range l.npcs {
+		pos := l.tileCenter(n.tile)
+		err := drawJoker(gfx, s, viewProjection, pos, n.rot, 0, m.Vec4{0.6, 1.3, 0.6, 1})
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.showRemote {
+		// Tint the other player's joker so we can tell them apart.
+		r := &s.remote
+		err := drawJoker(gfx, s, viewProjection, r.pos, r.rot, float64(r.limbRot), m.Vec4{0.6, 0.8, 1.4, 1})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drawJoker draws a joker at pos, rotated by rot turns about the Y axis, with
+// its arms and legs swung by limbRot, see joker.limbRot. The texture is tinted
+// with the color, times the scene's brightness.
+func drawJoker(
+	gfx renderer,
+	s *levelScene,
+	viewProjection m.Mat4,
+	pos m.Vec3,
+	rot float32,
+	limbRot float64,
+	tint m.Vec4,
+) error {
+	color := m.Vec4{
+		tint[0] * s.brightness,
+		tint[1] * s.brightness,
+		tint[2] * s.brightness,
+		1,
+	}
+	if err := gfx.setColor(color); err != nil {
+		return err
+	}
+	for _, o := range s.joker {
+		custom := m.Identity4()
+
+		if o.name == "leftLeg" || o.name == "rightLeg" ||
+			o.name == "leftArm" || o.name == "rightArm" ||
+			o.name == "leftHand" || o.name == "rightHand" {
+
+			limbRot := limbRot
+			if o.name == "leftLeg" ||
+				o.name == "rightArm" || o.name == "rightHand" {
+				limbRot = -limbRot
+			}
+
+			joint := s.jokerArmJoint
+			if o.name == "leftLeg" || o.name == "rightLeg" {
+				joint = s.jokerLegJoint
+			}
+
+			x, y, z := joint[0], joint[1], joint[2]
+
+			custom = m.Mul4(
+				m.Translate(-x, -y, -z),
+				m.RotateLeftHandX(0.16*float32(math.Sin(m.TurnsToRad*limbRot))),
+				m.Translate(x, y, z),
+			)
+		}
+
+		transform := m.Mul4(
+			custom,
+			m.RotateRightHandY(rot-jokerBaseRot),
+			m.TranslateV(pos),
+		)
+		mvp := m.Mul4(transform, viewProjection)
+		if err := gfx.setTransform(mvp, transform.NormalMatrix()); err != nil {
+			return err
+		}
+		if err := drawPart(gfx, s.mesh, o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
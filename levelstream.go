@@ -0,0 +1,337 @@
+package main
+
+import m "github.com/gonutz/d3dmath/column_major/d3dmath"
+
+// Levels of up to maxUnstreamedLevelSize tiles in each direction are built and
+// uploaded in one go when they start. Bigger ones, like huge random levels,
+// are split into square chunks of chunkSize tiles and only the chunks around
+// the jokers are kept in video memory. A worker goroutine builds the chunks'
+// geometry and the frame loop uploads it bit by bit, at most
+// chunkUploadBudget bytes per frame, so walking into new parts of the level
+// never makes a frame late.
+const (
+	maxUnstreamedLevelSize = 18
+	chunkSize              = 16
+	// chunkRadius is how many chunks are loaded around a joker's chunk in
+	// every direction. It is 1 so the chunks next to the joker are always
+	// there, chunkSize is large enough that the ones behind them are out of
+	// sight.
+	chunkRadius = 1
+	// chunkSlots are enough for two players far apart from each other.
+	chunkSlots        = 2 * (2*chunkRadius + 1) * (2*chunkRadius + 1)
+	chunkUploadBudget = 256 * 1024
+)
+
+// isStreamedLevel tells whether the level is too large to load at once.
+func isStreamedLevel(l *level) bool {
+	return l.width() > maxUnstreamedLevelSize ||
+		l.height() > maxUnstreamedLevelSize
+}
+
+// chunkPos is a chunk's column and row, counted in chunks. Chunk 0,0 holds
+// the tiles 0 to chunkSize-1 in both directions.
+type chunkPos struct {
+	col, row int
+}
+
+func chunkAt(x, z float32) chunkPos {
+	return chunkPos{int(x) / chunkSize, int(-z) / chunkSize}
+}
+
+// chunkDistance counts the chunks between a and b, diagonal steps count as
+// one.
+func chunkDistance(a, b chunkPos) int {
+	return max(a.col-b.col, b.col-a.col, a.row-b.row, b.row-a.row)
+}
+
+// levelChunk is a chunk in one of the stream's slots. Each slot has room for
+// the vertices of any chunk of the level at the same place in the vertex
+// buffer.
+type levelChunk struct {
+	used bool
+	pos  chunkPos
+	box  m.AABB
+	// vertices come from the worker. uploaded counts the floats that are in
+	// the mesh so far. Once all are, done is set, we drop the vertices and
+	// draw vertexCount vertices.
+	vertices    []float32
+	uploaded    int
+	done        bool
+	vertexCount int
+}
+
+// chunkJob is sent to the worker, which sends it back with the vertices.
+// generation tells apart the jobs of a level from those of the level that we
+// played before.
+type chunkJob struct {
+	generation int
+	level      *level
+	pos        chunkPos
+	vertices   []float32
+}
+
+// levelStream loads the chunks of a large level around the jokers.
+type levelStream struct {
+	gfx renderer
+	// level is nil while playing a level that is not streamed.
+	level      *level
+	generation int
+	chunks     [chunkSlots]levelChunk
+	// mesh holds chunkSlots slots of slotVertices vertices each.
+	mesh         meshHandle
+	slotVertices int
+	jobs         chan chunkJob
+	built        chan chunkJob
+}
+
+func newLevelStream(gfx renderer) *levelStream {
+	s := &levelStream{
+		gfx:   gfx,
+		jobs:  make(chan chunkJob, chunkSlots),
+		built: make(chan chunkJob, chunkSlots),
+	}
+	go func() {
+		for job := range s.jobs {
+			job.vertices = job.level.chunkVertices(job.pos)
+			s.built <- job
+		}
+	}()
+	return s
+}
+
+// chunkVertices builds the geometry of the chunk.
+func (l *level) chunkVertices(c chunkPos) []float32 {
+	col0, row0 := c.col*chunkSize, c.row*chunkSize
+	col1 := min(l.width(), col0+chunkSize)
+	row1 := min(l.height(), row0+chunkSize)
+	return l.meshVerticesIn(col0, row0, col1, row1)
+}
+
+// chunkVertexCapacity is the most vertices that a chunk of the level can have:
+// a floor and a ceiling quad per tile and walls along every tile edge, no
+// higher than from the lowest floor up to the ceiling.
+func chunkVertexCapacity(l *level) int {
+	lowest, highest := 0, levelWallHeight
+	for _, row := range l.floorHeights {
+		for _, h := range row {
+			lowest = min(lowest, h)
+			highest = max(highest, h)
+		}
+	}
+	const tiles = chunkSize * chunkSize
+	const edges = 2*chunkSize*(chunkSize-1) + 4*chunkSize
+	wallQuads := highest - lowest
+	return 6 * (2*tiles + edges*wallQuads)
+}
+
+// start streams the level. The chunk at the joker's start is built and
+// uploaded right away so there is ground under the joker's feet.
+func (s *levelStream) start(l *level) error {
+	s.stop()
+	// The worker reads the level while the game goes on, it gets its own
+	// copy in case the caller's variable is reused for the next level.
+	copied := *l
+	l = &copied
+	slotVertices := chunkVertexCapacity(l)
+	if slotVertices != s.slotVertices || s.mesh == invalidMesh {
+		s.release()
+		mesh, err := s.gfx.createDynamicMesh(chunkSlots * slotVertices)
+		if err != nil {
+			return err
+		}
+		s.mesh, s.slotVertices = mesh, slotVertices
+	}
+	s.level = l
+
+	first := &s.chunks[0]
+	first.used = true
+	first.pos = chunkAt(l.jokerStart[0], l.jokerStart[2])
+	first.box = s.chunkBox(first.pos)
+	first.vertices = l.chunkVertices(first.pos)
+	return s.upload(first, len(first.vertices))
+}
+
+// stop forgets the streamed level, chunks that are still being built are
+// dropped when they come back.
+func (s *levelStream) stop() {
+	s.level = nil
+	s.generation++
+	s.chunks = [chunkSlots]levelChunk{}
+}
+
+func (s *levelStream) active() bool {
+	return s.level != nil
+}
+
+// release frees the mesh. The stream can start again afterwards.
+func (s *levelStream) release() {
+	if s.mesh != invalidMesh {
+		s.gfx.releaseMesh(s.mesh)
+		s.mesh = invalidMesh
+	}
+}
+
+// close stops the worker and frees the mesh.
+func (s *levelStream) close() {
+	close(s.jobs)
+	s.release()
+}
+
+// loaded tells whether the chunk with the tile at x,z is drawn. The jokers
+// collide with chunks that are not, so they cannot walk on invisible ground.
+func (s *levelStream) loaded(x, z float32) bool {
+	c := chunkAt(x, z)
+	for i := range s.chunks {
+		if s.chunks[i].used && s.chunks[i].pos == c {
+			return s.chunks[i].done
+		}
+	}
+	return false
+}
+
+// update is called once per frame with the positions of the jokers. It
+// unloads chunks that are too far from all of them, asks the worker for the
+// ones that are missing, nearest first, and uploads built chunks within the
+// budget.
+func (s *levelStream) update(centers [2]m.Vec3, count int) error {
+	for {
+		var job chunkJob
+		select {
+		case job = <-s.built:
+		default:
+			return s.updateChunks(centers, count)
+		}
+		if job.generation != s.generation {
+			continue
+		}
+		for i := range s.chunks {
+			c := &s.chunks[i]
+			if c.used && c.pos == job.pos && !c.done && c.vertices == nil {
+				c.vertices = job.vertices
+			}
+		}
+	}
+}
+
+func (s *levelStream) updateChunks(centers [2]m.Vec3, count int) error {
+	if s.level == nil {
+		return nil
+	}
+
+	var near [2]chunkPos
+	for i := range count {
+		near[i] = chunkAt(centers[i][0], centers[i][2])
+	}
+	wanted := func(c chunkPos) bool {
+		for _, n := range near[:count] {
+			if chunkDistance(c, n) <= chunkRadius {
+				return true
+			}
+		}
+		return false
+	}
+	for i := range s.chunks {
+		if s.chunks[i].used && !wanted(s.chunks[i].pos) {
+			s.chunks[i] = levelChunk{}
+		}
+	}
+
+	chunkCols := (s.level.width() + chunkSize - 1) / chunkSize
+	chunkRows := (s.level.height() + chunkSize - 1) / chunkSize
+	for dist := range chunkRadius + 1 {
+		for _, n := range near[:count] {
+			for row := n.row - dist; row <= n.row+dist; row++ {
+				for col := n.col - dist; col <= n.col+dist; col++ {
+					c := chunkPos{col, row}
+					ring := chunkDistance(c, n) == dist
+					if ring && 0 <= col && col < chunkCols && 0 <= row && row < chunkRows {
+						s.request(c)
+					}
+				}
+			}
+		}
+	}
+
+	budget := chunkUploadBudget
+	for i := range s.chunks {
+		c := &s.chunks[i]
+		if budget > 0 && c.used && c.vertices != nil && !c.done {
+			n := min(len(c.vertices)-c.uploaded, budget/4)
+			if err := s.upload(c, n); err != nil {
+				return err
+			}
+			budget -= n * 4
+		}
+	}
+	return nil
+}
+
+// request gives the chunk a free slot and sends it to the worker, unless it
+// already has a slot. If the worker is busy, we try again next frame.
+func (s *levelStream) request(c chunkPos) {
+	free := -1
+	for i := range s.chunks {
+		if s.chunks[i].used && s.chunks[i].pos == c {
+			return
+		}
+		if !s.chunks[i].used && free == -1 {
+			free = i
+		}
+	}
+	if free == -1 {
+		return
+	}
+	select {
+	case s.jobs <- chunkJob{generation: s.generation, level: s.level, pos: c}:
+		s.chunks[free] = levelChunk{used: true, pos: c, box: s.chunkBox(c)}
+	default:
+	}
+}
+
+// upload copies the next count floats of the chunk's vertices to its slot.
+func (s *levelStream) upload(c *levelChunk, count int) error {
+	slot := 0
+	for i := range s.chunks {
+		if &s.chunks[i] == c {
+			slot = i
+		}
+	}
+	offset := slot*s.slotVertices*float32sPerTexturedVertex + c.uploaded
+	if count > 0 {
+		err := s.gfx.updateMesh(s.mesh, offset, c.vertices[c.uploaded:c.uploaded+count])
+		if err != nil {
+			return err
+		}
+		c.uploaded += count
+	}
+	if c.uploaded == len(c.vertices) {
+		c.done = true
+		c.vertexCount = len(c.vertices) / float32sPerTexturedVertex
+		c.vertices = nil
+	}
+	return nil
+}
+
+// chunkBox is the chunk's bounding box, from the lowest floor to the
+// ceiling.
+func (s *levelStream) chunkBox(c chunkPos) m.AABB {
+	x0, z0 := float32(c.col*chunkSize), -float32(c.row*chunkSize)
+	return m.AABB{
+		Min: m.Vec3{x0, -levelWallHeight, z0 - chunkSize},
+		Max: m.Vec3{x0 + chunkSize, levelWallHeight, z0},
+	}
+}
+
+// draw draws the uploaded chunks that are in view.
+func (s *levelStream) draw(viewProjection m.Mat4) error {
+	frustum := m.FrustumFromMatrix(viewProjection)
+	for i, c := range s.chunks {
+		if !c.done || !frustum.IntersectsAABB(c.box.Min, c.box.Max) {
+			continue
+		}
+		if err := drawTriangles(s.gfx, s.mesh, i*s.slotVertices, c.vertexCount/3); err != nil {
+			return err
+		}
+	}
+	return nil
+}
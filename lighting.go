@@ -0,0 +1,77 @@
+package main
+
+import m "github.com/gonutz/d3dmath/column_major/d3dmath"
+
+// lightingPreset is a time of day. It sets the light for the controller scenes
+// and the levels.
+type lightingPreset struct {
+	name string
+	// direction is the direction that the light shines in.
+	direction m.Vec4
+	// color is the color of the directional light, ambient the color of the
+	// light that falls onto all surfaces equally. How much of each an object
+	// gets is set by its light parameters, see lighting.hlsl.
+	color, ambient m.Vec4
+}
+
+// material is how an object's surface reacts to the light, see lighting.hlsl.
+// Emissive objects glow by themselves, at 1 they are not lit at all.
+type material struct {
+	specularStrength float32
+	specularExponent float32
+	ambient          float32
+	emissive         float32
+}
+
+const (
+	lightingMorning = iota
+	lightingNoon
+	lightingSunset
+	lightingNight
+
+	lightingPresetCount
+)
+
+var lightingPresets = [lightingPresetCount]lightingPreset{
+	lightingMorning: {
+		name:      "Morning",
+		direction: m.Vec4{1.5, -1.5, 1, 0},
+		color:     m.Vec4{1, 0.9, 0.75, 1},
+		ambient:   m.Vec4{0.85, 0.85, 1, 1},
+	},
+	lightingNoon: {
+		name:      "Noon",
+		direction: m.Vec4{-0.7, -4, 1, 0},
+		color:     m.Vec4{1, 1, 1, 1},
+		ambient:   m.Vec4{1, 1, 1, 1},
+	},
+	lightingSunset: {
+		name:      "Sunset",
+		direction: m.Vec4{-2, -0.8, 1, 0},
+		color:     m.Vec4{1, 0.6, 0.35, 1},
+		ambient:   m.Vec4{0.8, 0.6, 0.7, 1},
+	},
+	lightingNight: {
+		name:      "Night",
+		direction: m.Vec4{0.3, -2, 1, 0},
+		color:     m.Vec4{0.35, 0.4, 0.7, 1},
+		ambient:   m.Vec4{0.35, 0.4, 0.7, 1},
+	},
+}
+
+// lightingPresetFromDPad follows the sun: left is morning, up is noon and right
+// is sunset. Down is night. ok is false if no direction or a diagonal is
+// pressed.
+func lightingPresetFromDPad(dpad uint32) (preset int, ok bool) {
+	switch dpad {
+	case 27000:
+		return lightingMorning, true
+	case 0:
+		return lightingNoon, true
+	case 9000:
+		return lightingSunset, true
+	case 18000:
+		return lightingNight, true
+	}
+	return 0, false
+}
@@ -1,41 +1,128 @@
 package main
 
 import (
-	"embed"
+	"errors"
+	"flag"
+	"fmt"
 	"math"
 	"math/rand/v2"
+	"os"
 	"runtime"
+	"slices"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	_ "image/jpeg"
 	_ "image/png"
 
 	"github.com/gonutz/d3d9"
 	m "github.com/gonutz/d3dmath/column_major/d3dmath"
+	"github.com/gonutz/di8"
 	"github.com/gonutz/ds"
-	"github.com/gonutz/dxc"
 	"github.com/gonutz/ease"
 	"github.com/gonutz/obj"
 	"github.com/gonutz/w32/v2"
 )
 
-//go:embed assets
-var assetFiles embed.FS
-
 const fullscreen = true
 
-const fieldOfView = 50
+// backgroundFrameTime is how long we sleep between frames while the window is
+// not focused.
+const backgroundFrameTime = 50 * time.Millisecond
+
+// sysMenuControllerSettings is the command ID of our entry in the window's
+// system menu. Windows uses the lower 4 bits of WM_SYSCOMMAND itself, so it
+// must be a multiple of 16, and IDs from 0xF000 on are taken by Windows.
+const sysMenuControllerSettings = 0x0010
+
+// cameraFollowRate is how fast the cameras follow their targets, see
+// m.DampFactor. It moves them 5% closer every frame at 60 FPS.
+const cameraFollowRate = 3
 
 const (
-	gameStateFadingIn = iota
+	gameStateTitle = iota
+	gameStateOptions
+	gameStateLevelSelect
+	gameStateControllerTest
+	gameStateControllerSelect
+	gameStateFadingIn
 	gameStateXBoxControllerFlyingIn
 	gameStateXBoxController
 	gameStateTransitionToJoystick
 	gameStateJoystickRotating
 	gameStateJoystickShrinking
 	gameStatePlayingLevel
+	gameStateLevelComplete
+	gameStateDialogue
+	gameStateCutscene
+	gameStateStatistics
+	gameStatePaused
+	gameStateCredits
+)
+
+var gameStateNames = [...]string{
+	gameStateTitle:                  "title",
+	gameStateOptions:                "options",
+	gameStateLevelSelect:            "level select",
+	gameStateControllerTest:         "controller test",
+	gameStateControllerSelect:       "controller select",
+	gameStateFadingIn:               "fading in",
+	gameStateXBoxControllerFlyingIn: "XBox controller flying in",
+	gameStateXBoxController:         "XBox controller",
+	gameStateTransitionToJoystick:   "transition to joystick",
+	gameStateJoystickRotating:       "joystick rotating",
+	gameStateJoystickShrinking:      "joystick shrinking",
+	gameStatePlayingLevel:           "playing level",
+	gameStateLevelComplete:          "level complete",
+	gameStateDialogue:               "dialogue",
+	gameStateCutscene:               "cutscene",
+	gameStateStatistics:             "statistics",
+	gameStatePaused:                 "paused",
+	gameStateCredits:                "credits",
+}
+
+// inLevel tells whether the given game state shows the level.
+func inLevel(state int) bool {
+	return state == gameStatePlayingLevel ||
+		state == gameStateLevelComplete ||
+		state == gameStateDialogue ||
+		state == gameStateCutscene ||
+		state == gameStateStatistics ||
+		state == gameStatePaused
+}
+
+// triggerStay tells whether a joker is inside a trigger and if its entering
+// fired the enter event.
+type triggerStay uint8
+
+const (
+	outsideTrigger triggerStay = iota
+	// insideSilently is a joker that walked into a once trigger after it had
+	// fired. Neither its entering nor its leaving fire an event.
+	insideSilently
+	insideFired
 )
 
+// suspendedLevel is the state of a level that the players left through a
+// teleport. We restore it when they come back from the bonus level.
+type suspendedLevel struct {
+	level         *level
+	model         model
+	collider      *meshCollider
+	collected     []bool
+	pickedUp      []bool
+	doorOpen      []bool
+	insideTrigger [][2]triggerStay
+	triggerFired  []bool
+	levelTime     time.Duration
+	jokers        [2]joker
+	cameras       [2]followCamera
+	// teleport is where the jokers come back to.
+	teleport tilePos
+}
+
 var desiredButtonStates = []uint16{
 	w32.XINPUT_GAMEPAD_A,
 	0,
@@ -65,40 +152,6 @@ var desiredButtonStates = []uint16{
 	0,
 }
 
-var floorHeights = [][]int{
-	{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
-	{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
-	{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
-	{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
-	{0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0},
-	{0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0, 0},
-	{0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
-	{0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0},
-	{0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
-	{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
-	{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, -1, -1, 0, 0, 0, 0, 0},
-	{0, 0, 0, 0, 0, 1, 1, 1, 0, 0, 0, -1, -1, 0, 0, 0, 0, 0},
-	{0, 0, 0, 0, 0, 1, 2, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
-	{0, 0, 0, 0, 0, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
-	{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
-	{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
-	{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
-	{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
-}
-
-func floorHeightAt(x, z float32) int {
-	if x < 0 || z > 0 {
-		return 999
-	}
-	worldW, worldH := len(floorHeights[0]), len(floorHeights)
-	tx, ty := int(x), int(-z)
-	if 0 <= tx && tx < worldW &&
-		0 <= ty && ty < worldH {
-		return floorHeights[ty][tx]
-	}
-	return 999
-}
-
 // This function computes our desired sound distortion (the speed at which we
 // play the sound), depending on the controller input x, which is in the range
 // [-1..1]. It will return a speed of 1 at roughly 0.5, so when the controller
@@ -128,77 +181,235 @@ func norm01(x float64) float64 {
 
 func main() {
 	runtime.LockOSThread()
+	defer reportFatalError()
+
+	hosting := flag.Bool("host", false, "host a two-player game")
+	joinAddress := flag.String("join", "", "join a two-player game at this address, e.g. 192.168.0.5")
+	netPort := flag.Int("port", defaultNetPort, "UDP port for two-player games")
+	var assetPacks []string
+	flag.Func("pack", "load an asset pack whose files replace the built-in ones, can be repeated", func(path string) error {
+		assetPacks = append(assetPacks, path)
+		return nil
+	})
+	seed := flag.Uint64("seed", 0, "seed for all gameplay randomness, 0 picks one from the clock")
+	profileAddress := flag.String("profile", "", "serve net/http/pprof and performance counters at this address, e.g. localhost:6060")
+	reportAllocations := flag.Bool("allocs", false, "print the number of heap allocations per frame every second")
+	watchdogTimeout := flag.Duration("watchdog", 5*time.Second, "report a hang when the main loop does not run for this long, 0 disables it")
+	hangDialog := flag.Bool("hangdialog", true, "ask whether to keep waiting or quit when the watchdog reports a hang")
+	randomLevelSize := flag.Int("randomsize", defaultLevelParams().width, "width and height of random levels in tiles, levels larger than 18 are streamed in chunks")
+	flag.Parse()
+
+	mainLoopWatchdog = startWatchdog(*watchdogTimeout, *hangDialog)
+
+	var err error
+	assets, err = openAssets(assetPacks)
+	if err != nil {
+		check(&initError{message: "Cannot load the game's assets.", err: err})
+	}
+	if validateAssetsAtStartup {
+		if err := validateAssets(assets); err != nil {
+			check(&initError{message: "Some assets are broken.", err: err})
+		}
+	}
+
+	if *profileAddress != "" {
+		if err := startProfiling(*profileAddress); err != nil {
+			check(&initError{message: "Cannot start profiling.", err: err})
+		}
+	}
+
+	userSettings := loadSettings()
+
+	stats := newTelemetry(userSettings)
+	defer stats.finish()
+
+	// All gameplay randomness comes from rng so that a session can be
+	// replayed by passing its seed on the command line.
+	if *seed == 0 {
+		*seed = uint64(time.Now().UnixNano())
+	}
+	rng := rand.New(rand.NewPCG(*seed, 0))
+	fmt.Fprintf(os.Stderr, "random seed: %d\n", *seed)
+	stats.recordSeed(*seed)
+
+	savedGame := loadSaveGame()
+	// Saving is best effort, we do not want to stop the game because of it.
+	saveProgress := func() { savedGame.save() }
+	// The statistics change all the time, we save them when leaving.
+	defer saveProgress()
+	stats.recordStage(gameStateNames[gameStateTitle])
 
 	// These are the state variables used throughout the different states of
 	// the game.
-	gameState := gameStateFadingIn
-	fadeInColor := -100
+	gameState := gameStateTitle
+	// menuChoice is the selected line in the title, options and level select
+	// menus.
+	menuChoice := 0
+	// controllerTestScreen is opened from the options. controllerTestBackFrames
+	// counts how long back is held down to leave it.
+	var controllerTestScreen controllerTest
+	controllerTestBackFrames := 0
+	// practice is the free-roam mode for exploring the levels: the jokers
+	// take no damage, bonus levels have no time limit and the corner
+	// cameras work everywhere.
+	practice := false
+	// creditsScroll is how many pixels the credits have moved up from the
+	// bottom of the screen. creditsAfterGame is true if the last level was
+	// completed, the credits then lead back to the first level instead of
+	// the title screen.
+	var creditsScroll float32
+	creditsAfterGame := false
+	creditsFrames := 0
+	startCredits := func(afterGame bool) {
+		gameState = gameStateCredits
+		creditsScroll = 0
+		creditsFrames = 0
+		creditsAfterGame = afterGame
+	}
 	const backgroundGray = 200
 	xboxBlinkTimer := 0
+	// flashingTaskbar is true while the taskbar button blinks because we wait
+	// for the XBox controller.
+	flashingTaskbar := false
 	joystickBlinkTimer := 0
-	controllerFlyTime := 0.0
 	const finalControllerZ = 2.0
 	const finalControllerXRotation = 0.12
-	const joystickScaleSpeed = 0.0061
 	controllerYRotation := float32(0)
 	controllerXRotation := float32(0)
 	specularStrength := float32(0.5)
 	specularExponent := float32(16)
-	var lastButtonState uint16
-	lastButtonStates := make([]uint16, len(desiredButtonStates))
-	gamepadScale := float32(1)
-	joystickScale := float32(0)
 	const joystickYRotationSpeed = 0.0025
 	joystickYRotation := float32(0)
 	var lastJoystickState joystickState
 	var lastXBoxState xboxControllerState
+	var lastKeyboardState di8.KEYBOARDSTATE
+
+	// The intro's transitions are tweens. They advance once per frame so their
+	// durations are in frames.
+	var animations ease.Animator
+	fadeIn := ease.NewTween(-100, backgroundGray, backgroundGray+100, nil)
+	controllerFlyIn := ease.NewTween(0, 1, 400, nil)
+	const joystickScaleFrames = 164
+	gamepadScale := ease.NewTween(1, 0, joystickScaleFrames, nil)
+	joystickScale := ease.NewTween(0, 1, joystickScaleFrames, nil)
+	fadeIn.OnDone = func() {
+		gameState = gameStateXBoxControllerFlyingIn
+		animations.Add(controllerFlyIn)
+	}
+	controllerFlyIn.OnDone = func() { gameState = gameStateXBoxController }
+	// The joystick only grows after the gamepad has vanished.
+	gamepadScale.OnDone = func() { animations.Add(joystickScale) }
+	joystickScale.OnDone = func() { gameState = gameStateJoystickRotating }
+
 	levelColor := float32(30)
-	jokerPos := m.Vec3{9.4, 0, -7.6}
-	jokerRot := float32(0.57)
-	const jokerBaseRot = -0.25
-	jokerSpeed := 0.0
 	const jokerAcceleration = 0.004
 	const maxJokerSpeed = 0.04
 	const minJokerSpeed = -maxJokerSpeed / 2
-	jokerLimbRot := 0.0
 	const jokerSpeedLimbRatio = 0.55
-	cameraCornerPositions := []m.Vec3{
-		{9, 5.5, -0.5},
-		{17.5, 5.5, -0.5},
-		{17.5, 5.5, -9},
-		{17.5, 5.5, -17.5},
-		{9, 5.5, -17.5},
-		{0.5, 5.5, -17.5},
-		{0.5, 5.5, -9},
-		{0.5, 5.5, -0.5},
-	}
-	cameraTargetCorner := cameraCornerPositions[5]
-	cameraPos := cameraTargetCorner
-	cameraInCorner := true
-	jokerSpeedY := float32(0)
 	const gravity = -0.005
 	const jokerJumpSpeed = 0.115
-	wasOnGround := true
-	stepCoolDown := 0
-
-	pushButtonState := func(s uint16) {
-		copy(lastButtonStates, lastButtonStates[1:])
-		lastButtonStates[len(lastButtonStates)-1] = s
+	levelIndex := 0
+	currentLevel := &levels[levelIndex]
+	// levelTime is the time spent in the current level, it is shown on the
+	// results screen once the level is complete.
+	var levelTime time.Duration
+	// levelCompleteFrames counts the frames since reaching the exit, we first
+	// celebrate and then show the results.
+	levelCompleteFrames := 0
+	const celebrationFrames = 150
+	// resultsChoice is the selected entry on the results screen, 0 for the
+	// next level, 1 for a random level and 2 for the statistics.
+	resultsChoice := 0
+	// resultsLines and statisticsLines are formatted when their screen opens,
+	// the values do not change while it is shown.
+	var resultsLines, statisticsLines []string
+	// In local co-op, player 2 controls the second joker with the second XBox
+	// controller or the joystick.
+	playerCount := 1
+	var jokers [2]joker
+	var cameras [2]followCamera
+	// playerOf returns the index of the player who controls the joker.
+	playerOf := func(j *joker) int {
+		if j == &jokers[1] {
+			return 1
+		}
+		return 0
 	}
-
-	lightDir := m.Vec4{1, -1, 1, 0}
-
-	var err error
-
-	input, err := initInputSystem()
+	// haptics rumbles the controllers and shakes the cameras when something
+	// happens to a player, see feedbackPatterns for the tuning.
+	var haptics feedback
+	jokers[0] = newJoker(currentLevel.jokerStart, currentLevel.jokerStartRot)
+	cameras[0] = newFollowCamera(currentLevel)
+	// combinedCamera shows both players in one view instead of split-screen.
+	combinedCamera := false
+	combinedCameraPos := cameras[0].pos
+	var lastSecondXBoxState xboxControllerState
+	// Collectibles are shared, it does not matter which player collects them.
+	collected := make([]bool, len(currentLevel.collectibles))
+	collectibleSpin := 0.0
+	// pickedUp and doorOpen are per level, the items themselves go into the
+	// inventory, which is saved.
+	pickedUp := make([]bool, len(currentLevel.items))
+	doorOpen := make([]bool, len(currentLevel.doors))
+	// teleportUsed is kept for the normal level while the players are in a
+	// bonus level, bonusReturn is the level to go back to, nil if the
+	// players are not in a bonus level.
+	teleportUsed := make([]bool, len(currentLevel.teleports))
+	var bonusReturn *suspendedLevel
+	// lockedDoorHint is the number of frames that we show a hint about a
+	// missing key after a player bumped into a locked door.
+	lockedDoorHint := 0
+	// openDialogue is the conversation in gameStateDialogue. nearNPC is the
+	// index of the NPC that a player can talk to right now, or -1.
+	var openDialogue *dialogueBox
+	nearNPC := -1
+	// frameTime is the real time that passed since the last frame.
+	var frameTime time.Duration
+	// insideTrigger tells for each of the level's triggers which jokers are
+	// inside it. triggerFired is set once a trigger's enter event fired.
+	insideTrigger := make([][2]triggerStay, len(currentLevel.triggers))
+	triggerFired := make([]bool, len(currentLevel.triggers))
+	// tutorialText is shown at the top of the screen for tutorialTimeLeft.
+	tutorialText := ""
+	var tutorialTimeLeft time.Duration
+	const tutorialDuration = 4 * time.Second
+	// activeCutscene is played in gameStateCutscene, cutsceneTime is how far
+	// into it we are.
+	var activeCutscene *cutscene
+	var cutsceneTime time.Duration
+	// cutsceneCurve is the activeCutscene's easing curve. We look it up once
+	// when the cutscene starts, ease.ByName allocates a lowercase name.
+	var cutsceneCurve func(float64) float64
+	// The cutscene camera takes cutsceneBlend to fly from the players to the
+	// cutscene's view and back.
+	const cutsceneBlend = 800 * time.Millisecond
+
+	// lighting is the active lighting preset. The D-pad changes it in the
+	// XBox controller scene and in the level, see lightingPresetFromDPad.
+	lighting := lightingNoon
+
+	// The game only uses the input, sound and rendering backends through their
+	// interfaces, see backends.go.
+	var inputDevices inputSource
+	inputDevices, err = initInputSystem()
 	check(err)
-	defer input.close()
+	defer inputDevices.close()
+	input := inputDevices.state()
 
 	var lastMouseX, lastMouseY int
 	var rotationAboutY, rotationAboutX float32
 	rotationAboutX = 0.1
 	translation := float32(4)
 
+	// windowActive is false while the user works in another window.
+	windowActive := true
+	// runtimeStats is the overlay that F3 toggles. inputReadTime is when we
+	// read the controllers this frame, for measuring the input latency.
+	runtimeStats := newStatsOverlay()
+	var inputReadTime time.Time
+	// coveringMonitor is set once the window is made fullscreen.
+	coveringMonitor := false
+
 	className, _ := syscall.UTF16PtrFromString("game_window_class")
 	w32.RegisterClassEx(&w32.WNDCLASSEX{
 		Cursor: w32.LoadCursor(0, w32.MakeIntResource(w32.IDC_ARROW)),
@@ -237,12 +448,55 @@ func main() {
 				if w == w32.VK_ESCAPE {
 					w32.PostQuitMessage(0)
 				}
+				// Bit 30 is set for repeated key downs while F3 is held.
+				if msg == w32.WM_KEYDOWN && w == w32.VK_F3 && l&(1<<30) == 0 {
+					runtimeStats.visible = !runtimeStats.visible
+				}
 				return 0
+			case w32.WM_ACTIVATE:
+				windowActive = w&0xFFFF != w32.WA_INACTIVE
+				return w32.DefWindowProc(window, msg, w, l)
+			case w32.WM_DISPLAYCHANGE, w32.WM_WINDOWPOSCHANGED:
+				// When the resolution changes or the window is moved to another
+				// monitor, e.g. with Windows+Shift+Arrow, we fill that monitor.
+				minimized := w32.GetWindowLong(window, w32.GWL_STYLE)&w32.WS_MINIMIZE != 0
+				if coveringMonitor && !minimized {
+					if monitor, ok := monitorOf(window); ok {
+						coverMonitor(window, monitor)
+					}
+				}
+				return w32.DefWindowProc(window, msg, w, l)
+			case w32.WM_ENTERSIZEMOVE:
+				// Moving or resizing the window runs a modal loop, our main
+				// loop waits until the user lets go.
+				mainLoopWatchdog.pause()
+				return w32.DefWindowProc(window, msg, w, l)
+			case w32.WM_EXITSIZEMOVE:
+				mainLoopWatchdog.tick()
+				return w32.DefWindowProc(window, msg, w, l)
+			case w32.WM_ENTERMENULOOP:
+				// The system menu runs a modal loop as well.
+				mainLoopWatchdog.pause()
+				return w32.DefWindowProc(window, msg, w, l)
+			case w32.WM_EXITMENULOOP:
+				mainLoopWatchdog.tick()
+				return w32.DefWindowProc(window, msg, w, l)
 			case w32.WM_DEVICECHANGE:
 				if w == w32.DBT_DEVNODES_CHANGED {
-					input.connectJoystick()
+					inputDevices.connectJoystick()
 				}
 				return 0
+			case w32.WM_SYSCOMMAND:
+				if w&0xFFF0 == sysMenuControllerSettings {
+					// Failing to open the control panel is not worth
+					// stopping the game, the user can still open it from
+					// Windows.
+					mainLoopWatchdog.pause()
+					inputDevices.runControlPanel(window)
+					mainLoopWatchdog.tick()
+					return 0
+				}
+				return w32.DefWindowProc(window, msg, w, l)
 			case w32.WM_DESTROY:
 				w32.PostQuitMessage(0)
 				return 0
@@ -261,260 +515,333 @@ func main() {
 		w32.CW_USEDEFAULT, w32.CW_USEDEFAULT, 640, 480,
 		0, 0, 0, nil,
 	)
+	// Destroying the window on exit makes sure it does not cover the error
+	// dialog that reportFatalError shows in case something goes wrong.
+	defer w32.DestroyWindow(window)
+
+	inputDevices.connectKeyboard(window)
+	inputDevices.setPlayer1Controller(userSettings.Player1Controller)
+
+	// The window's system menu, the one behind the icon in the title bar, has
+	// an entry to calibrate the joystick outside the game.
+	sysMenu := w32.GetSystemMenu(window, false)
+	w32.AppendMenu(sysMenu, w32.MF_SEPARATOR, 0, "")
+	w32.AppendMenu(
+		sysMenu,
+		w32.MF_STRING,
+		sysMenuControllerSettings,
+		"Controller settings...",
+	)
+
+	icon, err := createWindowIcon()
+	check(err)
+	defer w32.DestroyIcon(icon)
+	setWindowIcon(window, icon)
+
+	var network *netSession
+	if *hosting {
+		network, err = hostGame(*netPort)
+	} else if *joinAddress != "" {
+		network, err = joinGame(*joinAddress, *netPort)
+	}
+	if err != nil {
+		check(&initError{message: "Cannot start the network game.", err: err})
+	}
+	if network != nil {
+		defer network.close()
+	}
 
-	sound, err := initSoundSystem(ds.HWND(window))
+	var sound audioOutput
+	sound, err = initSoundSystem(ds.HWND(window), userSettings.SurroundSound)
 	check(err)
 	defer sound.close()
 
-	check(sound.preload("assets/music_intro.ogg"))
-	check(sound.preload("assets/music_loop.ogg"))
+	if !demoContent {
+		check(sound.preload("assets/music_intro.ogg"))
+	}
+	check(sound.preload(musicLoopPath))
+	check(sound.preloadLowPass(musicLoopPath, musicMuffledPath, musicMuffledCutoff))
 	check(sound.preload("assets/blip.ogg"))
 	check(sound.preload("assets/step.ogg"))
 
+	// applyVolumes sets the volumes from the settings, the options menu calls
+	// it whenever they change.
+	applyVolumes := func() {
+		sound.setMasterVolume(userSettings.MasterVolume)
+		sound.setBusVolume(busMusic, userSettings.MusicVolume)
+		sound.setBusVolume(busEffects, userSettings.EffectsVolume)
+	}
+	applyVolumes()
+
 	instructions, err := sound.loop("assets/instructions.ogg")
 	check(err)
 	sound.setSpeed(instructions, 0)
 
-	objectVertexShaderCode, err := dxc.Compile([]byte(`
-float4x4 mvp: register(c0);
-float4x4 normalTransform: register(c4);
-
-struct input {
-	float4 position: POSITION;
-	float3 normal: NORMAL;
-	float2 uv: TEXCOORD0;
-};
-
-struct output {
-	float4 position: POSITION;
-	float3 normal: NORMAL;
-	float2 uv: TEXCOORD0;
-	float4 worldPosition: TEXCOORD1;
-};
-
-void main(in input IN, out output OUT) {
-	OUT.position = mul(IN.position, mvp);
-	OUT.normal = mul(float4(IN.normal, 1), normalTransform).xyz;
-	OUT.uv = IN.uv;
-	OUT.worldPosition = OUT.position;
-}
-	`), "main", "vs_3_0", dxc.WARNINGS_ARE_ERRORS, 0)
-	check(err)
+	// Triggers in the level change the music's intensity. We fade its volume
+	// towards the target volume.
+	musicVolumes := [...]float64{
+		musicCalm:    0.4,
+		musicNormal:  1,
+		musicIntense: 1.3,
+	}
+	var musicIntro, musicLoop soundHandle
+	musicVolume := musicVolumes[musicNormal]
+	targetMusicVolume := musicVolume
+	// musicLoop has the muffled stem, see music.go. Outside the levels, the
+	// intensity is 1 and we only hear the full music.
+	musicMuffledStem := 0
+	stemIntensity := float32(1)
+
+	// startMusic ends the intro's instructions and starts the level music.
+	startMusic := func() {
+		sound.stop(instructions)
+
+		var err error
+		if demoContent {
+			musicLoop, err = sound.loop(musicLoopPath)
+			check(err)
+		} else {
+			musicIntro, err = sound.play("assets/music_intro.ogg")
+			check(err)
+			musicLoop, err = sound.queueLoopAfter(musicIntro, musicLoopPath)
+			check(err)
+			check(sound.setBus(musicIntro, busMusic))
+		}
+		check(sound.setBus(musicLoop, busMusic))
+		musicMuffledStem, err = sound.addStem(musicLoop, musicMuffledPath)
+		check(err)
+	}
 
-	objectPixelShaderCode, err := dxc.Compile([]byte(`
-float4 colorFactor: register(c0);
-float4 lightDirection: register(c1);
-// lightParameters is (specular strength, specular exponent, ambient strength).
-float4 lightParameters: register(c2);
-
-sampler img;
-
-struct input {
-	float3 normal: NORMAL;
-	float2 uv: TEXCOORD0;
-	float4 worldPosition: TEXCOORD1;
-};
-
-struct output {
-	float4 color: COLOR0;
-};
-
-void main(in input IN, out output OUT) {
-	// For an explanation of this lighting model, see
-	// https://learnopengl.com/Lighting/Basic-Lighting
-	float4 lightColor = float4(1, 1, 1, 1);
-	float4 objectColor = tex2D(img, IN.uv);
-	float3 norm = normalize(IN.normal);
-	float3 pos = IN.worldPosition.xyz / IN.worldPosition.w;
-
-	float ambientStrength = lightParameters.z;
-	float4 ambient = ambientStrength * lightColor;
-
-	float3 lightDir = -normalize(lightDirection.xyz);
-	float diff = max(0, dot(norm, lightDir));
-	float4 diffuse = diff * lightColor;
-
-	float specularStrength = lightParameters.x;
-	float3 viewPos = float3(0, 0, 0);
-	float3 viewDir = normalize(viewPos - pos);
-	float3 reflectDir = reflect(-lightDir, norm);
-	float spec = pow(max(0, dot(viewDir, reflectDir)), lightParameters.y);
-	float4 specular = specularStrength * spec * lightColor;
-
-	OUT.color = min(1, ambient + diffuse + specular) * objectColor * colorFactor;
-}
-	`), "main", "ps_3_0", dxc.WARNINGS_ARE_ERRORS, 0)
-	check(err)
+	// Entering the secret button sequence on the XBox controller starts the
+	// transition to the joystick.
+	introCombos := newComboDetector()
+	introCombos.register(desiredButtonStates, 0, func() {
+		gameState = gameStateTransitionToJoystick
+		animations.Add(gamepadScale)
+		startMusic()
+	})
+
+	check(requireDLL("d3d9.dll", errDirect3DMissing))
 
 	d3d, err := d3d9.Create(d3d9.SDK_VERSION)
-	check(err)
+	if err != nil {
+		check(errDirect3DMissing(err))
+	}
 	defer d3d.Release()
 
-	createFlags := uint32(d3d9.CREATE_SOFTWARE_VERTEXPROCESSING)
-	caps, err := d3d.GetDeviceCaps(d3d9.ADAPTER_DEFAULT, d3d9.DEVTYPE_HAL)
-	if err == nil &&
-		caps.DevCaps&d3d9.DEVCAPS_HWTRANSFORMANDLIGHT != 0 {
-		createFlags = d3d9.CREATE_HARDWARE_VERTEXPROCESSING
-	}
-
-	pp := d3d9.PRESENT_PARAMETERS{
-		Windowed:      1,
-		HDeviceWindow: d3d9.HWND(window),
-		// SWAPEFFECT_COPY lets Present define the rectangle.
-		SwapEffect: d3d9.SWAPEFFECT_COPY,
-		// We use 2048 by 2048 which gets scaled to the monitor resolution on
-		// Present.
-		BackBufferWidth:        2048,
-		BackBufferHeight:       2048,
-		BackBufferFormat:       d3d9.FMT_UNKNOWN,
-		BackBufferCount:        1,
-		EnableAutoDepthStencil: 1,
-		AutoDepthStencilFormat: d3d9.FMT_D24X8,
-	}
-
-	device, _, err := d3d.CreateDevice(
-		d3d9.ADAPTER_DEFAULT,
-		d3d9.DEVTYPE_HAL,
-		d3d9.HWND(window),
-		createFlags,
-		pp,
-	)
-	check(err)
-	defer device.Release()
+	// We render with the adapter of the monitor that the window will cover,
+	// so fullscreen modes switch that monitor and not the primary one.
+	adapter := uint(d3d9.ADAPTER_DEFAULT)
+	if monitor, ok := chooseMonitor(userSettings.Monitor); ok && fullscreen {
+		adapter = adapterOf(d3d, monitor.handle)
+	}
 
-	objectVertexShader, err := device.CreateVertexShaderFromBytes(objectVertexShaderCode)
+	// A display mode from the settings that the adapter no longer supports,
+	// e.g. after changing the monitor, falls back to the desktop.
+	displayModes := listDisplayModes(d3d, adapter)
+	displayModeIndex := max(0, slices.Index(displayModes, userSettings.DisplayMode))
+
+	// gfx releases all textures and meshes that are left when it is closed.
+	var gfx renderer
+	gfx, err = newGraphicsSystem(d3d, adapter, window, displayModes[displayModeIndex])
 	check(err)
-	defer objectVertexShader.Release()
+	defer gfx.close()
 
-	objectPixelShader, err := device.CreatePixelShaderFromBytes(objectPixelShaderCode)
+	hud, err := newHUD(gfx)
 	check(err)
-	defer objectPixelShader.Release()
+	defer hud.release()
+	// hudText is reused every frame to format the HUD's numbers without
+	// allocating, see hud.textBytes.
+	var hudText []byte
+
+	if identifier, err := d3d.GetAdapterIdentifier(adapter, 0); err == nil {
+		// Without caps, we report no hardware transform and lighting.
+		caps, _ := d3d.GetDeviceCaps(adapter, d3d9.DEVTYPE_HAL)
+		stats.recordHardware(identifier, caps)
+	}
 
-	texturedVertex, err := device.CreateVertexDeclaration([]d3d9.VERTEXELEMENT{
-		{Offset: 0, Type: d3d9.DECLTYPE_FLOAT3, Usage: d3d9.DECLUSAGE_POSITION},
-		{Offset: 3 * 4, Type: d3d9.DECLTYPE_FLOAT3, Usage: d3d9.DECLUSAGE_NORMAL},
-		{Offset: 6 * 4, Type: d3d9.DECLTYPE_FLOAT2, Usage: d3d9.DECLUSAGE_TEXCOORD},
-		d3d9.DeclEnd(),
-	})
+	xboxControllerTexture, err := loadTexture(gfx, "assets/xbox_controller.jpg")
 	check(err)
-	defer texturedVertex.Release()
 
-	xboxControllerTexture, err := loadTexture(device, "assets/xbox_controller.jpg")
+	joystickTexture, err := loadTexture(gfx, "assets/joystick.jpg")
 	check(err)
-	defer xboxControllerTexture.Release()
 
-	joystickTexture, err := loadTexture(device, "assets/joystick.jpg")
+	jokerTexture, err := loadTexture(gfx, "assets/joker.jpg")
 	check(err)
-	defer joystickTexture.Release()
 
-	jokerTexture, err := loadTexture(device, "assets/joker.jpg")
+	levelTexture, err := loadTexture(gfx, "assets/level.png")
 	check(err)
-	defer jokerTexture.Release()
 
-	levelTexture, err := loadTexture(device, "assets/level.png")
+	whiteTexture, err := createWhiteTexture(gfx)
 	check(err)
-	defer levelTexture.Release()
 
 	jokerModel, err := loadObj("assets/joker.obj")
 	check(err)
 
-	levelModel, err := loadObj("assets/level.obj")
+	controllerModel, err := loadObj("assets/xbox_controller.obj")
 	check(err)
 
-	controllerModel, err := loadObj("assets/xbox_controller.obj")
+	dialogues, err := loadDialogues("assets/dialogue.json")
 	check(err)
+	for _, l := range levels {
+		for _, n := range l.npcs {
+			if dialogues[n.dialogue] == nil {
+				check(fmt.Errorf("NPC in level %q has unknown dialogue %q", l.name, n.dialogue))
+			}
+		}
+	}
 
 	joystickModel, err := loadObj("assets/joystick.obj")
 	check(err)
 
 	vertices := make([]float32, 0, 1024*1024*4)
-
-	addFace := func(obj *obj.File, f obj.FaceVertex, box *aabb) {
-		v := obj.Vertices[f.VertexIndex][:3]
-		x, y, z := v[0], v[1], v[2]
-
-		if x < box.x.min {
-			box.x.min = x
-		}
-		if y < box.y.min {
-			box.y.min = y
-		}
-		if z < box.z.min {
-			box.z.min = z
-		}
-		if x > box.x.max {
-			box.x.max = x
-		}
-		if y > box.y.max {
-			box.y.max = y
-		}
-		if z > box.z.max {
-			box.z.max = z
-		}
-
-		vertices = append(vertices, v...)
-		vertices = append(vertices, obj.Normals[f.NormalIndex][:3]...)
-		if f.TexCoordIndex < 0 {
-			vertices = append(vertices, 0, 0)
-		} else {
-			vertices = append(vertices, obj.TexCoords[f.TexCoordIndex][:2]...)
-		}
-	}
-
-	addModel := func(obj *obj.File) model {
-		var m model
-		for _, o := range obj.Objects {
-			faces := obj.Faces[o.StartFace:o.EndFace]
+	// vertexColors has one entry per vertex in vertices.
+	vertexColors := make([]uint32, 0, 1024*1024/2)
+
+	addModel := func(file *obj.File) model {
+		// Our meshes hold plain triangle lists so we expand the indexed
+		// mesh here.
+		mesh := file.Indexed()
+		var result model
+		for _, p := range mesh.Parts {
 			part := modelPart{
-				name:        o.Name,
+				name:        p.Name,
+				material:    p.Material,
 				firstVertex: len(vertices),
-				box:         emptyAABB,
+				box:         m.AABB{Min: p.Bounds.Min, Max: p.Bounds.Max},
 			}
-
-			for _, face := range faces {
-				for i := 2; i < len(face); i++ {
-					addFace(obj, face[0], &part.box)
-					addFace(obj, face[i-1], &part.box)
-					addFace(obj, face[i], &part.box)
+			for _, i := range mesh.Indices[p.StartIndex:p.EndIndex] {
+				v := mesh.Vertices[i*obj.FloatsPerIndexedVertex:][:obj.FloatsPerIndexedVertex]
+				vertices = append(vertices, v...)
+				if mesh.Colors != nil {
+					vertexColors = append(vertexColors, vertexColor(mesh.Colors[i]))
+				} else {
+					vertexColors = append(vertexColors, whiteVertex)
 				}
 			}
-
 			part.endVertex = len(vertices)
-			m = append(m, part)
+			result = append(result, part)
 		}
-		return m
+		return result
 	}
 
 	controller3D := addModel(controllerModel)
 	joystick3D := addModel(joystickModel)
 	joker3D := addModel(jokerModel)
-	level3D := addModel(levelModel)
 
-	float32sPerTexturedVertex := 8
-	objectBufferSize := uint(len(vertices) * float32sPerTexturedVertex)
-	objectBufferStride := uint(float32sPerTexturedVertex * 4)
+	addGeneratedModel := func(name string, generated []float32) model {
+		part := modelPart{name: name, firstVertex: len(vertices), box: m.EmptyAABB()}
+		for i := 0; i+3 <= len(generated); i += 8 {
+			part.box = part.box.Extend(m.Vec3(generated[i : i+3]))
+		}
+		vertices = append(vertices, generated...)
+		vertexColors = appendWhiteVertices(vertexColors, len(generated)/8)
+		part.endVertex = len(vertices)
+		return model{part}
+	}
 
-	objectBuffer, err := device.CreateVertexBuffer(
-		objectBufferSize, d3d9.USAGE_WRITEONLY, 0, d3d9.POOL_DEFAULT, 0,
-	)
-	check(err)
-	defer objectBuffer.Release()
+	levelModels := make([]model, len(levels))
+	for i := range levels {
+		if levels[i].modelPath != "" {
+			levelModel, err := loadObj(levels[i].modelPath)
+			check(err)
+			levelModels[i] = addModel(levelModel)
+		} else {
+			levelModels[i] = addGeneratedModel(levels[i].name, levels[i].meshVertices())
+		}
+	}
+	bonusModels := make([]model, len(bonusLevels))
+	for i := range bonusLevels {
+		bonusModels[i] = addGeneratedModel(bonusLevels[i].name, bonusLevels[i].meshVertices())
+	}
+	// levelModel is drawn for the current level, it is nil for a random
+	// level, which has its own mesh.
+	levelModel := levelModels[levelIndex]
+
+	gem3D := addGeneratedModel("gem", gemVertices())
+	box3D := addGeneratedModel("box", boxVertices())
+	tile3D := addGeneratedModel("tile", tileVertices())
+	propModels := map[string]model{
+		"ramp": addGeneratedModel("ramp", rampVertices()),
+	}
+	for _, l := range levels {
+		for _, p := range l.props {
+			if _, ok := propModels[p.model]; !ok {
+				check(fmt.Errorf("level %q uses unknown prop model %q", l.name, p.model))
+			}
+		}
+	}
 
-	mem, err := objectBuffer.Lock(0, objectBufferSize, d3d9.LOCK_DISCARD)
-	check(err)
-	mem.SetFloat32s(0, vertices)
-	check(objectBuffer.Unlock())
+	// uploadVertices puts all model vertices and their colors into one mesh.
+	// It is called again when hot-reloading adds new models.
+	var objectMesh meshHandle
+	uploadVertices := func() error {
+		mesh, err := gfx.createMesh(vertices, vertexColors)
+		if err != nil {
+			return err
+		}
+		gfx.releaseMesh(objectMesh)
+		objectMesh = mesh
+		return nil
+	}
+	check(uploadVertices())
+
+	// Generated levels are not known at startup, they get their own mesh
+	// which is replaced for every new random level.
+	var randomLevel level
+	var randomLevelMesh meshHandle
+	randomLevelVertexCount := 0
+	// levelStream loads random levels that are too large for one mesh chunk
+	// by chunk, see isStreamedLevel.
+	levelStream := newLevelStream(gfx)
+	defer levelStream.close()
+
+	// In a fullscreen display mode, the device is lost while another window is
+	// in front of ours. Presenting then fails and we stop rendering until we
+	// can restore it.
+	deviceLost := false
+	present := func() {
+		if runtimeStats.visible {
+			// The overlay goes on top of whatever the game state drew.
+			var s overlayStats
+			s.meshes, s.meshBytes = gfx.meshMemory()
+			s.activeSounds, s.playingSounds = sound.soundCounts()
+			runtimeStats.draw(hud, s)
+			bounds := w32.GetClientRect(window)
+			check(hud.draw(float32(bounds.Right), float32(bounds.Bottom)))
+		}
+		counters.inputLatency = time.Since(inputReadTime)
+		err := gfx.endFrame()
+		if errors.Is(err, errDeviceLost) {
+			deviceLost = true
+			return
+		}
+		check(err)
+	}
+
+	// applyDisplayMode switches the device to the mode. If the device is lost,
+	// the mode is applied when we restore it.
+	applyDisplayMode := func(mode displayMode) error {
+		err := gfx.setDisplayMode(mode)
+		if errors.Is(err, errDeviceLost) {
+			deviceLost = true
+			return nil
+		}
+		if err == nil {
+			deviceLost = false
+		}
+		return err
+	}
 
-	check(device.SetRenderState(d3d9.RS_CULLMODE, uint32(d3d9.CULL_CCW)))
+	// applyLighting sets the light of the active lighting preset.
+	applyLighting := func() {
+		check(gfx.setLight(&lightingPresets[lighting]))
+	}
 
 	drawXBoxController := func(modelTransform m.Mat4) {
 		bounds := w32.GetClientRect(window)
 		aspect := float32(bounds.Right) / float32(bounds.Bottom)
-
-		check(device.SetVertexDeclaration(texturedVertex))
-		check(device.SetVertexShader(objectVertexShader))
-		check(device.SetPixelShader(objectPixelShader))
-		check(device.SetStreamSource(0, objectBuffer, 0, objectBufferStride))
+		fov := controllerFieldOfView(userSettings.FieldOfView)
 
 		colorFactor := m.Vec4{1, 1, 1, 1}
 		if gameState == gameStateXBoxController && !input.xboxController.connected {
@@ -525,9 +852,9 @@ void main(in input IN, out output OUT) {
 			xboxBlinkTimer = 0
 		}
 
-		check(device.SetPixelShaderConstantF(0, colorFactor[:]))
-		check(device.SetPixelShaderConstantF(1, lightDir[:]))
-		check(device.SetPixelShaderConstantF(2, []float32{
+		check(gfx.setColor(colorFactor))
+		applyLighting()
+		check(gfx.setMaterial(material{
 			specularStrength,
 			specularExponent,
 			0.1,
@@ -535,7 +862,7 @@ void main(in input IN, out output OUT) {
 		}))
 
 		// Draw the XBox controller.
-		check(device.SetTexture(0, xboxControllerTexture))
+		check(gfx.setTexture(xboxControllerTexture))
 		for _, o := range controller3D {
 			custom := m.Identity4()
 
@@ -571,14 +898,14 @@ void main(in input IN, out output OUT) {
 				}
 
 				// Rotate about the bottom of the stick.
-				x := (o.box.x.min + o.box.x.max) / 2
-				y := o.box.y.min + (o.box.y.max-o.box.y.min)*-0.5
-				z := (o.box.z.min + o.box.z.max) / 2
+				x := (o.box.Min[0] + o.box.Max[0]) / 2
+				y := o.box.Min[1] + (o.box.Max[1]-o.box.Min[1])*-0.5
+				z := (o.box.Min[2] + o.box.Max[2]) / 2
 
 				var dy float32
 				if o.name == "leftAxis" && input.xboxController.leftAxisDown() ||
 					o.name == "rightAxis" && input.xboxController.rightAxisDown() {
-					dy = (o.box.y.max - o.box.y.min) * -0.1
+					dy = (o.box.Max[1] - o.box.Min[1]) * -0.1
 				}
 
 				custom = m.Mul4(
@@ -596,15 +923,15 @@ void main(in input IN, out output OUT) {
 				rotationAxis := base.MulMat(rot).DropW()
 
 				// Rotate about the bottom of the stick.
-				x := (o.box.x.min + o.box.x.max) / 2
-				y := o.box.y.min + (o.box.y.max-o.box.y.min)*-0.5
-				z := (o.box.z.min + o.box.z.max) / 2
+				x := (o.box.Min[0] + o.box.Max[0]) / 2
+				y := o.box.Min[1] + (o.box.Max[1]-o.box.Min[1])*-0.5
+				z := (o.box.Min[2] + o.box.Max[2]) / 2
 
 				custom = m.Mul4(
 					m.Translate(-x, -y, -z),
 					m.RotateRightHandAbout(rotationAxis, 0.03),
 					m.Translate(x, y, z),
-					m.Translate(0, (o.box.y.max-o.box.y.min)*-0.2, 0),
+					m.Translate(0, (o.box.Max[1]-o.box.Min[1])*-0.2, 0),
 				)
 			}
 
@@ -614,10 +941,10 @@ void main(in input IN, out output OUT) {
 					value = input.xboxController.rightTrigger
 				}
 
-				zRange := o.box.z.max - o.box.z.min
-				x := (o.box.x.min + o.box.x.max) / 2
-				y := o.box.y.max
-				z := o.box.z.min
+				zRange := o.box.Max[2] - o.box.Min[2]
+				x := (o.box.Min[0] + o.box.Max[0]) / 2
+				y := o.box.Max[1]
+				z := o.box.Min[2]
 				custom = m.Mul4(
 					m.Translate(-x, -y, -z),
 					m.RotateLeftHandX(value/20),
@@ -630,41 +957,26 @@ void main(in input IN, out output OUT) {
 				modelTransform,
 			)
 
-			normalTransform := finalModelTransform
-			normalTransform[3] = 0
-			normalTransform[7] = 0
-			normalTransform[11] = 0
-			normalTransform[12] = 0
-			normalTransform[13] = 0
-			normalTransform[14] = 0
-			normalTransform[15] = 0
+			normalTransform := finalModelTransform.NormalMatrix()
 
 			mvp := m.Mul4(
 				finalModelTransform,
-				m.Perspective(m.DegToRad*80, aspect, 0.1, 1000.0),
+				m.Perspective(m.DegToRad*fov, aspect, 0.1, 1000.0),
 			)
 
-			check(device.SetVertexShaderConstantF(0, mvp[:]))
-			check(device.SetVertexShaderConstantF(4, normalTransform[:]))
+			check(gfx.setTransform(mvp, normalTransform))
 
-			vertices := vertices[o.firstVertex:o.endVertex]
-			triangleCount := uint(len(vertices) / (3 * float32sPerTexturedVertex))
-			offset := uint(o.firstVertex / float32sPerTexturedVertex)
-			check(device.DrawPrimitive(d3d9.PT_TRIANGLELIST, offset, triangleCount))
+			check(drawPart(gfx, objectMesh, o))
 		}
 	}
 
 	drawJoystick := func(modelTransform m.Mat4) {
 		bounds := w32.GetClientRect(window)
 		aspect := float32(bounds.Right) / float32(bounds.Bottom)
-
-		check(device.SetVertexDeclaration(texturedVertex))
-		check(device.SetVertexShader(objectVertexShader))
-		check(device.SetPixelShader(objectPixelShader))
-		check(device.SetStreamSource(0, objectBuffer, 0, objectBufferStride))
+		fov := controllerFieldOfView(userSettings.FieldOfView)
 
 		colorFactor := m.Vec4{1, 1, 1, 1}
-		if input.joystickDevice == nil {
+		if !input.joystickConnected {
 			joystickBlinkTimer++
 			f := float32(math.Sin(float64(joystickBlinkTimer)/10)) + 1
 			colorFactor = m.Vec4{1.2 * f, f, f, 1}
@@ -672,26 +984,26 @@ void main(in input IN, out output OUT) {
 			joystickBlinkTimer = 0
 		}
 
-		check(device.SetPixelShaderConstantF(0, colorFactor[:]))
-		check(device.SetPixelShaderConstantF(1, []float32{1, -1, 3, 1}))
-		check(device.SetPixelShaderConstantF(2, []float32{0.7, 128, 0.1, 0}))
+		check(gfx.setColor(colorFactor))
+		applyLighting()
+		check(gfx.setMaterial(material{0.7, 128, 0.1, 0}))
 
 		// Draw the joystick.
-		check(device.SetTexture(0, joystickTexture))
+		check(gfx.setTexture(joystickTexture))
 		for _, o := range joystick3D {
 			custom := m.Identity4()
 
 			if o.name == "stick" {
 				rotationAxis := m.Vec3{
-					relativeAxis(input.joystick.yAxis),
+					input.joystick.yAxis,
 					0,
-					relativeAxis(input.joystick.xAxis),
+					input.joystick.xAxis,
 				}
 
 				// Rotate about the bottom of the stick.
-				x := (o.box.x.min + o.box.x.max) / 2
-				y := o.box.y.min
-				z := (o.box.z.min + o.box.z.max) / 2
+				x := (o.box.Min[0] + o.box.Max[0]) / 2
+				y := o.box.Min[1]
+				z := (o.box.Min[2] + o.box.Max[2]) / 2
 
 				custom = m.Mul4(
 					m.Translate(-x, -y, -z),
@@ -705,27 +1017,16 @@ void main(in input IN, out output OUT) {
 				modelTransform,
 			)
 
-			normalTransform := finalModelTransform
-			normalTransform[3] = 0
-			normalTransform[7] = 0
-			normalTransform[11] = 0
-			normalTransform[12] = 0
-			normalTransform[13] = 0
-			normalTransform[14] = 0
-			normalTransform[15] = 0
+			normalTransform := finalModelTransform.NormalMatrix()
 
 			mvp := m.Mul4(
 				finalModelTransform,
-				m.Perspective(m.DegToRad*80, aspect, 0.1, 1000.0),
+				m.Perspective(m.DegToRad*fov, aspect, 0.1, 1000.0),
 			)
 
-			check(device.SetVertexShaderConstantF(0, mvp[:]))
-			check(device.SetVertexShaderConstantF(4, normalTransform[:]))
+			check(gfx.setTransform(mvp, normalTransform))
 
-			vertices := vertices[o.firstVertex:o.endVertex]
-			triangleCount := uint(len(vertices) / (3 * float32sPerTexturedVertex))
-			offset := uint(o.firstVertex / float32sPerTexturedVertex)
-			check(device.DrawPrimitive(d3d9.PT_TRIANGLELIST, offset, triangleCount))
+			check(drawPart(gfx, objectMesh, o))
 		}
 	}
 
@@ -737,566 +1038,2113 @@ void main(in input IN, out output OUT) {
 		}
 		sound.setSpeed(instructions, speed)
 
+		musicVolume += 0.03 * (targetMusicVolume - musicVolume)
+		sound.setVolume(musicIntro, musicVolume)
+		sound.setVolume(musicLoop, musicVolume)
+
+		targetIntensity := float32(1)
+		if inLevel(gameState) {
+			var speed, danger float32
+			for i := range playerCount {
+				j := &jokers[i]
+				if j.dead() {
+					continue
+				}
+				speed = max(speed, min(1, float32(math.Abs(j.speed)/maxJokerSpeed)))
+				for _, h := range currentLevel.hazards {
+					d := currentLevel.tileCenter(h.tile).Sub(j.pos).WithY(0).Norm()
+					danger = max(danger, 1-d/dangerDistance)
+				}
+			}
+			targetIntensity = playIntensity(speed, danger)
+		}
+		// The stems fade slowly, the music should not jump with every step.
+		stemIntensity += 0.01 * (targetIntensity - stemIntensity)
+		full, muffled := musicStemVolumes(stemIntensity)
+		sound.setStemVolume(musicLoop, 0, full)
+		sound.setStemVolume(musicLoop, musicMuffledStem, muffled)
+
 		check(sound.update())
 	}
 
-	render := func() {
-		if gameState == gameStateFadingIn {
-			var c uint8
-			if fadeInColor > 0 {
-				c = uint8(fadeInColor)
-			}
-			check(device.Clear(
-				nil,
-				d3d9.CLEAR_TARGET|d3d9.CLEAR_ZBUFFER,
-				d3d9.ColorRGB(c, c, c),
-				1,
-				0,
-			))
-			check(device.Present(nil, nil, 0, nil))
-			fadeInColor++
-			if fadeInColor >= backgroundGray {
-				gameState = gameStateXBoxControllerFlyingIn
+	// floorHeightAt is the level's floor height, where closed doors are as
+	// high as the walls. So are the parts of a streamed level that are not
+	// loaded yet.
+	floorHeightAt := func(x, z float32) int {
+		if levelStream.active() && !levelStream.loaded(x, z) {
+			return levelWallHeight
+		}
+		if x >= 0 && z <= 0 {
+			t := tilePos{int(x), int(-z)}
+			for i, door := range currentLevel.doors {
+				if door == t && !doorOpen[i] {
+					return levelWallHeight
+				}
 			}
-		} else if gameState == gameStateXBoxControllerFlyingIn {
-			check(device.Clear(
-				nil,
-				d3d9.CLEAR_TARGET|d3d9.CLEAR_ZBUFFER,
-				d3d9.ColorRGB(backgroundGray, backgroundGray, backgroundGray),
-				1,
-				0,
-			))
-
-			check(device.BeginScene())
-			scale := float32(controllerFlyTime * controllerFlyTime)
-			rotation := controllerFlyTime * (10 + finalControllerXRotation)
-			dz := float32((1 - controllerFlyTime) * 100)
-			modelTransform := m.Mul4(
-				m.Scale(scale, scale, scale),
-				m.RotateRightHandX(float32(rotation)),
-				m.Translate(0, 0, finalControllerZ+dz),
-			)
-			drawXBoxController(modelTransform)
-			check(device.EndScene())
-			check(device.Present(nil, nil, 0, nil))
+			for _, n := range currentLevel.npcs {
+				if n.tile == t {
+					return levelWallHeight
+				}
+			}
+		}
+		return currentLevel.floorHeightAt(x, z)
+	}
 
-			controllerFlyTime += 0.0025
-			if controllerFlyTime >= 1 {
-				controllerFlyTime = 1
-				gameState = gameStateXBoxController
+	// levelCollider holds the current level's geometry that uses mesh-accurate
+	// collision, it is nil if the level only uses its grid.
+	var levelCollider *meshCollider
+
+	jokerCollides := func(x, y, z float32) bool {
+		const collisionMargin = 0.25
+		x0 := x - collisionMargin
+		x1 := x + collisionMargin
+		z0 := z - collisionMargin
+		z1 := z + collisionMargin
+		heights := [4]float32{
+			float32(floorHeightAt(x0, z0)),
+			float32(floorHeightAt(x0, z1)),
+			float32(floorHeightAt(x1, z0)),
+			float32(floorHeightAt(x1, z1)),
+		}
+		for _, h := range heights {
+			if h > y {
+				return true
 			}
-		} else if gameState == gameStateXBoxController {
-			check(device.Clear(
-				nil,
-				d3d9.CLEAR_TARGET|d3d9.CLEAR_ZBUFFER,
-				d3d9.ColorRGB(backgroundGray, backgroundGray, backgroundGray),
-				1,
-				0,
-			))
+		}
+		return false
+	}
 
-			check(device.BeginScene())
-			modelTransform := m.Mul4(
-				m.RotateRightHandX(finalControllerXRotation),
-				m.RotateRightHandX(controllerXRotation),
-				m.RotateLeftHandY(controllerYRotation),
-				m.Translate(0, 0, finalControllerZ),
-			)
-			drawXBoxController(modelTransform)
-			check(device.EndScene())
-			check(device.Present(nil, nil, 0, nil))
+	killJoker := func(j *joker) {
+		if j.dead() {
+			return
+		}
+		j.health = 0
+		j.deadFrames = respawnTime
+		j.speed = 0
+		j.speedY = 0
+		j.flash = 0.8
+		haptics.trigger(playerOf(j), feedbackDamage)
+		stats.recordDeath()
+		s, err := sound.play("assets/blip.ogg")
+		check(err)
+		sound.setSpeed(s, 0.4)
+	}
 
-			controllerXRotation += input.xboxController.rightYAxis / 200
-			if controllerXRotation > 0.1 {
-				controllerXRotation = 0.1
-			}
-			if controllerXRotation < -0.1 {
-				controllerXRotation = -0.1
-			}
+	hurtJoker := func(j *joker, damage int) {
+		if practice || !j.hurt(damage) {
+			return
+		}
+		if j.health == 0 {
+			killJoker(j)
+			return
+		}
 
-			controllerYRotation -= float32(
-				ease.InQuint(float64(input.xboxController.rightXAxis)) / 100)
-			if controllerYRotation > 1 {
-				controllerYRotation--
+		// Knock the joker back, against the direction it is facing, and let
+		// it hop a little.
+		sin, cos := math.Sincos(float64(m.TurnsToRad * j.rot))
+		j.knockback = m.Vec3{-float32(cos), 0, -float32(sin)}.MulScalar(knockbackSpeed)
+		j.speed = 0
+		j.speedY = knockbackHop
+		j.flash = 0.6
+		haptics.trigger(playerOf(j), feedbackDamage)
+
+		s, err := sound.play("assets/step.ogg")
+		check(err)
+		sound.setSpeed(s, 0.5)
+		s, err = sound.play("assets/blip.ogg")
+		check(err)
+		sound.setSpeed(s, 0.6)
+	}
+
+	// moveJoker moves the joker horizontally by d. It does not move through
+	// grid walls at all and stops at the collision mesh. On the mesh, the
+	// joker can step up a little, its vertical update lifts it onto the mesh.
+	moveJoker := func(j *joker, d m.Vec3) {
+		var lift float32
+		if j.onMesh {
+			lift = meshStepHeight
+		}
+		if jokerCollides(j.pos[0]+d[0], j.pos[1]+lift, j.pos[2]+d[2]) {
+			return
+		}
+		if levelCollider != nil {
+			t, _ := levelCollider.sweep(j.box(meshStepHeight), d)
+			d = d.MulScalar(t)
+		}
+		j.pos = j.pos.Add(d)
+	}
+
+	// playAt plays a sound that comes from pos in the level. We listen from
+	// player 1's camera, so sounds left of the screen come from the left.
+	playAt := func(path string, pos m.Vec3) soundHandle {
+		s, err := sound.play(path)
+		check(err)
+		sound.setDirection(s, listenerAzimuth(cameras[0].pos, jokers[0].pos, pos))
+		return s
+	}
+
+	updateJoker := func(j *joker, in playerInput) {
+		player := playerOf(j)
+		targetJokerSpeed := float64(-in.yAxis) * 0.05
+
+		if j.speed < targetJokerSpeed {
+			j.speed += jokerAcceleration
+			if j.speed > targetJokerSpeed {
+				j.speed = targetJokerSpeed
 			}
-			if controllerYRotation < -1 {
-				controllerYRotation++
+		}
+
+		if j.speed > targetJokerSpeed {
+			j.speed -= jokerAcceleration
+			if j.speed < targetJokerSpeed {
+				j.speed = targetJokerSpeed
 			}
+		}
 
-			if input.xboxController.buttonADown() {
-				specularStrength -= 0.01
-				if specularStrength < 0.05 {
-					specularStrength = 0.05
+		lastLimbRot := j.limbRot
+		lastPos := j.pos
+
+		if in.yAxis == 0 {
+			if j.speed > 0 {
+				j.speed -= jokerAcceleration
+				if j.speed < 0 {
+					j.speed = 0
 				}
 			}
-			if input.xboxController.buttonBDown() {
-				specularStrength += 0.01
-				if specularStrength > 0.95 {
-					specularStrength = 0.95
+			if j.speed < 0 {
+				j.speed += jokerAcceleration
+				if j.speed > 0 {
+					j.speed = 0
 				}
 			}
-			if input.xboxController.buttonXDown() {
-				specularExponent /= 1.05
-				if specularExponent < 2 {
-					specularExponent = 2
+
+			// Limb rotations of 0.0, 0.5 and 1.0 are all OK, as they are
+			// all the standing position.
+			if j.limbRot < 0.25 {
+				// Go from (0.0, 0.25) down to 0.0.
+				j.limbRot -= maxJokerSpeed * jokerSpeedLimbRatio
+				if j.limbRot < 0 {
+					j.limbRot = 0
 				}
-			}
-			if input.xboxController.buttonYDown() {
-				specularExponent *= 1.05
-				if specularExponent > 128 {
-					specularExponent = 128
+			} else if 0.25 < j.limbRot && j.limbRot < 0.5 {
+				// Go from (0.25,  0.5) up to 0.5.
+				j.limbRot += maxJokerSpeed * jokerSpeedLimbRatio
+				if j.limbRot >= 0.5 {
+					j.limbRot = 0
 				}
+			} else if 0.5 < j.limbRot && j.limbRot < 0.75 {
+				// Go from (0.5,  0.75) down to 0.5.
+				j.limbRot -= maxJokerSpeed * jokerSpeedLimbRatio
+				if j.limbRot <= 0.5 {
+					j.limbRot = 0
+				}
+			} else if 0.75 < j.limbRot {
+				// Go from (0.75,  1.0) up to 1.0.
+				j.limbRot += maxJokerSpeed * jokerSpeedLimbRatio
+				if j.limbRot >= 1 {
+					j.limbRot = 0
+				}
+			} else {
+				j.limbRot = 0
 			}
-			if input.xboxController.buttonStartDown() {
-				specularStrength = 0.5
-				specularExponent = 16
-			}
-			if input.xboxController.buttonRBDown() {
-				lightDir = m.Vec4{1, -1, 1, 0}
-			}
-			if input.xboxController.buttonBackDown() {
-				controllerXRotation = 0
-				controllerYRotation = 0
-			}
-			if input.xboxController.dpad < 0xFFFF {
-				degress := float64(input.xboxController.dpad) / 100
-				dz, dx := math.Sincos(m.DegToRad * (90 - degress))
-				lightDir = m.Vec4{float32(-dx), -2, float32(-dz), 0}
-			}
+		}
 
-			if input.xboxController.buttons != lastButtonState {
-				lastButtonState = input.xboxController.buttons
-				pushButtonState(input.xboxController.buttons)
-				equal := func() bool {
-					for i := range desiredButtonStates {
-						if desiredButtonStates[i] != lastButtonStates[i] {
-							return false
-						}
-					}
-					return true
-				}()
-				if equal {
-					gameState = gameStateTransitionToJoystick
-					sound.stop(instructions)
+		j.rot += -in.xAxis * 0.006
+
+		if in.dash && j.dashCoolDown == 0 && j.wasOnGround {
+			j.dashFrames = dashTime
+			j.dashCoolDown = dashCoolDownTime
+			haptics.trigger(player, feedbackDash)
+			s, err := sound.play("assets/step.ogg")
+			check(err)
+			sound.setSpeed(s, 1.6)
+			s, err = sound.play("assets/blip.ogg")
+			check(err)
+			sound.setSpeed(s, 0.9)
+		}
+		if j.dashCoolDown > 0 {
+			j.dashCoolDown--
+		}
+		if j.dashFrames > 0 {
+			// Once the dash is over, the normal acceleration slows the joker
+			// down again.
+			j.dashFrames--
+			j.speed = dashSpeed
+		}
 
-					intro, err := sound.play("assets/music_intro.ogg")
-					check(err)
-					_, err = sound.queueLoopAfter(intro, "assets/music_loop.ogg")
-					check(err)
-				}
+		if in.spin && j.spinFrames == 0 {
+			j.spinFrames = spinTime
+			s, err := sound.play("assets/blip.ogg")
+			check(err)
+			sound.setSpeed(s, 1.2)
+		}
+		if j.spinFrames > 0 {
+			j.spinFrames--
+			j.rot += 1.0 / spinTime
+		}
+
+		if j.speed != 0 {
+			if in.yAxis != 0 {
+				j.limbRot += j.speed * jokerSpeedLimbRatio
 			}
-		} else if gameState == gameStateTransitionToJoystick {
-			check(device.Clear(
-				nil,
-				d3d9.CLEAR_TARGET|d3d9.CLEAR_ZBUFFER,
-				d3d9.ColorRGB(backgroundGray, backgroundGray, backgroundGray),
-				1,
-				0,
-			))
 
-			check(device.BeginScene())
+			sin, cos := math.Sincos(float64(m.TurnsToRad * j.rot))
+			dx := float32(j.speed * cos)
+			dz := float32(j.speed * sin)
 
-			xboxControllerTransform := m.Mul4(
-				m.ScaleUniform(gamepadScale),
-				m.RotateRightHandX(finalControllerXRotation),
-				m.RotateRightHandX(controllerXRotation),
-				m.RotateLeftHandY(controllerYRotation),
-				m.Translate(0, 0, finalControllerZ),
-			)
-			drawXBoxController(xboxControllerTransform)
+			moveJoker(j, m.Vec3{0, 0, dz})
+			moveJoker(j, m.Vec3{dx, 0, 0})
+		}
 
-			joystickTransform := m.Mul4(
-				m.ScaleUniform(0.5),
-				m.ScaleUniform(joystickScale),
-				m.RotateRightHandX(0.05),
-				m.RotateRightHandY(joystickYRotation),
-				m.Translate(0, -0.5, finalControllerZ),
-			)
-			drawJoystick(joystickTransform)
+		if j.knockback != (m.Vec3{}) {
+			k := j.knockback
+			moveJoker(j, m.Vec3{k[0], 0, 0})
+			moveJoker(j, m.Vec3{0, 0, k[2]})
+			j.knockback = k.MulScalar(0.85)
+			if j.knockback.Norm() < 0.001 {
+				j.knockback = m.Vec3{}
+			}
+		}
+		j.flash = max(0, j.flash-0.04)
+
+		playStep := func() {
+			if j.stepCoolDown > 0 {
+				return
+			}
+			s := playAt("assets/step.ogg", j.pos)
+			sound.setSpeed(s, 0.75+1.5*rng.Float64())
+			j.stepCoolDown = 10
+			haptics.trigger(player, feedbackStep)
+		}
+		if j.stepCoolDown > 0 {
+			j.stepCoolDown--
+		}
+
+		onGround := false
+		j.speedY += gravity
+		if levelCollider != nil {
+			// Walking up a slope pushes the joker into the mesh, lift it
+			// back on top before falling.
+			if lift, ok := levelCollider.liftOut(j.box(0), meshStepHeight); ok {
+				j.pos[1] += lift
+			}
+			t, hit := levelCollider.sweep(j.box(0), m.Vec3{0, j.speedY, 0})
+			j.pos[1] += t * j.speedY
+			j.onMesh = hit && j.speedY < 0
+			if hit {
+				j.speedY = 0
+			}
+		} else {
+			j.pos[1] += j.speedY
+		}
+		if jokerCollides(j.pos[0], j.pos[1], j.pos[2]) {
+			onGround = true
+			j.onMesh = false
+			j.pos[1] = float32(int(j.pos[1]))
+
+			if jokerCollides(j.pos[0], j.pos[1], j.pos[2]) {
+				j.pos[1] = float32(int(j.pos[1]) + 1)
+			}
+		}
+		if j.onMesh {
+			onGround = true
+		}
+		if onGround {
+			j.speedY = 0
+			if in.jump {
+				j.speedY = jokerJumpSpeed
+				savedGame.Stats.Jumps++
+				s, err := sound.play("assets/blip.ogg")
+				check(err)
+				sound.setSpeed(s, 1+0.5*rng.Float64())
+			}
+		}
+
+		if onGround && !j.wasOnGround {
+			playStep()
+			haptics.trigger(player, feedbackLand)
+		}
+		j.wasOnGround = onGround
+
+		if j.hurtCoolDown > 0 {
+			j.hurtCoolDown--
+		}
+		if onGround {
+			if fall := j.fallStartY - j.pos[1]; fall > safeFallHeight {
+				hurtJoker(j, 1+int(fall-safeFallHeight))
+			}
+			j.fallStartY = j.pos[1]
+
+			switch currentLevel.hazardAt(j.pos[0], j.pos[2]) {
+			case hazardSpikes:
+				hurtJoker(j, 1)
+			case hazardLava:
+				if !practice {
+					killJoker(j)
+				}
+			}
+		} else {
+			j.fallStartY = max(j.fallStartY, j.pos[1])
+		}
+		if j.pos[1] < fallDeathHeight {
+			killJoker(j)
+		}
+
+		j.limbRot = norm01(j.limbRot)
+
+		if onGround &&
+			(lastLimbRot < 0.25 && j.limbRot >= 0.25 ||
+				lastLimbRot < 0.75 && j.limbRot >= 0.75) {
+			playStep()
+			savedGame.Stats.Steps++
+		}
+
+		if onGround {
+			walked := j.pos.Sub(lastPos).WithY(0)
+			savedGame.Stats.DistanceWalked += float64(walked.Norm())
+		}
+	}
+
+	updateCamera := func(c *followCamera, j *joker, in playerInput) {
+		if in.toggleCamera {
+			c.inCorner = !c.inCorner
+		}
+
+		var targetCameraPos m.Vec3
+
+		var rail *cameraRail
+		for i := range currentLevel.cameraRails {
+			if currentLevel.cameraRails[i].area.Intersects(j.box(0)) {
+				rail = &currentLevel.cameraRails[i]
+				break
+			}
+		}
+
+		if rail != nil && !(practice && c.inCorner) {
+			targetCameraPos = rail.closestTo(j.pos)
+		} else if c.inCorner {
+			corners := currentLevel.cameraCorners()
+			cornerIndex := int(in.dpad) / 4500
+			if cornerIndex < len(corners) {
+				c.targetCorner = corners[cornerIndex]
+			}
+			targetCameraPos = c.targetCorner
+		} else {
+			dirZ, dirX := math.Sincos(float64(m.TurnsToRad * j.rot))
+			maxCamX := float32(currentLevel.width() - 1)
+			minCamZ := -float32(currentLevel.height() - 1)
+			targetCameraPos = m.Vec3{
+				max(1, min(maxCamX, j.pos[0]-5*float32(dirX))),
+				4,
+				min(-1, max(minCamZ, j.pos[2]-5*float32(dirZ))),
+			}
+		}
+
+		c.pos = c.pos.Lerp(
+			targetCameraPos,
+			m.DampFactor(cameraFollowRate, float32(frameTime.Seconds())),
+		)
+	}
+
+	xboxInput := func(c, last *xboxControllerState) playerInput {
+		return playerInput{
+			xAxis:        relativeAxis(c.leftXAxis),
+			yAxis:        relativeAxis(c.leftYAxis),
+			jump:         !last.buttonADown() && c.buttonADown(),
+			toggleCamera: !last.buttonYDown() && c.buttonYDown(),
+			useItem:      !last.buttonXDown() && c.buttonXDown(),
+			interact:     !last.buttonBDown() && c.buttonBDown(),
+			dpad:         c.dpad,
+		}
+	}
+
+	joystickInput := func(j, last *joystickState) playerInput {
+		return playerInput{
+			xAxis:        j.xAxis,
+			yAxis:        j.yAxis,
+			jump:         !last.buttonDown[0] && j.buttonDown[0],
+			toggleCamera: !last.buttonDown[1] && j.buttonDown[1],
+			useItem:      !last.buttonDown[2] && j.buttonDown[2],
+			interact:     !last.buttonDown[3] && j.buttonDown[3],
+			dpad:         j.dpad,
+		}
+	}
+
+	// keyboardInput moves with WASD or the arrow keys, jumps with Space, C
+	// toggles the camera, E uses an item and F interacts. The keyboard has no
+	// D-pad.
+	keyboardInput := func(k, last *di8.KEYBOARDSTATE) playerInput {
+		pressed := func(key byte) bool {
+			return !last.IsDown(key) && k.IsDown(key)
+		}
+		axis := func(negative, negative2, positive, positive2 byte) float32 {
+			var a float32
+			if k.IsDown(negative) || k.IsDown(negative2) {
+				a--
+			}
+			if k.IsDown(positive) || k.IsDown(positive2) {
+				a++
+			}
+			return a
+		}
+		return playerInput{
+			xAxis:        axis(di8.K_A, di8.K_LEFT, di8.K_D, di8.K_RIGHT),
+			yAxis:        axis(di8.K_W, di8.K_UP, di8.K_S, di8.K_DOWN),
+			jump:         pressed(di8.K_SPACE),
+			toggleCamera: pressed(di8.K_C),
+			useItem:      pressed(di8.K_E),
+			interact:     pressed(di8.K_F),
+			dpad:         0xFFFF,
+		}
+	}
+
+	// combineInputs lets a single player use two devices, e.g. the joystick
+	// and the XBox controller, at the same time.
+	combineInputs := func(a, b playerInput) playerInput {
+		in := a
+		if abs(b.yAxis) > abs(a.yAxis) {
+			in.yAxis = b.yAxis
+		}
+		if abs(b.xAxis) > abs(a.xAxis) {
+			in.xAxis = b.xAxis
+		}
+		in.jump = a.jump || b.jump
+		in.toggleCamera = a.toggleCamera || b.toggleCamera
+		in.useItem = a.useItem || b.useItem
+		in.interact = a.interact || b.interact
+		if a.dpad/4500 >= 8 {
+			in.dpad = b.dpad
+		}
+		return in
+	}
+
+	collectiblePos := func(i int) m.Vec3 {
+		return collectiblePos(currentLevel, i, collectibleSpin)
+	}
+
+	// The joker's arms and legs swing about these reference points.
+	jointOf := func(name string) m.Vec3 {
+		v := jokerModel.Vertices[jokerModel.FindObject(name).StartVertex]
+		return m.Vec3{v[0], v[1], v[2]}
+	}
+	scene := levelScene{
+		jokerArmJoint: jointOf("refArmJoint"),
+		jokerLegJoint: jointOf("refLegJoint"),
+	}
+	drawScene := func(view m.Mat4, aspect float32) {
+		scene.mesh = objectMesh
+		scene.randomLevelMesh = randomLevelMesh
+		scene.randomLevelVertexCount = randomLevelVertexCount
+		scene.stream = levelStream
+		scene.levelTexture = levelTexture
+		scene.whiteTexture = whiteTexture
+		scene.jokerTexture = jokerTexture
+		scene.levelModel = levelModel
+		scene.gem = gem3D
+		scene.box = box3D
+		scene.tile = tile3D
+		scene.joker = joker3D
+		scene.props = propModels
+		scene.level = currentLevel
+		scene.collected = collected
+		scene.pickedUp = pickedUp
+		scene.doorOpen = doorOpen
+		scene.teleportUsed = teleportUsed
+		scene.jokers = jokers[:playerCount]
+		scene.showRemote = false
+		if network != nil && network.connected() {
+			scene.remote, _ = network.remotePlayer()
+			scene.showRemote = scene.remote.playing &&
+				int(scene.remote.level) == levelIndex
+		}
+		scene.brightness = levelColor
+		scene.spin = collectibleSpin
+		scene.light = &lightingPresets[lighting]
+		scene.fieldOfView = levelFieldOfView(userSettings.FieldOfView)
+		check(drawLevel(gfx, &scene, view, aspect))
+	}
+
+	// levelCombos are cheats for player 1's XBox controller while playing.
+	levelCombos := newComboDetector()
+	// Clicking the left, right, left and right stick restores all health. The
+	// sticks' buttons do nothing else in a level, unlike the D-pad which picks
+	// the camera corner and the lighting.
+	levelCombos.register(
+		[]uint16{
+			w32.XINPUT_GAMEPAD_LEFT_THUMB, 0,
+			w32.XINPUT_GAMEPAD_RIGHT_THUMB, 0,
+			w32.XINPUT_GAMEPAD_LEFT_THUMB, 0,
+			w32.XINPUT_GAMEPAD_RIGHT_THUMB, 0,
+		},
+		time.Second/2,
+		func() {
+			for i := range playerCount {
+				if !jokers[i].dead() {
+					jokers[i].health = maxJokerHealth
+				}
+			}
+			haptics.trigger(0, feedbackCombo)
+			s, err := sound.play("assets/blip.ogg")
+			check(err)
+			sound.setSpeed(s, 3)
+		},
+	)
+
+	var playerGestures [2]gestureDetector
+
+	// updatePlayers moves the players, collects collectibles and checks if
+	// the level is complete.
+	fireTrigger := func(e triggerEvent, pos m.Vec3) {
+		if e.sound != "" {
+			playAt(e.sound, pos)
+		}
+		if e.music != musicUnchanged {
+			targetMusicVolume = musicVolumes[e.music]
+		}
+		if e.tutorial != "" {
+			tutorialText = e.tutorial
+			tutorialTimeLeft = tutorialDuration
+		}
+		if e.cutscene != nil {
+			activeCutscene = e.cutscene
+			cutsceneTime = 0
+			var ok bool
+			cutsceneCurve, ok = ease.ByName(e.cutscene.ease)
+			if !ok {
+				cutsceneCurve = ease.InOutCubic
+			}
+			gameState = gameStateCutscene
+		}
+	}
+
+	updatePlayers := func() {
+		// Player 2 joins by pressing Start on the second XBox controller.
+		// If there is only one XBox controller, player 1 can press Back
+		// to let player 2 join with the joystick.
+		secondStartPressed := !lastSecondXBoxState.buttonStartDown() &&
+			input.secondXBoxController.buttonStartDown()
+		backPressed := !lastXBoxState.buttonBackDown() &&
+			input.xboxController.buttonBackDown()
+		if secondStartPressed ||
+			backPressed && input.joystickConnected &&
+				!input.secondXBoxController.connected {
+			if playerCount == 1 {
+				playerCount = 2
+				jokers[1] = newJoker(currentLevel.jokerStart, currentLevel.jokerStartRot)
+				cameras[1] = newFollowCamera(currentLevel)
+				combinedCameraPos = cameras[0].pos
+			} else {
+				playerCount = 1
+			}
+		}
+
+		if !lastXBoxState.buttonLBDown() && input.xboxController.buttonLBDown() {
+			combinedCamera = !combinedCamera
+		}
+
+		levelCombos.update(input.xboxController.buttons, time.Now())
+
+		var inputs [2]playerInput
+		if playerCount == 1 {
+			inputs[0] = combineInputs(
+				combineInputs(
+					joystickInput(&input.joystick, &lastJoystickState),
+					xboxInput(&input.xboxController, &lastXBoxState),
+				),
+				keyboardInput(&input.keyboard, &lastKeyboardState),
+			)
+		} else {
+			inputs[0] = xboxInput(&input.xboxController, &lastXBoxState)
+			if input.secondXBoxController.connected {
+				inputs[1] = xboxInput(
+					&input.secondXBoxController,
+					&lastSecondXBoxState,
+				)
+			} else {
+				inputs[1] = joystickInput(&input.joystick, &lastJoystickState)
+			}
+		}
+
+		// The D-pad picks the corner for the corner camera, with the follow
+		// camera it picks the lighting. On the keyboard, 1 to 4 do that.
+		newLighting := lighting
+		for i := range playerCount {
+			if preset, ok := lightingPresetFromDPad(inputs[i].dpad); ok && !cameras[i].inCorner {
+				newLighting = preset
+			}
+		}
+		for i, key := range [lightingPresetCount]byte{di8.K_1, di8.K_2, di8.K_3, di8.K_4} {
+			if input.keyboard.IsDown(key) && !lastKeyboardState.IsDown(key) {
+				newLighting = i
+			}
+		}
+		if newLighting != lighting {
+			lighting = newLighting
+			tutorialText = lightingPresets[lighting].name
+			tutorialTimeLeft = tutorialDuration
+		}
+
+		lastJoystickState = input.joystick
+		lastKeyboardState = input.keyboard
+		lastXBoxState = input.xboxController
+		lastSecondXBoxState = input.secondXBoxController
+
+		// Gestures are made with the stick only, the D-pad moves the camera
+		// in the level.
+		for i := range playerCount {
+			g := playerGestures[i].update(
+				pointingTo(inputs[i].xAxis, inputs[i].yAxis, 0xFFFF),
+				time.Now(),
+			)
+			inputs[i].dash = g.doubleTapForward
+			inputs[i].spin = g.quarterCircle
+		}
+
+		for i := range playerCount {
+			if jokers[i].dead() {
+				jokers[i].deadFrames--
+				jokers[i].flash = max(0, jokers[i].flash-0.04)
+				if !jokers[i].dead() {
+					jokers[i] = newJoker(currentLevel.jokerStart, currentLevel.jokerStartRot)
+				}
+			} else {
+				updateJoker(&jokers[i], inputs[i])
+			}
+			updateCamera(&cameras[i], &jokers[i], inputs[i])
+		}
+
+		for i, t := range currentLevel.triggers {
+			for j := range playerCount {
+				inside := !jokers[j].dead() && t.box.Intersects(jokers[j].box(0))
+				stay := insideTrigger[i][j]
+				if inside && stay == outsideTrigger {
+					if t.once && triggerFired[i] {
+						insideTrigger[i][j] = insideSilently
+					} else {
+						triggerFired[i] = true
+						insideTrigger[i][j] = insideFired
+						fireTrigger(t.enter, t.box.Center())
+					}
+				} else if !inside && stay != outsideTrigger {
+					if stay == insideFired {
+						fireTrigger(t.exit, t.box.Center())
+					}
+					insideTrigger[i][j] = outsideTrigger
+				}
+			}
+		}
+		tutorialTimeLeft = max(0, tutorialTimeLeft-frameTime)
+
+		if playerCount == 2 {
+			// The combined camera backs off as the players move apart.
+			center := jokers[0].pos.Add(jokers[1].pos).MulScalar(0.5)
+			dist := jokers[0].pos.Sub(jokers[1].pos).Norm()
+			target := m.Vec3{
+				center[0],
+				3 + 0.5*dist,
+				min(-1, center[2]+2+0.5*dist),
+			}
+			combinedCameraPos = combinedCameraPos.Lerp(
+				target,
+				m.DampFactor(cameraFollowRate, float32(frameTime.Seconds())),
+			)
+		}
+
+		collectibleSpin += 0.01
+		for i := range collected {
+			if collected[i] {
+				continue
+			}
+			p := collectiblePos(i)
+			for j := range playerCount {
+				if jokers[j].dead() {
+					continue
+				}
+				// The joker's position is at its feet, we check against
+				// its center.
+				center := jokers[j].pos.Add(m.Vec3{0, 0.5, 0})
+				if center.Sub(p).Norm() < 0.6 {
+					collected[i] = true
+					s := playAt("assets/blip.ogg", p)
+					sound.setSpeed(s, 2)
+					break
+				}
+			}
+		}
+
+		for i, item := range currentLevel.items {
+			if pickedUp[i] {
+				continue
+			}
+			p := currentLevel.tileCenter(item.tile)
+			for j := range playerCount {
+				if jokers[j].dead() {
+					continue
+				}
+				d := jokers[j].pos.Sub(p).Abs()
+				if d[0] < 0.5 && d[2] < 0.5 && d[1] < 1 {
+					pickedUp[i] = true
+					savedGame.Inventory.pickUp(item.kind)
+					saveProgress()
+					s, err := sound.play("assets/blip.ogg")
+					check(err)
+					sound.setSpeed(s, 1.5)
+					break
+				}
+			}
+		}
+
+		for i := range playerCount {
+			j := &jokers[i]
+			if inputs[i].useItem && !j.dead() && j.health < maxJokerHealth &&
+				savedGame.Inventory.consume(itemHeart) {
+				j.health++
+				saveProgress()
+				s, err := sound.play("assets/blip.ogg")
+				check(err)
+				sound.setSpeed(s, 2.5)
+			}
+		}
+
+		// A player opens a locked door by walking into it with a key.
+		if lockedDoorHint > 0 {
+			lockedDoorHint--
+		}
+		for i, door := range currentLevel.doors {
+			if doorOpen[i] {
+				continue
+			}
+			p := currentLevel.tileCenter(door)
+			for j := range playerCount {
+				if jokers[j].dead() {
+					continue
+				}
+				d := jokers[j].pos.Sub(p).Abs()
+				if d[0] > 0.8 || d[2] > 0.8 || d[0] > 0.5 && d[2] > 0.5 {
+					continue
+				}
+				if savedGame.Inventory.consume(itemKey) {
+					doorOpen[i] = true
+					saveProgress()
+					s, err := sound.play("assets/blip.ogg")
+					check(err)
+					sound.setSpeed(s, 0.8)
+				} else {
+					lockedDoorHint = 60
+				}
+				break
+			}
+		}
+
+		// Players talk to an NPC when standing right next to it.
+		nearNPC = -1
+		for i, n := range currentLevel.npcs {
+			p := currentLevel.tileCenter(n.tile)
+			for j := range playerCount {
+				if jokers[j].dead() {
+					continue
+				}
+				d := jokers[j].pos.Sub(p).Abs()
+				if d[0] < 1.3 && d[2] < 1.3 && d[1] < 1 {
+					nearNPC = i
+					if inputs[j].interact {
+						openDialogue = newDialogueBox(dialogues[n.dialogue])
+						gameState = gameStateDialogue
+					}
+				}
+			}
+		}
+
+		levelTime += frameTime
+
+		// Bonus levels have no exit, the challenge ends when all collectibles
+		// are found or the time is up.
+		exit := currentLevel.tileCenter(currentLevel.exit)
+		for i := range playerCount {
+			if jokers[i].dead() || currentLevel.timeLimit > 0 {
+				continue
+			}
+			d := jokers[i].pos.Sub(exit).Abs()
+			if d[0] < 0.5 && d[2] < 0.5 && d[1] < 0.5 {
+				gameState = gameStateLevelComplete
+				levelCompleteFrames = 0
+				resultsLines = nil
+				stats.recordCompletion()
+				saveProgress()
+			}
+		}
+	}
+
+	// enterLevel resets the players and the level state for the given level
+	// and its model, which is nil for a random level.
+	enterLevel := func(l *level, lm model) {
+		currentLevel = l
+		levelModel = lm
+		for i := range jokers {
+			jokers[i] = newJoker(currentLevel.jokerStart, currentLevel.jokerStartRot)
+			cameras[i] = newFollowCamera(currentLevel)
+		}
+		combinedCameraPos = cameras[0].pos
+		collected = make([]bool, len(currentLevel.collectibles))
+		pickedUp = make([]bool, len(currentLevel.items))
+		doorOpen = make([]bool, len(currentLevel.doors))
+		insideTrigger = make([][2]triggerStay, len(currentLevel.triggers))
+		triggerFired = make([]bool, len(currentLevel.triggers))
+		tutorialTimeLeft = 0
+		targetMusicVolume = musicVolumes[musicNormal]
+
+		levelCollider = nil
+		var collider meshCollider
+		for _, o := range levelModel {
+			if slices.Contains(currentLevel.collisionParts, o.name) {
+				collider.addPart(
+					vertices[o.firstVertex:o.endVertex],
+					float32sPerTexturedVertex,
+					m.Identity4(),
+				)
+			}
+		}
+		for _, p := range currentLevel.props {
+			if !p.solid {
+				continue
+			}
+			for _, o := range propModels[p.model] {
+				collider.addPart(
+					vertices[o.firstVertex:o.endVertex],
+					float32sPerTexturedVertex,
+					p.transform(currentLevel),
+				)
+			}
+		}
+		if len(collider.parts) > 0 {
+			levelCollider = &collider
+		}
+
+		levelTime = 0
+		levelColor = 30
+	}
+
+	// startLevel starts the given level from the beginning. index is the
+	// level's index in levels or len(levels) for a random level.
+	startLevel := func(index int, l *level) {
+		levelIndex = index
+		var lm model
+		if index < len(levels) {
+			lm = levelModels[index]
+		}
+		bonusReturn = nil
+		teleportUsed = make([]bool, len(l.teleports))
+		levelStream.stop()
+		enterLevel(l, lm)
+	}
+
+	enterBonusLevel := func(t teleport) {
+		bonusReturn = &suspendedLevel{
+			level:         currentLevel,
+			model:         levelModel,
+			collider:      levelCollider,
+			collected:     collected,
+			pickedUp:      pickedUp,
+			doorOpen:      doorOpen,
+			insideTrigger: insideTrigger,
+			triggerFired:  triggerFired,
+			levelTime:     levelTime,
+			jokers:        jokers,
+			cameras:       cameras,
+			teleport:      t.tile,
+		}
+		enterLevel(&bonusLevels[t.bonus], bonusModels[t.bonus])
+		tutorialText = fmt.Sprintf(
+			"Collect all gems in %d seconds",
+			int(currentLevel.timeLimit.Seconds()),
+		)
+		tutorialTimeLeft = tutorialDuration
+	}
+
+	// leaveBonusLevel takes the jokers back to the teleport that they came
+	// through. Winning the challenge gives them a heart.
+	leaveBonusLevel := func(won bool) {
+		b := bonusReturn
+		bonusReturn = nil
+
+		currentLevel = b.level
+		levelModel = b.model
+		levelCollider = b.collider
+		collected = b.collected
+		pickedUp = b.pickedUp
+		doorOpen = b.doorOpen
+		insideTrigger = b.insideTrigger
+		triggerFired = b.triggerFired
+		// The time in the bonus level counts for the level, too.
+		levelTime += b.levelTime
+		cameras = b.cameras
+		combinedCameraPos = cameras[0].pos
+		for i := range jokers {
+			health := jokers[i].health
+			jokers[i] = newJoker(currentLevel.tileCenter(b.teleport), b.jokers[i].rot)
+			jokers[i].health = health
+		}
+		targetMusicVolume = musicVolumes[musicNormal]
+		levelColor = 30
+
+		if won {
+			savedGame.Inventory.pickUp(itemHeart)
+			saveProgress()
+			tutorialText = "Challenge complete, you won a heart!"
+		} else {
+			tutorialText = "Time is up!"
+		}
+		tutorialTimeLeft = tutorialDuration
+	}
+
+	// updateTeleports sends the jokers to a bonus level when one of them
+	// steps on a teleport and brings them back when the challenge is over.
+	updateTeleports := func() {
+		if bonusReturn != nil {
+			if !slices.Contains(collected, false) {
+				leaveBonusLevel(true)
+			} else if !practice && levelTime >= currentLevel.timeLimit {
+				leaveBonusLevel(false)
+			}
+			return
+		}
+
+		for i, t := range currentLevel.teleports {
+			if teleportUsed[i] {
+				continue
+			}
+			p := currentLevel.tileCenter(t.tile)
+			for j := range playerCount {
+				d := jokers[j].pos.Sub(p).Abs()
+				if !jokers[j].dead() && d[0] < 0.4 && d[2] < 0.4 && d[1] < 0.5 {
+					teleportUsed[i] = true
+					s, err := sound.play("assets/blip.ogg")
+					check(err)
+					sound.setSpeed(s, 0.7)
+					enterBonusLevel(t)
+					return
+				}
+			}
+		}
+	}
+
+	loadLevel := func(index int) {
+		startLevel(index, &levels[index])
+	}
+
+	loadRandomLevel := func(seed int64) {
+		params := defaultLevelParams()
+		params.width, params.height = *randomLevelSize, *randomLevelSize
+		randomLevel = generateLevel(seed, params)
+
+		gfx.releaseMesh(randomLevelMesh)
+		randomLevelMesh = invalidMesh
+		if isStreamedLevel(&randomLevel) {
+			startLevel(len(levels), &randomLevel)
+			check(levelStream.start(&randomLevel))
+			return
+		}
+
+		generated := randomLevel.meshVertices()
+		randomLevelVertexCount = len(generated) / float32sPerTexturedVertex
+		randomLevelMesh, err = gfx.createMesh(
+			generated,
+			appendWhiteVertices(nil, randomLevelVertexCount),
+		)
+		check(err)
+
+		startLevel(len(levels), &randomLevel)
+	}
+
+	updateDialogue := func() {
+		in := xboxMenuInput(&input.xboxController, &lastXBoxState).
+			or(xboxMenuInput(&input.secondXBoxController, &lastSecondXBoxState)).
+			or(joystickMenuInput(&input.joystick, &lastJoystickState)).
+			or(keyboardMenuInput(&input.keyboard, &lastKeyboardState))
+		if !openDialogue.update(in) {
+			openDialogue = nil
+			gameState = gameStatePlayingLevel
+		} else if in.up || in.down || in.confirm {
+			s, err := sound.play("assets/blip.ogg")
+			check(err)
+			sound.setSpeed(s, 1.8)
+		}
+
+		lastJoystickState = input.joystick
+		lastKeyboardState = input.keyboard
+		lastXBoxState = input.xboxController
+		lastSecondXBoxState = input.secondXBoxController
+	}
+
+	// updateCutscene plays the active cutscene until it is over or a player
+	// skips it.
+	updateCutscene := func() {
+		in := xboxMenuInput(&input.xboxController, &lastXBoxState).
+			or(xboxMenuInput(&input.secondXBoxController, &lastSecondXBoxState)).
+			or(joystickMenuInput(&input.joystick, &lastJoystickState)).
+			or(keyboardMenuInput(&input.keyboard, &lastKeyboardState))
+		cutsceneTime += frameTime
+		if in.confirm || in.back {
+			// Skipping still flies the camera back to the players.
+			cutsceneTime = max(cutsceneTime, activeCutscene.duration-cutsceneBlend)
+		}
+		if cutsceneTime >= activeCutscene.duration {
+			activeCutscene = nil
+			gameState = gameStatePlayingLevel
+		}
+
+		lastJoystickState = input.joystick
+		lastKeyboardState = input.keyboard
+		lastXBoxState = input.xboxController
+		lastSecondXBoxState = input.secondXBoxController
+	}
+
+	// updateLevelComplete lets the jokers celebrate, then waits for a player
+	// to continue to the next level.
+	updateLevelComplete := func() {
+		levelCompleteFrames++
+
+		if levelCompleteFrames <= celebrationFrames {
+			// Jump and spin, and play a rising fanfare of blips.
+			for i := range playerCount {
+				j := &jokers[i]
+				j.rot += 0.02
+				j.limbRot = norm01(j.limbRot + 0.03)
+				floor := float32(currentLevel.floorHeightAt(j.pos[0], j.pos[2]))
+				hop := float64(levelCompleteFrames) / 30
+				j.pos[1] = floor + 0.5*float32(abs(float32(math.Sin(math.Pi*hop))))
+			}
+			if levelCompleteFrames <= 40 && levelCompleteFrames%10 == 0 {
+				s, err := sound.play("assets/blip.ogg")
+				check(err)
+				sound.setSpeed(s, 1+float64(levelCompleteFrames)/40)
+			}
+		} else {
+			in := xboxMenuInput(&input.xboxController, &lastXBoxState).
+				or(xboxMenuInput(&input.secondXBoxController, &lastSecondXBoxState)).
+				or(joystickMenuInput(&input.joystick, &lastJoystickState)).
+				or(keyboardMenuInput(&input.keyboard, &lastKeyboardState))
+			if !lastXBoxState.buttonStartDown() && input.xboxController.buttonStartDown() {
+				in.confirm = true
+			}
+			if in.up || in.down {
+				if in.up {
+					resultsChoice = (resultsChoice + 2) % 3
+				} else {
+					resultsChoice = (resultsChoice + 1) % 3
+				}
+				s, err := sound.play("assets/blip.ogg")
+				check(err)
+				sound.setSpeed(s, 1.8)
+			}
+			if in.confirm {
+				if resultsChoice == 0 && levelIndex == len(levels)-1 {
+					startCredits(true)
+				} else if resultsChoice == 0 {
+					// After a random level, we go back to the first one.
+					loadLevel((levelIndex + 1) % (len(levels) + 1) % len(levels))
+					gameState = gameStatePlayingLevel
+				} else if resultsChoice == 1 {
+					loadRandomLevel(rng.Int64N(1000000))
+					gameState = gameStatePlayingLevel
+				} else {
+					gameState = gameStateStatistics
+					statisticsLines = nil
+				}
+			}
+		}
+
+		lastJoystickState = input.joystick
+		lastKeyboardState = input.keyboard
+		lastXBoxState = input.xboxController
+		lastSecondXBoxState = input.secondXBoxController
+	}
+
+	// updatePaused continues the game when a player presses A or Start.
+	updatePaused := func() {
+		in := xboxMenuInput(&input.xboxController, &lastXBoxState).
+			or(xboxMenuInput(&input.secondXBoxController, &lastSecondXBoxState)).
+			or(joystickMenuInput(&input.joystick, &lastJoystickState)).
+			or(keyboardMenuInput(&input.keyboard, &lastKeyboardState))
+		if !lastXBoxState.buttonStartDown() && input.xboxController.buttonStartDown() {
+			in.confirm = true
+		}
+		if in.confirm {
+			gameState = gameStatePlayingLevel
+		}
+
+		lastJoystickState = input.joystick
+		lastKeyboardState = input.keyboard
+		lastXBoxState = input.xboxController
+		lastSecondXBoxState = input.secondXBoxController
+	}
+
+	// updateStatistics goes back to the results screen.
+	updateStatistics := func() {
+		in := xboxMenuInput(&input.xboxController, &lastXBoxState).
+			or(xboxMenuInput(&input.secondXBoxController, &lastSecondXBoxState)).
+			or(joystickMenuInput(&input.joystick, &lastJoystickState)).
+			or(keyboardMenuInput(&input.keyboard, &lastKeyboardState))
+		if in.confirm || in.back {
+			gameState = gameStateLevelComplete
+		}
+
+		lastJoystickState = input.joystick
+		lastKeyboardState = input.keyboard
+		lastXBoxState = input.xboxController
+		lastSecondXBoxState = input.secondXBoxController
+	}
+
+	const (
+		titleStart = iota
+		titlePractice
+		titleOptions
+		titleLevelSelect
+		titleCredits
+		titleQuit
+	)
+	titleMenuLines := []string{
+		titleStart:       "Start",
+		titlePractice:    "Practice",
+		titleOptions:     "Options",
+		titleLevelSelect: "Level Select",
+		titleCredits:     "Credits",
+		titleQuit:        "Quit",
+	}
+	onOff := func(on bool) string {
+		if on {
+			return "On"
+		}
+		return "Off"
+	}
+	// Volumes change in steps of 10% and are drawn as a bar with one segment
+	// per step.
+	const volumeSteps = 10
+	volumeSlider := func(volume float64) string {
+		n := max(0, min(volumeSteps, int(math.Round(volume*volumeSteps))))
+		return "[" + strings.Repeat("=", n) + strings.Repeat("-", volumeSteps-n) + "]"
+	}
+	// changeVolume moves the volume one step up or down.
+	changeVolume := func(volume *float64, in menuInput) {
+		n := math.Round(*volume * volumeSteps)
+		if in.left {
+			n--
+		}
+		if in.right {
+			n++
+		}
+		*volume = max(0, min(volumeSteps, n)) / volumeSteps
+	}
+	const (
+		optionRunInBackground = iota
+		optionMasterVolume
+		optionMusicVolume
+		optionEffectsVolume
+		optionDisplayMode
+		optionFieldOfView
+		optionPlayer1Controller
+		optionControllerTest
+	)
+	// pickedDisplayMode is the display mode selected in the options. Switching
+	// modes takes a moment, so we only apply it when the player confirms.
+	pickedDisplayMode := displayModeIndex
+	// The options lines only change when an option does, so we do not build
+	// strings every frame.
+	var optionsLines []string
+	updateOptionsLines := func() {
+		optionsLines = append(optionsLines[:0],
+			"Run in background: "+onOff(userSettings.RunInBackground),
+			"Master volume "+volumeSlider(userSettings.MasterVolume),
+			"Music volume "+volumeSlider(userSettings.MusicVolume),
+			"Effects volume "+volumeSlider(userSettings.EffectsVolume),
+			"Display: "+displayModes[pickedDisplayMode].String(),
+			"Field of view: "+strconv.Itoa(int(levelFieldOfView(userSettings.FieldOfView)))+" degrees",
+			"Player 1 controller",
+			"Controller test",
+			"Back",
+		)
+		if pickedDisplayMode != displayModeIndex {
+			optionsLines[optionDisplayMode] += " {confirm}"
+		}
+	}
+
+	// setDisplayMode switches to the display mode. If the driver refuses the
+	// mode, we go back to the old one.
+	setDisplayMode := func(index int) {
+		if err := applyDisplayMode(displayModes[index]); err != nil {
+			check(applyDisplayMode(displayModes[displayModeIndex]))
+			return
+		}
+		displayModeIndex = index
+		userSettings.DisplayMode = displayModes[index]
+		if displayModes[index].isDesktop() && coveringMonitor {
+			// Leaving fullscreen restores the monitor's resolution, our
+			// window has to cover it again.
+			if monitor, ok := monitorOf(window); ok {
+				coverMonitor(window, monitor)
+			}
+		}
+	}
+	updateOptionsLines()
+	var levelSelectLines []string
+	for _, l := range levels {
+		levelSelectLines = append(levelSelectLines, l.name)
+	}
+	levelSelectLines = append(levelSelectLines, "Back")
+
+	// readMenuInput returns the menu input of all controllers.
+	readMenuInput := func() menuInput {
+		in := xboxMenuInput(&input.xboxController, &lastXBoxState).
+			or(xboxMenuInput(&input.secondXBoxController, &lastSecondXBoxState)).
+			or(joystickMenuInput(&input.joystick, &lastJoystickState)).
+			or(keyboardMenuInput(&input.keyboard, &lastKeyboardState))
+		if !lastXBoxState.buttonStartDown() && input.xboxController.buttonStartDown() {
+			in.confirm = true
+		}
+
+		lastJoystickState = input.joystick
+		lastKeyboardState = input.keyboard
+		lastXBoxState = input.xboxController
+		lastSecondXBoxState = input.secondXBoxController
+		return in
+	}
+
+	// readMenu is readMenuInput that also moves the selection through count
+	// lines.
+	readMenu := func(count int) menuInput {
+		in := readMenuInput()
+		if in.up || in.down {
+			if in.up {
+				menuChoice = (menuChoice + count - 1) % count
+			} else {
+				menuChoice = (menuChoice + 1) % count
+			}
+			s, err := sound.play("assets/blip.ogg")
+			check(err)
+			sound.setSpeed(s, 1.8)
+		}
+		return in
+	}
+
+	// updateTitle runs the main menu. Start plays the controller intro, which
+	// leads into the first level.
+	updateTitle := func() {
+		in := readMenu(len(titleMenuLines))
+		if !in.confirm {
+			return
+		}
+		switch menuChoice {
+		case titleStart:
+			practice = false
+			gameState = gameStateFadingIn
+			animations.Add(fadeIn)
+		case titlePractice:
+			// Practice also starts from the level select screen.
+			practice = true
+			gameState = gameStateLevelSelect
+			menuChoice = 0
+		case titleOptions:
+			gameState = gameStateOptions
+			menuChoice = 0
+		case titleLevelSelect:
+			practice = false
+			gameState = gameStateLevelSelect
+			menuChoice = 0
+		case titleCredits:
+			startCredits(false)
+		case titleQuit:
+			w32.PostQuitMessage(0)
+		}
+	}
+
+	// updateCredits scrolls the credits. The stick or the arrow keys change
+	// the speed, confirm or back skip them.
+	updateCredits := func() {
+		in := readMenuInput()
+		creditsFrames++
+
+		axis := relativeAxis(input.xboxController.leftYAxis)
+		if abs(input.joystick.yAxis) > abs(axis) {
+			axis = input.joystick.yAxis
+		}
+		if input.keyboard.IsDown(di8.K_DOWN) || input.keyboard.IsDown(di8.K_S) {
+			axis = 1
+		} else if input.keyboard.IsDown(di8.K_UP) || input.keyboard.IsDown(di8.K_W) {
+			axis = -1
+		}
+		creditsScroll = max(0, creditsScroll+creditsScrollSpeed*creditsSpeedFactor(axis))
+
+		bounds := w32.GetClientRect(window)
+		const lineHeight = 48
+		done := creditsScroll > float32(bounds.Bottom)+float32(len(credits))*lineHeight
+		if in.confirm || in.back || done {
+			if creditsAfterGame {
+				loadLevel(0)
+				gameState = gameStatePlayingLevel
+			} else {
+				gameState = gameStateTitle
+				menuChoice = titleCredits
+			}
+		}
+	}
+
+	var openControllerSelect func(returnTo int)
+
+	// updateOptions changes the settings and saves them right away. Left and
+	// right move the volume sliders, the new volume is audible at once.
+	updateOptions := func() {
+		in := readMenu(len(optionsLines))
+		back := menuChoice == len(optionsLines)-1
+		if in.back || in.confirm && back {
+			gameState = gameStateTitle
+			menuChoice = titleOptions
+			// A display mode that was picked but not applied is forgotten.
+			pickedDisplayMode = displayModeIndex
+			updateOptionsLines()
+			return
+		}
+		before := userSettings
+		switch menuChoice {
+		case optionRunInBackground:
+			if in.confirm || in.left || in.right {
+				userSettings.RunInBackground = !userSettings.RunInBackground
+			}
+		case optionMasterVolume:
+			changeVolume(&userSettings.MasterVolume, in)
+		case optionMusicVolume:
+			changeVolume(&userSettings.MusicVolume, in)
+		case optionEffectsVolume:
+			changeVolume(&userSettings.EffectsVolume, in)
+		case optionDisplayMode:
+			if in.left || in.right {
+				n := len(displayModes)
+				if in.left {
+					pickedDisplayMode = (pickedDisplayMode + n - 1) % n
+				} else {
+					pickedDisplayMode = (pickedDisplayMode + 1) % n
+				}
+				updateOptionsLines()
+				s, err := sound.play("assets/blip.ogg")
+				check(err)
+				sound.setSpeed(s, 1.8)
+			}
+			if in.confirm && pickedDisplayMode != displayModeIndex {
+				setDisplayMode(pickedDisplayMode)
+				pickedDisplayMode = displayModeIndex
+				updateOptionsLines()
+			}
+		case optionFieldOfView:
+			fov := levelFieldOfView(userSettings.FieldOfView)
+			if in.left {
+				fov -= fieldOfViewStep
+			}
+			if in.right {
+				fov += fieldOfViewStep
+			}
+			userSettings.FieldOfView = float64(levelFieldOfView(float64(fov)))
+		case optionPlayer1Controller:
+			if in.confirm {
+				openControllerSelect(gameStateOptions)
+			}
+		case optionControllerTest:
+			if in.confirm {
+				controllerTestScreen.refresh(inputDevices)
+				controllerTestBackFrames = 0
+				gameState = gameStateControllerTest
+			}
+		}
+		if userSettings != before {
+			applyVolumes()
+			updateOptionsLines()
+			if in.left || in.right {
+				// The blip lets the player hear the new effects volume.
+				s, err := sound.play("assets/blip.ogg")
+				check(err)
+				sound.setSpeed(s, 1.8)
+			}
+			// Saving is best effort, like saving the progress.
+			userSettings.save()
+		}
+	}
+
+	// The controller select screen lets player 1 pick their controller. It
+	// opens from the options, and at startup if there are several
+	// controllers and player 1 has not picked one of them yet.
+	var controllerSelectLines, controllerSelectChoices []string
+	controllerSelectReturn := gameStateTitle
+	openControllerSelect = func(returnTo int) {
+		controllerSelectLines, controllerSelectChoices = listControllerChoices(inputDevices)
+		controllerSelectReturn = returnTo
+		menuChoice = 0
+		for i, c := range controllerSelectChoices {
+			if c == userSettings.Player1Controller {
+				menuChoice = i
+			}
+		}
+		gameState = gameStateControllerSelect
+	}
+
+	// updateControllerSelect stores the picked controller and goes back.
+	updateControllerSelect := func() {
+		in := readMenu(len(controllerSelectLines))
+		if in.confirm {
+			userSettings.Player1Controller = controllerSelectChoices[menuChoice]
+			inputDevices.setPlayer1Controller(userSettings.Player1Controller)
+			// Saving is best effort, like in the options.
+			userSettings.save()
+		}
+		if in.confirm || in.back {
+			gameState = controllerSelectReturn
+			menuChoice = titleStart
+			if controllerSelectReturn == gameStateOptions {
+				menuChoice = optionPlayer1Controller
+			}
+		}
+	}
+
+	// updateControllerTest leaves the controller test when back is held down
+	// for a second. Pressing it only shows it on the screen, like all other
+	// buttons.
+	updateControllerTest := func() {
+		readMenuInput()
+		if input.xboxController.buttonBDown() ||
+			input.secondXBoxController.buttonBDown() ||
+			input.joystick.buttonDown[1] ||
+			input.keyboard.IsDown(di8.K_BACK) {
+			controllerTestBackFrames++
+		} else {
+			controllerTestBackFrames = 0
+		}
+		if controllerTestBackFrames >= 60 {
+			gameState = gameStateOptions
+		}
+	}
 
-			check(device.EndScene())
-			check(device.Present(nil, nil, 0, nil))
+	// updateLevelSelect skips the intro and starts the chosen level.
+	updateLevelSelect := func() {
+		in := readMenu(len(levelSelectLines))
+		back := menuChoice == len(levelSelectLines)-1
+		if in.back || in.confirm && back {
+			gameState = gameStateTitle
+			menuChoice = titleLevelSelect
+			if practice {
+				menuChoice = titlePractice
+			}
+			return
+		}
+		if in.confirm {
+			startMusic()
+			loadLevel(menuChoice)
+			gameState = gameStatePlayingLevel
+		}
+	}
 
-			joystickYRotation += joystickYRotationSpeed
+	// drawTextPanel shows the lines centered on a dark panel in the middle of
+	// the screen.
+	drawTextPanel := func(lines []string, selected int, screenW, screenH float32) {
+		const lineHeight = 48
+		panelW := min(screenW-20, 700)
+		panelH := float32(len(lines)+1) * lineHeight
+		panelX, panelY := (screenW-panelW)/2, (screenH-panelH)/2
+		hud.rect(panelX, panelY, panelW, panelH, m.Vec4{0, 0, 0, 0.7})
+		for i, line := range lines {
+			w := hud.promptWidth(line, lineHeight, input.lastDevice)
+			x := (screenW - w) / 2
+			y := panelY + lineHeight/2 + float32(i)*lineHeight
+			white := m.Vec4{1, 1, 1, 1}
+			hud.prompt(x, y, lineHeight, line, input.lastDevice, white)
+			if i == selected {
+				// We draw the markers separately instead of concatenating
+				// strings every frame.
+				hud.text(x-hud.textWidth("> ", lineHeight), y, lineHeight, "> ", white)
+				hud.text(x+w, y, lineHeight, " <", white)
+			}
+		}
+	}
 
-			gamepadScale -= joystickScaleSpeed
-			if gamepadScale <= 0 {
-				gamepadScale = 0
+	// drawDialogueBox shows the dialogue at the bottom of the screen, with
+	// the speaker's portrait on the left, cut out of the joker's texture.
+	drawDialogueBox := func(b *dialogueBox, screenW, screenH float32) {
+		const (
+			margin       = 20
+			portraitSize = 160
+			textSize     = 36
+		)
+		line := b.current()
+		boxW := min(screenW-2*margin, 1200)
+		textX := (screenW-boxW)/2 + 2*margin + portraitSize
+		textW := boxW - 3*margin - portraitSize
+		if b.wrappedLine != b.line || b.wrappedWidth != textW {
+			b.wrapped = hud.wrapText(line.Text, textSize, textW)
+			b.wrappedLine, b.wrappedWidth = b.line, textW
+		}
+		text := b.wrapped
+		rows := 1 + len(text) + len(line.Choices)
+		if len(line.Choices) > 0 {
+			rows++
+		}
+		boxH := max(portraitSize+2*margin, float32(rows)*textSize+2*margin)
+		boxX := (screenW - boxW) / 2
+		boxY := screenH - margin - boxH
+
+		hud.rect(boxX, boxY, boxW, boxH, m.Vec4{0, 0, 0, 0.8})
+		hud.rect(boxX+margin-4, boxY+margin-4, portraitSize+8, portraitSize+8, m.Vec4{0.6, 1.3, 0.6, 1})
+		// The face is rotated by 90 degrees in the texture, its top points
+		// to the left.
+		const u0, v0, u1, v1 = 0.5125, 0.5325, 0.6125, 0.6325
+		hud.image(
+			jokerTexture,
+			boxX+margin, boxY+margin, portraitSize, portraitSize,
+			[4][2]float32{{u0, v1}, {u0, v0}, {u1, v1}, {u1, v0}},
+		)
+
+		y := boxY + margin
+		hud.text(textX, y, textSize, b.dialogue.Speaker, m.Vec4{1, 0.8, 0.1, 1})
+		y += textSize
+		for _, t := range text {
+			hud.prompt(textX, y, textSize, t, input.lastDevice, m.Vec4{1, 1, 1, 1})
+			y += textSize
+		}
+		if len(line.Choices) > 0 {
+			y += textSize
+		}
+		for i, c := range line.Choices {
+			color := m.Vec4{0.7, 0.7, 0.7, 1}
+			prefix := "  "
+			if i == b.choice {
+				color = m.Vec4{1, 1, 0.3, 1}
+				prefix = "> "
+			}
+			hud.text(textX, y, textSize, prefix, color)
+			hud.text(textX+hud.textWidth(prefix, textSize), y, textSize, c.Text, color)
+			y += textSize
+		}
+	}
 
-				joystickScale += joystickScaleSpeed
-				if joystickScale >= 1 {
-					joystickScale = 1
-					gameState = gameStateJoystickRotating
-				}
+	render := func() {
+		if gameState == gameStateTitle ||
+			gameState == gameStateOptions ||
+			gameState == gameStateLevelSelect ||
+			gameState == gameStateControllerSelect {
+			// The menus are black, like the start of the fade-in. While the
+			// field of view is selected, the level shows behind the options
+			// as a preview.
+			fovPreview := gameState == gameStateOptions &&
+				menuChoice == optionFieldOfView
+			background := uint8(0)
+			if fovPreview {
+				background = backgroundGray
 			}
-		} else if gameState == gameStateJoystickRotating {
-			check(device.Clear(
-				nil,
-				d3d9.CLEAR_TARGET|d3d9.CLEAR_ZBUFFER,
-				d3d9.ColorRGB(backgroundGray, backgroundGray, backgroundGray),
-				1,
-				0,
+			check(gfx.beginFrame(background))
+			bounds := w32.GetClientRect(window)
+			w, h := float32(bounds.Right), float32(bounds.Bottom)
+			if fovPreview {
+				drawScene(m.LookAt(cameras[0].pos, jokers[0].pos, m.Vec3{0, 1, 0}), w/h)
+			}
+			const titleSize = 96
+			const title = "Demo Time"
+			hud.text((w-hud.textWidth(title, titleSize))/2, h/8, titleSize, title, m.Vec4{1, 0.8, 0.1, 1})
+			lines := titleMenuLines
+			if gameState == gameStateOptions {
+				lines = optionsLines
+			} else if gameState == gameStateLevelSelect {
+				lines = levelSelectLines
+			} else if gameState == gameStateControllerSelect {
+				lines = controllerSelectLines
+				const questionSize = 40
+				const question = "Which controller does player 1 use?"
+				hud.text((w-hud.textWidth(question, questionSize))/2, h/8+titleSize, questionSize, question, m.Vec4{1, 1, 1, 1})
+			}
+			drawTextPanel(lines, menuChoice, w, h)
+			const hintSize = 32
+			const hint = "{confirm} Select    {back} Back"
+			hud.prompt(
+				(w-hud.promptWidth(hint, hintSize, input.lastDevice))/2, h-2*hintSize,
+				hintSize, hint, input.lastDevice, m.Vec4{0.7, 0.7, 0.7, 1},
+			)
+			check(hud.draw(w, h))
+			present()
+
+			if gameState == gameStateTitle {
+				updateTitle()
+			} else if gameState == gameStateOptions {
+				updateOptions()
+			} else if gameState == gameStateControllerSelect {
+				updateControllerSelect()
+			} else {
+				updateLevelSelect()
+			}
+		} else if gameState == gameStateControllerTest {
+			check(gfx.beginFrame(0))
+			bounds := w32.GetClientRect(window)
+			w, h := float32(bounds.Right), float32(bounds.Bottom)
+			const titleSize = 64
+			const title = "Controller Test"
+			hud.text((w-hud.textWidth(title, titleSize))/2, 20, titleSize, title, m.Vec4{1, 0.8, 0.1, 1})
+			controllerTestScreen.draw(hud, input, w, h)
+			const hintSize = 32
+			const hint = "Hold {back} to leave"
+			hud.prompt(
+				(w-hud.promptWidth(hint, hintSize, input.lastDevice))/2, h-2*hintSize,
+				hintSize, hint, input.lastDevice, m.Vec4{0.7, 0.7, 0.7, 1},
+			)
+			check(hud.draw(w, h))
+			present()
+
+			updateControllerTest()
+		} else if gameState == gameStateCredits {
+			check(gfx.beginFrame(backgroundGray))
+			// The controller turns once every 20 seconds.
+			drawXBoxController(m.Mul4(
+				m.RotateRightHandX(finalControllerXRotation),
+				m.RotateLeftHandY(float32(creditsFrames)/1200),
+				m.Translate(0, 0, finalControllerZ),
 			))
 
-			check(device.BeginScene())
+			bounds := w32.GetClientRect(window)
+			w, h := float32(bounds.Right), float32(bounds.Bottom)
+			const lineHeight = 48
+			y := h - creditsScroll
+			for _, line := range credits {
+				size := float32(lineHeight * 0.75)
+				color := m.Vec4{1, 1, 1, 1}
+				if line.heading {
+					size = lineHeight
+					color = m.Vec4{1, 0.8, 0.1, 1}
+				}
+				if y > -lineHeight && y < h {
+					x := (w - hud.textWidth(line.text, size)) / 2
+					// The shadow keeps the text readable in front of the
+					// controller.
+					hud.text(x+2, y+2, size, line.text, m.Vec4{0, 0, 0, 0.6})
+					hud.text(x, y, size, line.text, color)
+				}
+				y += lineHeight
+			}
+			check(hud.draw(w, h))
+			present()
+
+			updateCredits()
+		} else if gameState == gameStateFadingIn {
+			c := uint8(max(0, fadeIn.Value()))
+			check(gfx.beginFrame(c))
+			present()
+		} else if gameState == gameStateXBoxControllerFlyingIn {
+			check(gfx.beginFrame(backgroundGray))
+			t := controllerFlyIn.Value()
+			scale := float32(t * t)
+			rotation := t * (10 + finalControllerXRotation)
+			dz := float32((1 - t) * 100)
+			modelTransform := m.Mul4(
+				m.Scale(scale, scale, scale),
+				m.RotateRightHandX(float32(rotation)),
+				m.Translate(0, 0, finalControllerZ+dz),
+			)
+			drawXBoxController(modelTransform)
+			present()
+		} else if gameState == gameStateXBoxController {
+			check(gfx.beginFrame(backgroundGray))
+			modelTransform := m.Mul4(
+				m.RotateRightHandX(finalControllerXRotation),
+				m.RotateRightHandX(controllerXRotation),
+				m.RotateLeftHandY(controllerYRotation),
+				m.Translate(0, 0, finalControllerZ),
+			)
+			drawXBoxController(modelTransform)
+
+			// While we wait for the controller, we tell the player what to do.
+			if !input.xboxController.connected {
+				bounds := w32.GetClientRect(window)
+				w, h := float32(bounds.Right), float32(bounds.Bottom)
+				text := "Please connect an XBox controller"
+				size := min(48, w/20)
+				x := (w - hud.textWidth(text, size)) / 2
+				y := h - 3*size
+				hud.rect(0, y-size/2, w, 2*size, m.Vec4{0, 0, 0, 0.6})
+				hud.text(x, y, size, text, m.Vec4{1, 0.4, 0.4, 1})
+				check(hud.draw(w, h))
+			}
+			present()
+
+			controllerXRotation += input.xboxController.rightYAxis / 200
+			if controllerXRotation > 0.1 {
+				controllerXRotation = 0.1
+			}
+			if controllerXRotation < -0.1 {
+				controllerXRotation = -0.1
+			}
+
+			controllerYRotation -= float32(
+				ease.InQuint(float64(input.xboxController.rightXAxis)) / 100)
+			if controllerYRotation > 1 {
+				controllerYRotation--
+			}
+			if controllerYRotation < -1 {
+				controllerYRotation++
+			}
+
+			if input.xboxController.buttonADown() {
+				specularStrength -= 0.01
+				if specularStrength < 0.05 {
+					specularStrength = 0.05
+				}
+			}
+			if input.xboxController.buttonBDown() {
+				specularStrength += 0.01
+				if specularStrength > 0.95 {
+					specularStrength = 0.95
+				}
+			}
+			if input.xboxController.buttonXDown() {
+				specularExponent /= 1.05
+				if specularExponent < 2 {
+					specularExponent = 2
+				}
+			}
+			if input.xboxController.buttonYDown() {
+				specularExponent *= 1.05
+				if specularExponent > 128 {
+					specularExponent = 128
+				}
+			}
+			if input.xboxController.buttonStartDown() {
+				specularStrength = 0.5
+				specularExponent = 16
+			}
+			if input.xboxController.buttonRBDown() {
+				lighting = lightingNoon
+			}
+			if input.xboxController.buttonBackDown() {
+				controllerXRotation = 0
+				controllerYRotation = 0
+			}
+			if preset, ok := lightingPresetFromDPad(input.xboxController.dpad); ok {
+				lighting = preset
+			}
+
+			introCombos.update(input.xboxController.buttons, time.Now())
+		} else if gameState == gameStateTransitionToJoystick {
+			check(gfx.beginFrame(backgroundGray))
+
+			xboxControllerTransform := m.Mul4(
+				m.ScaleUniform(float32(gamepadScale.Value())),
+				m.RotateRightHandX(finalControllerXRotation),
+				m.RotateRightHandX(controllerXRotation),
+				m.RotateLeftHandY(controllerYRotation),
+				m.Translate(0, 0, finalControllerZ),
+			)
+			drawXBoxController(xboxControllerTransform)
+
+			joystickTransform := m.Mul4(
+				m.ScaleUniform(0.5),
+				m.ScaleUniform(float32(joystickScale.Value())),
+				m.RotateRightHandX(0.05),
+				m.RotateRightHandY(joystickYRotation),
+				m.Translate(0, -0.5, finalControllerZ),
+			)
+			drawJoystick(joystickTransform)
+
+			present()
+
+			joystickYRotation += joystickYRotationSpeed
+		} else if gameState == gameStateJoystickRotating {
+			check(gfx.beginFrame(backgroundGray))
 			joystickTransform := m.Mul4(
 				m.ScaleUniform(0.5),
-				m.ScaleUniform(joystickScale),
+				m.ScaleUniform(float32(joystickScale.Value())),
 				m.RotateRightHandX(0.05),
 				m.RotateRightHandY(joystickYRotation),
 				m.Translate(0, -0.5, finalControllerZ),
 			)
 			drawJoystick(joystickTransform)
 
-			check(device.EndScene())
-			check(device.Present(nil, nil, 0, nil))
+			present()
 
 			joystickYRotation += joystickYRotationSpeed
 
 			if input.joystick.buttonDown != [8]bool{} {
 				gameState = gameStateJoystickShrinking
+				joystickScale.Reverse()
+				joystickScale.OnDone = func() { gameState = gameStatePlayingLevel }
+				animations.Add(joystickScale)
 			}
 		} else if gameState == gameStateJoystickShrinking {
-			check(device.Clear(
-				nil,
-				d3d9.CLEAR_TARGET|d3d9.CLEAR_ZBUFFER,
-				d3d9.ColorRGB(backgroundGray, backgroundGray, backgroundGray),
-				1,
-				0,
-			))
-
-			check(device.BeginScene())
+			check(gfx.beginFrame(backgroundGray))
 			joystickTransform := m.Mul4(
 				m.ScaleUniform(0.5),
-				m.ScaleUniform(joystickScale),
+				m.ScaleUniform(float32(joystickScale.Value())),
 				m.RotateRightHandX(0.05),
 				m.RotateRightHandY(joystickYRotation),
 				m.Translate(0, -0.5, finalControllerZ),
 			)
 			drawJoystick(joystickTransform)
 
-			check(device.EndScene())
-			check(device.Present(nil, nil, 0, nil))
+			present()
 
 			joystickYRotation += joystickYRotationSpeed
-			joystickScale -= joystickScaleSpeed
-
-			if joystickScale <= 0 {
-				gameState = gameStatePlayingLevel
-			}
-		} else if gameState == gameStatePlayingLevel {
-			check(device.Clear(
-				nil,
-				d3d9.CLEAR_TARGET|d3d9.CLEAR_ZBUFFER,
-				d3d9.ColorRGB(backgroundGray, backgroundGray, backgroundGray),
-				1,
-				0,
-			))
-
-			check(device.BeginScene())
-
-			view := m.LookAt(cameraPos, jokerPos, m.Vec3{0, 1, 0})
+		} else if inLevel(gameState) {
+			check(gfx.beginFrame(backgroundGray))
 
 			bounds := w32.GetClientRect(window)
 			aspect := float32(bounds.Right) / float32(bounds.Bottom)
-
-			check(device.SetVertexDeclaration(texturedVertex))
-			check(device.SetVertexShader(objectVertexShader))
-			check(device.SetPixelShader(objectPixelShader))
-			check(device.SetStreamSource(0, objectBuffer, 0, objectBufferStride))
-			lightColor := []float32{levelColor, levelColor, levelColor, 1}
-			check(device.SetPixelShaderConstantF(0, lightColor))
-			check(device.SetPixelShaderConstantF(1, []float32{-0.7, -4, 1, 1}))
-			check(device.SetPixelShaderConstantF(2, []float32{0.1, 2, 0.6, 0}))
-
-			check(device.SetTexture(0, levelTexture))
-			for _, o := range level3D {
-				normalTransform := m.Identity4()
-
-				mvp := m.Mul4(
-					view,
-					m.Perspective(m.DegToRad*fieldOfView, aspect, 0.1, 1000.0),
-				)
-
-				check(device.SetVertexShaderConstantF(0, mvp[:]))
-				check(device.SetVertexShaderConstantF(4, normalTransform[:]))
-
-				vertices := vertices[o.firstVertex:o.endVertex]
-				triangleCount := uint(len(vertices) / (3 * float32sPerTexturedVertex))
-				offset := uint(o.firstVertex / float32sPerTexturedVertex)
-				check(device.DrawPrimitive(d3d9.PT_TRIANGLELIST, offset, triangleCount))
-			}
-
-			// Draw the joker.
-			check(device.SetPixelShaderConstantF(1, []float32{0, -1, 1, 1}))
-			check(device.SetPixelShaderConstantF(2, []float32{0.7, 128, 0.2, 0}))
-			check(device.SetTexture(0, jokerTexture))
-			for _, o := range joker3D {
-				custom := m.Identity4()
-
-				if o.name == "leftLeg" || o.name == "rightLeg" ||
-					o.name == "leftArm" || o.name == "rightArm" ||
-					o.name == "leftHand" || o.name == "rightHand" {
-
-					rot := jokerLimbRot
-					if o.name == "leftLeg" ||
-						o.name == "rightArm" || o.name == "rightHand" {
-						rot = -rot
-					}
-
-					ref := jokerModel.FindObject("refArmJoint")
-					if o.name == "leftLeg" || o.name == "rightLeg" {
-						ref = jokerModel.FindObject("refLegJoint")
-					}
-
-					joint := jokerModel.Vertices[ref.StartVertex]
-
-					x, y, z := joint[0], joint[1], joint[2]
-
-					custom = m.Mul4(
-						m.Translate(-x, -y, -z),
-						m.RotateLeftHandX(0.16*float32(math.Sin(m.TurnsToRad*rot))),
-						m.Translate(x, y, z),
-					)
+			up := m.Vec3{0, 1, 0}
+
+			if gameState == gameStateCutscene {
+				// The camera flies from player 1's view to the cutscene's view
+				// and back at the end.
+				c := activeCutscene
+				blend := min(cutsceneTime, c.duration-cutsceneTime)
+				t := float32(cutsceneCurve(min(1, float64(blend)/float64(cutsceneBlend))))
+				pos := cameras[0].pos.MulScalar(1 - t).Add(c.camera.MulScalar(t))
+				target := jokers[0].pos.MulScalar(1 - t).Add(c.target.MulScalar(t))
+				drawScene(m.LookAt(pos, target, up), aspect)
+			} else if playerCount == 2 && !combinedCamera {
+				// Split the screen vertically, player 1 on the left.
+				for i := range playerCount {
+					check(gfx.setViewport(float32(i)/2, 0, 0.5, 1))
+					eye := cameras[i].pos.Add(haptics.shakeOffset(i))
+					view := m.LookAt(eye, jokers[i].pos, up)
+					drawScene(view, aspect/2)
 				}
-
-				model := m.Mul4(
-					custom,
-					m.RotateRightHandY(jokerRot-jokerBaseRot),
-					m.TranslateV(jokerPos),
-				)
-
-				normalTransform := model
-				normalTransform[3] = 0
-				normalTransform[7] = 0
-				normalTransform[11] = 0
-				normalTransform[12] = 0
-				normalTransform[13] = 0
-				normalTransform[14] = 0
-				normalTransform[15] = 0
-
-				mvp := m.Mul4(
-					model,
-					view,
-					m.Perspective(m.DegToRad*fieldOfView, aspect, 0.1, 1000.0),
-				)
-
-				check(device.SetVertexShaderConstantF(0, mvp[:]))
-				check(device.SetVertexShaderConstantF(4, normalTransform[:]))
-
-				vertices := vertices[o.firstVertex:o.endVertex]
-				triangleCount := uint(len(vertices) / (3 * float32sPerTexturedVertex))
-				offset := uint(o.firstVertex / float32sPerTexturedVertex)
-				check(device.DrawPrimitive(d3d9.PT_TRIANGLELIST, offset, triangleCount))
-			}
-
-			check(device.EndScene())
-			check(device.Present(nil, nil, 0, nil))
-
-			joyX := relativeAxis(input.joystick.xAxis)
-			joyY := relativeAxis(input.joystick.yAxis)
-
-			xboxX := relativeAxis(input.xboxController.leftXAxis)
-			xboxY := relativeAxis(input.xboxController.leftYAxis)
-
-			xAxis := joyX
-			yAxis := joyY
-
-			if abs(xboxY) > abs(joyY) {
-				yAxis = xboxY
-			}
-			if abs(xboxX) > abs(joyX) {
-				xAxis = xboxX
+				check(gfx.setViewport(0, 0, 1, 1))
+			} else if playerCount == 2 {
+				center := jokers[0].pos.Add(jokers[1].pos).MulScalar(0.5)
+				eye := combinedCameraPos.
+					Add(haptics.shakeOffset(0)).
+					Add(haptics.shakeOffset(1))
+				drawScene(m.LookAt(eye, center, up), aspect)
+			} else {
+				eye := cameras[0].pos.Add(haptics.shakeOffset(0))
+				drawScene(m.LookAt(eye, jokers[0].pos, up), aspect)
 			}
 
-			targetJokerSpeed := float64(-yAxis) * 0.05
-
-			if jokerSpeed < targetJokerSpeed {
-				jokerSpeed += jokerAcceleration
-				if jokerSpeed > targetJokerSpeed {
-					jokerSpeed = targetJokerSpeed
+			if network != nil {
+				status := hudText[:0]
+				if network.connected() {
+					_, latency := network.remotePlayer()
+					status = append(status, "Player 2: "...)
+					status = strconv.AppendInt(status, latency.Milliseconds(), 10)
+					status = append(status, " ms"...)
+				} else if network.hosting {
+					status = append(status, "Waiting for player 2 on port "...)
+					status = strconv.AppendInt(status, int64(*netPort), 10)
+				} else {
+					status = append(status, "Connecting to "...)
+					status = append(status, *joinAddress...)
 				}
+				hud.textBytes(11, 11, 32, status, m.Vec4{0, 0, 0, 0.5})
+				hud.textBytes(10, 10, 32, status, m.Vec4{1, 1, 1, 1})
+				hudText = status
 			}
 
-			if jokerSpeed > targetJokerSpeed {
-				jokerSpeed -= jokerAcceleration
-				if jokerSpeed < targetJokerSpeed {
-					jokerSpeed = targetJokerSpeed
+			// Flash the view of a player that just got hurt in red.
+			for i := range playerCount {
+				if jokers[i].flash <= 0 {
+					continue
+				}
+				x, w := float32(0), float32(bounds.Right)
+				if playerCount == 2 && !combinedCamera {
+					w /= 2
+					x = float32(i) * w
 				}
+				hud.rect(x, 0, w, float32(bounds.Bottom), m.Vec4{1, 0, 0, jokers[i].flash})
 			}
 
-			lastLimbRot := jokerLimbRot
-
-			if yAxis == 0 {
-				if jokerSpeed > 0 {
-					jokerSpeed -= jokerAcceleration
-					if jokerSpeed < 0 {
-						jokerSpeed = 0
-					}
+			// Show each player's health as a row of red boxes in the bottom-left
+			// corner of their part of the screen.
+			for i := range playerCount {
+				const boxSize = 30
+				x := float32(10)
+				if playerCount == 2 && !combinedCamera {
+					x += float32(i) * float32(bounds.Right) / 2
+				} else {
+					x += float32(i) * (maxJokerHealth*(boxSize+8) + 70)
 				}
-				if jokerSpeed < 0 {
-					jokerSpeed += jokerAcceleration
-					if jokerSpeed > 0 {
-						jokerSpeed = 0
-					}
+				y := float32(bounds.Bottom) - 10 - boxSize
+				if playerCount == 2 {
+					label := [...]string{"P1", "P2"}[i]
+					hud.text(x, y-5, boxSize+10, label, m.Vec4{1, 1, 1, 1})
+					x += hud.textWidth(label, boxSize+10) + 8
 				}
-
-				// Limb rotations of 0.0, 0.5 and 1.0 are all OK, as they are
-				// all the standing position.
-				if jokerLimbRot < 0.25 {
-					// Go from (0.0, 0.25) down to 0.0.
-					jokerLimbRot -= maxJokerSpeed * jokerSpeedLimbRatio
-					if jokerLimbRot < 0 {
-						jokerLimbRot = 0
-					}
-				} else if 0.25 < jokerLimbRot && jokerLimbRot < 0.5 {
-					// Go from (0.25,  0.5) up to 0.5.
-					jokerLimbRot += maxJokerSpeed * jokerSpeedLimbRatio
-					if jokerLimbRot >= 0.5 {
-						jokerLimbRot = 0
-					}
-				} else if 0.5 < jokerLimbRot && jokerLimbRot < 0.75 {
-					// Go from (0.5,  0.75) down to 0.5.
-					jokerLimbRot -= maxJokerSpeed * jokerSpeedLimbRatio
-					if jokerLimbRot <= 0.5 {
-						jokerLimbRot = 0
-					}
-				} else if 0.75 < jokerLimbRot {
-					// Go from (0.75,  1.0) up to 1.0.
-					jokerLimbRot += maxJokerSpeed * jokerSpeedLimbRatio
-					if jokerLimbRot >= 1 {
-						jokerLimbRot = 0
+				for h := range maxJokerHealth {
+					color := m.Vec4{0.9, 0.1, 0.1, 1}
+					if h >= jokers[i].health {
+						color = m.Vec4{0.2, 0.2, 0.2, 0.6}
 					}
-				} else {
-					jokerLimbRot = 0
+					hud.rect(x-2, y-2, boxSize+4, boxSize+4, m.Vec4{0, 0, 0, 0.6})
+					hud.rect(x, y, boxSize, boxSize, color)
+					x += boxSize + 8
 				}
 			}
 
-			floorHeightsAt := func(x, z float32) [4]float32 {
-				const collisionMargin = 0.25
-				x0 := x - collisionMargin
-				x1 := x + collisionMargin
-				z0 := z - collisionMargin
-				z1 := z + collisionMargin
-				return [4]float32{
-					float32(floorHeightAt(x0, z0)),
-					float32(floorHeightAt(x0, z1)),
-					float32(floorHeightAt(x1, z0)),
-					float32(floorHeightAt(x1, z1)),
+			collectedCount := 0
+			for _, c := range collected {
+				if c {
+					collectedCount++
 				}
 			}
-
-			collides := func(x, y, z float32) bool {
-				heights := floorHeightsAt(x, z)
-				for _, h := range heights {
-					if h > y {
-						return true
-					}
+			score := strconv.AppendInt(hudText[:0], int64(collectedCount), 10)
+			score = append(score, " / "...)
+			score = strconv.AppendInt(score, int64(len(collected)), 10)
+			scoreX := float32(bounds.Right) - 10 - hud.textBytesWidth(score, 40)
+			hud.textBytes(scoreX+1, 11, 40, score, m.Vec4{0, 0, 0, 0.5})
+			hud.textBytes(scoreX, 10, 40, score, m.Vec4{1, 0.8, 0.1, 1})
+			hudText = score
+
+			if practice {
+				const size = 48
+				x := (float32(bounds.Right) - hud.textWidth("Practice", size)) / 2
+				hud.text(x+1, 11, size, "Practice", m.Vec4{0, 0, 0, 0.5})
+				hud.text(x, 10, size, "Practice", m.Vec4{0.6, 1, 0.6, 1})
+			} else if currentLevel.timeLimit > 0 {
+				left := max(0, currentLevel.timeLimit-levelTime)
+				timer := appendLevelTime(hudText[:0], left)
+				color := m.Vec4{1, 1, 1, 1}
+				if left < 5*time.Second {
+					color = m.Vec4{1, 0.2, 0.2, 1}
 				}
-				return false
+				x := (float32(bounds.Right) - hud.textBytesWidth(timer, 48)) / 2
+				hud.textBytes(x+1, 11, 48, timer, m.Vec4{0, 0, 0, 0.5})
+				hud.textBytes(x, 10, 48, timer, color)
+				hudText = timer
 			}
 
-			jokerRot += -xAxis * 0.006
-
-			if jokerSpeed != 0 {
-				if yAxis != 0 {
-					jokerLimbRot += jokerSpeed * jokerSpeedLimbRatio
+			// Show the inventory below the score, each item as a colored box
+			// with its count.
+			itemY := float32(60)
+			for item := range itemKindCount {
+				n := savedGame.Inventory.count(item)
+				if n == 0 {
+					continue
 				}
-
-				sin, cos := math.Sincos(float64(m.TurnsToRad * jokerRot))
-				dx := float32(jokerSpeed * cos)
-				dz := float32(jokerSpeed * sin)
-
-				collidesX := collides(jokerPos[0]+dx, jokerPos[1], jokerPos[2])
-				collidesZ := collides(jokerPos[0], jokerPos[1], jokerPos[2]+dz)
-				if !collidesZ {
-					jokerPos[2] += dz
-				}
-				if !collidesX {
-					jokerPos[0] += dx
-				}
-
+				const iconSize = 30
+				text := strconv.AppendInt(append(hudText[:0], "x "...), int64(n), 10)
+				x := float32(bounds.Right) - 10 - hud.textBytesWidth(text, 36)
+				hud.textBytes(x, itemY-3, 36, text, m.Vec4{1, 1, 1, 1})
+				hudText = text
+				x -= iconSize + 10
+				hud.rect(x-2, itemY-2, iconSize+4, iconSize+4, m.Vec4{0, 0, 0, 0.6})
+				hud.rect(x, itemY, iconSize, iconSize, itemColors[item])
+				itemY += iconSize + 14
 			}
 
-			wantsToJump :=
-				!lastJoystickState.buttonDown[0] && input.joystick.buttonDown[0] ||
-					!lastXBoxState.buttonADown() && input.xboxController.buttonADown()
-
-			if !lastJoystickState.buttonDown[1] && input.joystick.buttonDown[1] ||
-				!lastXBoxState.buttonYDown() && input.xboxController.buttonYDown() {
-				cameraInCorner = !cameraInCorner
+			if lockedDoorHint > 0 {
+				hint := "The door is locked, find a key"
+				size := float32(40)
+				x := (float32(bounds.Right) - hud.textWidth(hint, size)) / 2
+				y := float32(bounds.Bottom) - 2*size - 10
+				hud.text(x+1, y+1, size, hint, m.Vec4{0, 0, 0, 0.5})
+				hud.text(x, y, size, hint, m.Vec4{1, 1, 1, 1})
 			}
 
-			var targetCameraPos m.Vec3
+			if gameState == gameStatePlayingLevel && nearNPC != -1 {
+				hint := "Press {interact} to talk"
+				size := float32(40)
+				device := input.lastDevice
+				x := (float32(bounds.Right) - hud.promptWidth(hint, size, device)) / 2
+				y := float32(bounds.Bottom) - 3*size - 10
+				hud.prompt(x+1, y+1, size, hint, device, m.Vec4{0, 0, 0, 0.5})
+				hud.prompt(x, y, size, hint, device, m.Vec4{1, 1, 1, 1})
+			}
 
-			if cameraInCorner {
-				cornerIndex := int(input.joystick.dpad) / 4500
-				if cornerIndex >= len(cameraCornerPositions) {
-					cornerIndex = int(input.xboxController.dpad) / 4500
-				}
-				if cornerIndex < len(cameraCornerPositions) {
-					cameraTargetCorner = cameraCornerPositions[cornerIndex]
-				}
-				targetCameraPos = cameraTargetCorner
-			} else {
-				dirZ, dirX := math.Sincos(float64(m.TurnsToRad * jokerRot))
-				maxCamX := float32(len(floorHeights[0]) - 1)
-				minCamZ := -float32(len(floorHeights) - 1)
-				targetCameraPos = m.Vec3{
-					max(1, min(maxCamX, jokerPos[0]-5*float32(dirX))),
-					4,
-					min(-1, max(minCamZ, jokerPos[2]-5*float32(dirZ))),
-				}
+			if gameState == gameStateDialogue {
+				drawDialogueBox(openDialogue, float32(bounds.Right), float32(bounds.Bottom))
 			}
 
-			cameraPos = cameraPos.MulScalar(0.95).Add(targetCameraPos.MulScalar(0.05))
+			if gameState == gameStatePlayingLevel && tutorialTimeLeft > 0 {
+				// Fade the text out during its last second.
+				alpha := float32(min(1, tutorialTimeLeft.Seconds()))
+				size := float32(44)
+				device := input.lastDevice
+				x := (float32(bounds.Right) - hud.promptWidth(tutorialText, size, device)) / 2
+				y := float32(80)
+				hud.prompt(x+1, y+1, size, tutorialText, device, m.Vec4{0, 0, 0, 0.5 * alpha})
+				hud.prompt(x, y, size, tutorialText, device, m.Vec4{1, 1, 1, alpha})
+			}
 
-			lastJoystickState = input.joystick
-			lastXBoxState = input.xboxController
+			if gameState == gameStateCutscene {
+				// Letterbox bars and the cutscene's text at the bottom.
+				w, h := float32(bounds.Right), float32(bounds.Bottom)
+				bar := h / 8
+				hud.rect(0, 0, w, bar, m.Vec4{0, 0, 0, 1})
+				hud.rect(0, h-bar, w, bar, m.Vec4{0, 0, 0, 1})
+				size := min(bar*0.6, 48)
+				text := activeCutscene.text
+				hud.text((w-hud.textWidth(text, size))/2, h-bar+(bar-size)/2, size, text, m.Vec4{1, 1, 1, 1})
+			}
 
-			playStep := func() {
-				if stepCoolDown > 0 {
-					return
+			if gameState == gameStateLevelComplete &&
+				levelCompleteFrames > celebrationFrames {
+				if resultsLines == nil {
+					nextLevelLabel := "Next level"
+					timeLine := "Time: " + formatLevelTime(levelTime)
+					if practice {
+						timeLine = "Practice, no time taken"
+					}
+					if levelIndex == len(levels)-1 {
+						nextLevelLabel = "Credits"
+					}
+					resultsLines = []string{
+						currentLevel.name + " complete!",
+						"",
+						timeLine,
+						fmt.Sprintf("Collected: %d / %d", collectedCount, len(collected)),
+						"",
+						nextLevelLabel,
+						"Random level",
+						"Statistics",
+					}
 				}
-				s, err := sound.play("assets/step.ogg")
-				check(err)
-				sound.setSpeed(s, 0.75+1.5*rand.Float64())
-				stepCoolDown = 10
+				drawTextPanel(resultsLines, 5+resultsChoice, float32(bounds.Right), float32(bounds.Bottom))
 			}
-			if stepCoolDown > 0 {
-				stepCoolDown--
-			}
-
-			onGround := false
-			jokerSpeedY += gravity
-			jokerPos[1] += jokerSpeedY
-			if collides(jokerPos[0], jokerPos[1], jokerPos[2]) {
-				onGround = true
-				jokerPos[1] = float32(int(jokerPos[1]))
-				jokerSpeedY = 0
 
-				if collides(jokerPos[0], jokerPos[1], jokerPos[2]) {
-					jokerPos[1] = float32(int(jokerPos[1]) + 1)
-				}
+			if gameState == gameStatePaused {
+				drawTextPanel([]string{
+					"Paused",
+					"",
+					"Press {confirm} to continue",
+				}, -1, float32(bounds.Right), float32(bounds.Bottom))
+			}
 
-				if wantsToJump {
-					jokerSpeedY = jokerJumpSpeed
-					s, err := sound.play("assets/blip.ogg")
-					check(err)
-					sound.setSpeed(s, 1+0.5*rand.Float64())
+			if gameState == gameStateStatistics {
+				if statisticsLines == nil {
+					s := savedGame.Stats
+					statisticsLines = []string{
+						"Statistics",
+						"",
+						fmt.Sprintf("Jumps: %d", s.Jumps),
+						fmt.Sprintf("Steps: %d", s.Steps),
+						fmt.Sprintf("Distance walked: %.0f tiles", s.DistanceWalked),
+						"Time played: " + formatPlayTime(time.Duration(s.SecondsPlayed*float64(time.Second))),
+						"",
+						"Back",
+					}
 				}
+				drawTextPanel(statisticsLines, 7, float32(bounds.Right), float32(bounds.Bottom))
 			}
 
-			if onGround && !wasOnGround {
-				playStep()
+			check(hud.draw(float32(bounds.Right), float32(bounds.Bottom)))
+
+			present()
+
+			if gameState == gameStatePlayingLevel {
+				updatePlayers()
+				updateTeleports()
+			} else if gameState == gameStateDialogue {
+				updateDialogue()
+			} else if gameState == gameStateCutscene {
+				updateCutscene()
+			} else if gameState == gameStateStatistics {
+				updateStatistics()
+			} else if gameState == gameStatePaused {
+				updatePaused()
+			} else {
+				updateLevelComplete()
 			}
-			wasOnGround = onGround
-
-			jokerLimbRot = norm01(jokerLimbRot)
-
-			if onGround &&
-				(lastLimbRot < 0.25 && jokerLimbRot >= 0.25 ||
-					lastLimbRot < 0.75 && jokerLimbRot >= 0.75) {
-				playStep()
+			if gameState == gameStatePlayingLevel {
+				haptics.update(inputDevices)
+			} else {
+				haptics.stop(inputDevices)
 			}
 
 			levelColor = max(1, levelColor*0.95)
@@ -1305,33 +3153,119 @@ void main(in input IN, out output OUT) {
 
 	if fullscreen {
 		style := w32.GetWindowLong(window, w32.GWL_STYLE)
-		var monitorInfo w32.MONITORINFO
-		monitor := w32.MonitorFromWindow(window, w32.MONITOR_DEFAULTTOPRIMARY)
-		var windowed w32.WINDOWPLACEMENT
-		if w32.GetWindowPlacement(window, &windowed) &&
-			w32.GetMonitorInfo(monitor, &monitorInfo) {
+		if monitor, ok := chooseMonitor(userSettings.Monitor); ok {
 			w32.SetWindowLong(
 				window,
 				w32.GWL_STYLE,
 				style & ^w32.WS_OVERLAPPEDWINDOW,
 			)
-			w32.SetWindowPos(
-				window,
-				0,
-				int(monitorInfo.RcMonitor.Left),
-				int(monitorInfo.RcMonitor.Top),
-				int(monitorInfo.RcMonitor.Right-monitorInfo.RcMonitor.Left),
-				int(monitorInfo.RcMonitor.Bottom-monitorInfo.RcMonitor.Top),
-				w32.SWP_NOOWNERZORDER|w32.SWP_FRAMECHANGED,
-			)
+			coverMonitor(window, monitor)
+			coveringMonitor = true
 		}
 		w32.ShowCursor(false)
 	}
 
 	w32.ShowWindow(window, syscall.SW_SHOWNORMAL)
 
+	// reloadAsset replaces a changed asset file in dev builds. Errors, e.g.
+	// from a file that is only half written, keep the old asset.
+	textures := map[string]*textureHandle{
+		"assets/xbox_controller.jpg": &xboxControllerTexture,
+		"assets/joystick.jpg":        &joystickTexture,
+		"assets/joker.jpg":           &jokerTexture,
+		"assets/level.png":           &levelTexture,
+	}
+	models := map[string]*model{
+		"assets/joker.obj":           &joker3D,
+		"assets/xbox_controller.obj": &controller3D,
+		"assets/joystick.obj":        &joystick3D,
+	}
+	reloadAsset := func(path string) error {
+		if t, ok := textures[path]; ok {
+			texture, err := loadTexture(gfx, path)
+			if err != nil {
+				return err
+			}
+			gfx.releaseTexture(*t)
+			*t = texture
+			return nil
+		}
+
+		if strings.HasSuffix(path, ".obj") {
+			file, err := loadObj(path)
+			if err != nil {
+				return err
+			}
+			// We append the new model to the vertices, the old one stays
+			// unused in the buffer. This wastes memory but only in dev builds.
+			var reloaded model
+			replace := func(old *model) {
+				if reloaded == nil {
+					reloaded = addModel(file)
+				}
+				if len(levelModel) > 0 && len(*old) > 0 &&
+					levelModel[0].firstVertex == (*old)[0].firstVertex {
+					levelModel = reloaded
+				}
+				*old = reloaded
+			}
+			if target, ok := models[path]; ok {
+				replace(target)
+			}
+			for i := range levels {
+				if levels[i].modelPath == path {
+					replace(&levelModels[i])
+				}
+			}
+			if reloaded == nil {
+				return nil
+			}
+			return uploadVertices()
+		}
+
+		if strings.HasSuffix(path, ".ogg") || strings.HasSuffix(path, ".mp3") {
+			return sound.reload(path)
+		}
+
+		if path == "assets/dialogue.json" {
+			d, err := loadDialogues(path)
+			if err != nil {
+				return err
+			}
+			dialogues = d
+		}
+		return nil
+	}
+	var assetChanges *assetWatcher
+	if hotReloadAssets {
+		assetChanges = newAssetWatcher("assets")
+	}
+
+	lastGameState := gameState
+	lastFrameTime := time.Now()
+
+	var allocations *allocationReport
+	if *reportAllocations {
+		allocations = newAllocationReport()
+	}
+
+	// With several controllers, player 1 picks one before the title screen,
+	// unless they did already and it is still connected.
+	if gameState == gameStateTitle {
+		inputDevices.update()
+		_, choices := listControllerChoices(inputDevices)
+		picked := userSettings.Player1Controller == allControllers
+		for _, c := range choices {
+			picked = picked || c == userSettings.Player1Controller
+		}
+		if len(choices) > 2 && !picked {
+			openControllerSelect(gameStateTitle)
+		}
+	}
+
 	msg := w32.MSG{Message: w32.WM_QUIT + 1}
 	for msg.Message != w32.WM_QUIT {
+		mainLoopWatchdog.tick()
 		if w32.PeekMessage(&msg, 0, 0, 0, w32.PM_REMOVE) {
 			if msg.Message == w32.WM_QUIT {
 				break
@@ -1339,9 +3273,91 @@ void main(in input IN, out output OUT) {
 			w32.TranslateMessage(&msg)
 			w32.DispatchMessage(&msg)
 		} else {
-			input.update()
+			// If we wait for the XBox controller while the game is in the
+			// background, the taskbar button blinks.
+			flash := !windowActive &&
+				gameState == gameStateXBoxController &&
+				!input.xboxController.connected
+			if flash != flashingTaskbar {
+				flashTaskbar(window, flash)
+				flashingTaskbar = flash
+			}
+
+			if !windowActive {
+				// In the background, we do not burn a whole CPU core.
+				time.Sleep(backgroundFrameTime)
+				if !userSettings.RunInBackground {
+					// Pause the game so the players do not miss anything
+					// when they come back, and be quiet until then.
+					if gameState == gameStatePlayingLevel {
+						gameState = gameStatePaused
+					}
+					check(sound.pause())
+					haptics.stop(inputDevices)
+					lastFrameTime = time.Now()
+					continue
+				}
+			}
+			check(sound.resume())
+
+			now := time.Now()
+			frameTime = now.Sub(lastFrameTime)
+			lastFrameTime = now
+
+			if assetChanges != nil {
+				for _, path := range assetChanges.changes(now) {
+					if err := reloadAsset(path); err != nil {
+						tutorialText = "Cannot reload " + path + ": " + err.Error()
+					} else {
+						tutorialText = "Reloaded " + path
+					}
+					tutorialTimeLeft = tutorialDuration
+				}
+			}
+
+			if deviceLost {
+				err := gfx.restore()
+				if err == nil {
+					deviceLost = false
+				} else if !errors.Is(err, errDeviceLost) {
+					check(err)
+				}
+				if deviceLost {
+					time.Sleep(backgroundFrameTime)
+					lastFrameTime = time.Now()
+					continue
+				}
+			}
+
+			inputDevices.update()
+			inputReadTime = time.Now()
+			check(levelStream.update([2]m.Vec3{jokers[0].pos, jokers[1].pos}, playerCount))
 			updateSound()
 			render()
+			animations.Update(1)
+			publishFrameCounters(frameTime, sound.underrunCount())
+			if allocations != nil {
+				allocations.frameDone(now)
+			}
+
+			if network != nil {
+				network.sendState(playerState{
+					playing: inLevel(gameState) && !jokers[0].dead() && bonusReturn == nil,
+					level:   uint8(levelIndex),
+					pos:     jokers[0].pos,
+					rot:     jokers[0].rot,
+					limbRot: float32(jokers[0].limbRot),
+				})
+			}
+
+			if gameState == gameStatePlayingLevel {
+				stats.addPlayTime(frameTime)
+				savedGame.Stats.SecondsPlayed += frameTime.Seconds()
+			}
+			if gameState != lastGameState {
+				stats.recordStage(gameStateNames[gameState])
+				lastGameState = gameState
+			}
 		}
 	}
 }
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"syscall"
+
+	"github.com/gonutz/w32/v2"
+)
+
+// monitor is one of the displays connected to the computer. bounds are in
+// virtual screen coordinates.
+type monitor struct {
+	handle  w32.HMONITOR
+	bounds  w32.RECT
+	primary bool
+}
+
+// listMonitors returns all monitors in the order that Windows enumerates them,
+// which usually is the order in the display settings.
+func listMonitors() []monitor {
+	var monitors []monitor
+	callback := syscall.NewCallback(func(handle w32.HMONITOR, _ w32.HDC, _ *w32.RECT, _ uintptr) uintptr {
+		var info w32.MONITORINFO
+		if w32.GetMonitorInfo(handle, &info) {
+			monitors = append(monitors, monitor{
+				handle:  handle,
+				bounds:  info.RcMonitor,
+				primary: info.DwFlags&w32.MONITORINFOF_PRIMARY != 0,
+			})
+		}
+		return 1
+	})
+	w32.EnumDisplayMonitors(0, nil, callback, 0)
+	return monitors
+}
+
+// chooseMonitor returns the monitor with the given 1-based number. 0 or an
+// invalid number selects the primary monitor.
+func chooseMonitor(number int) (monitor, bool) {
+	monitors := listMonitors()
+	if 1 <= number && number <= len(monitors) {
+		return monitors[number-1], true
+	}
+	for _, m := range monitors {
+		if m.primary {
+			return m, true
+		}
+	}
+	return monitor{}, false
+}
+
+// monitorOf returns the monitor that shows most of the window.
+func monitorOf(window w32.HWND) (monitor, bool) {
+	handle := w32.MonitorFromWindow(window, w32.MONITOR_DEFAULTTONEAREST)
+	var info w32.MONITORINFO
+	if !w32.GetMonitorInfo(handle, &info) {
+		return monitor{}, false
+	}
+	return monitor{
+		handle:  handle,
+		bounds:  info.RcMonitor,
+		primary: info.DwFlags&w32.MONITORINFOF_PRIMARY != 0,
+	}, true
+}
+
+// coverMonitor makes the window cover the whole monitor, unless it already
+// does.
+func coverMonitor(window w32.HWND, m monitor) {
+	r := w32.GetWindowRect(window)
+	if r != nil && *r == m.bounds {
+		return
+	}
+	w32.SetWindowPos(
+		window,
+		0,
+		int(m.bounds.Left),
+		int(m.bounds.Top),
+		int(m.bounds.Right-m.bounds.Left),
+		int(m.bounds.Bottom-m.bounds.Top),
+		w32.SWP_NOOWNERZORDER|w32.SWP_FRAMECHANGED,
+	)
+}
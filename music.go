@@ -0,0 +1,32 @@
+package main
+
+import "math"
+
+// The level music adapts to the game. Its loop plays as two stems: as
+// recorded and muffled by a low-pass filter. The calmer the game, the more we
+// hear the muffled stem, walking fast or getting close to a hazard brings the
+// full sound back.
+const (
+	musicLoopPath    = "assets/music_loop.ogg"
+	musicMuffledPath = "assets/music_loop.ogg (muffled)"
+	// musicMuffledCutoff is in Hz, it keeps the bass and drums.
+	musicMuffledCutoff = 500
+	// dangerDistance is how close, in tiles, a hazard starts to make the
+	// music more intense.
+	dangerDistance = 4
+)
+
+// playIntensity says how exciting the game is, from 0 to 1. Unlike the
+// triggers' musicIntensity, which sets the music's volume, it comes from what
+// the players do. speed is how fast the jokers move relative to their top
+// speed, danger how close they are to a hazard, 1 meaning right on top of it.
+// Both go from 0 to 1.
+func playIntensity(speed, danger float32) float32 {
+	return min(1, 0.2+0.5*speed+danger)
+}
+
+// musicStemVolumes crossfades the stems for the intensity. The crossfade
+// keeps the power constant, so the music does not get quieter in between.
+func musicStemVolumes(intensity float32) (full, muffled float64) {
+	return math.Sincos(float64(intensity) * math.Pi / 2)
+}
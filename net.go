@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	m "github.com/gonutz/d3dmath/column_major/d3dmath"
+)
+
+const (
+	defaultNetPort = 43210
+	// We consider the other player gone if we have not heard from them for
+	// this long.
+	netTimeout   = 3 * time.Second
+	pingInterval = 500 * time.Millisecond
+)
+
+// These are the message types, they are the first byte of every packet.
+const (
+	netMsgState = iota + 1
+	netMsgPing
+	netMsgPong
+	netMsgBye
+)
+
+// playerState is what we send over the network every frame. We simply sync the
+// state of each player's joker, every instance runs its own simulation.
+type playerState struct {
+	playing bool
+	// level is the index into levels that the player is in.
+	level   uint8
+	pos     m.Vec3
+	rot     float32
+	limbRot float32
+}
+
+const playerStateSize = 1 + 4 + 1 + 1 + 5*4 // type, sequence, playing, level, pos, rot, limbRot
+
+// netSession connects two game instances via UDP. One of them hosts, it
+// listens on a port and accepts the first player who sends it a packet. The
+// other one joins by sending packets to the host's address.
+//
+// Packets are read in a separate goroutine, the game loop reads the latest
+// remote state with remotePlayer and sends its own state with sendState.
+type netSession struct {
+	conn    *net.UDPConn
+	hosting bool
+
+	mu           sync.Mutex
+	peer         *net.UDPAddr
+	remote       playerState
+	remoteSeq    uint32
+	lastReceived time.Time
+	latency      time.Duration
+	left         bool
+
+	// These are only used from the game loop.
+	seq      uint32
+	lastPing time.Time
+	sendBuf  [playerStateSize]byte
+}
+
+// hostGame starts listening on the given UDP port for another player to join.
+func hostGame(port int) (*netSession, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		return nil, err
+	}
+	s := &netSession{conn: conn, hosting: true}
+	go s.receive()
+	return s, nil
+}
+
+// joinGame connects to a hosted game at the given address, e.g. "1.2.3.4". If
+// the address does not contain a port, the given port is used.
+func joinGame(address string, port int) (*netSession, error) {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, strconv.Itoa(port))
+	}
+	host, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	s := &netSession{conn: conn, peer: host}
+	go s.receive()
+	return s, nil
+}
+
+func (s *netSession) close() {
+	if peer := s.peerAddr(); peer != nil {
+		s.conn.WriteToUDP([]byte{netMsgBye}, peer)
+	}
+	s.conn.Close()
+}
+
+func (s *netSession) peerAddr() *net.UDPAddr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peer
+}
+
+// connected is true while we are receiving packets from the other player.
+func (s *netSession) connected() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.left && !s.lastReceived.IsZero() &&
+		time.Since(s.lastReceived) < netTimeout
+}
+
+// remotePlayer returns the last known state of the other player and the round
+// trip time of our last ping.
+func (s *netSession) remotePlayer() (playerState, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.remote, s.latency
+}
+
+// sendState is called once per frame with our own joker's state. It also
+// sends a ping every now and then to measure the latency.
+func (s *netSession) sendState(p playerState) {
+	peer := s.peerAddr()
+	if peer == nil {
+		return // Nobody has joined our game yet.
+	}
+
+	s.seq++
+	b := s.sendBuf[:]
+	b[0] = netMsgState
+	binary.LittleEndian.PutUint32(b[1:], s.seq)
+	b[5] = 0
+	if p.playing {
+		b[5] = 1
+	}
+	b[6] = p.level
+	binary.LittleEndian.PutUint32(b[7:], math.Float32bits(p.pos[0]))
+	binary.LittleEndian.PutUint32(b[11:], math.Float32bits(p.pos[1]))
+	binary.LittleEndian.PutUint32(b[15:], math.Float32bits(p.pos[2]))
+	binary.LittleEndian.PutUint32(b[19:], math.Float32bits(p.rot))
+	binary.LittleEndian.PutUint32(b[23:], math.Float32bits(p.limbRot))
+	s.conn.WriteToUDP(b, peer)
+
+	if time.Since(s.lastPing) >= pingInterval {
+		s.lastPing = time.Now()
+		var ping [9]byte
+		ping[0] = netMsgPing
+		binary.LittleEndian.PutUint64(ping[1:], uint64(s.lastPing.UnixNano()))
+		s.conn.WriteToUDP(ping[:], peer)
+	}
+}
+
+func (s *netSession) receive() {
+	var buf [512]byte
+	for {
+		n, from, err := s.conn.ReadFromUDP(buf[:])
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil || n == 0 {
+			continue
+		}
+		s.handlePacket(buf[:n], from)
+	}
+}
+
+func (s *netSession) handlePacket(b []byte, from *net.UDPAddr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	timedOut := time.Since(s.lastReceived) >= netTimeout
+	if s.hosting && (s.peer == nil || timedOut) {
+		// The first player to send us something joins our game.
+		s.peer = from
+	}
+	if !sameAddr(s.peer, from) {
+		return // Somebody else, we only play with one other player.
+	}
+	if timedOut {
+		// The other player might have restarted their game, which starts
+		// their sequence numbers over.
+		s.remoteSeq = 0
+	}
+
+	s.lastReceived = time.Now()
+	s.left = false
+
+	switch b[0] {
+	case netMsgState:
+		if len(b) < playerStateSize {
+			return
+		}
+		seq := binary.LittleEndian.Uint32(b[1:])
+		if seq <= s.remoteSeq {
+			return // UDP packets may arrive out of order, drop old ones.
+		}
+		s.remoteSeq = seq
+		f := func(i int) float32 {
+			return math.Float32frombits(binary.LittleEndian.Uint32(b[i:]))
+		}
+		s.remote = playerState{
+			playing: b[5] != 0,
+			level:   b[6],
+			pos:     m.Vec3{f(7), f(11), f(15)},
+			rot:     f(19),
+			limbRot: f(23),
+		}
+	case netMsgPing:
+		if len(b) < 9 {
+			return
+		}
+		var pong [9]byte
+		pong[0] = netMsgPong
+		copy(pong[1:], b[1:9])
+		s.conn.WriteToUDP(pong[:], from)
+	case netMsgPong:
+		if len(b) < 9 {
+			return
+		}
+		sent := time.Unix(0, int64(binary.LittleEndian.Uint64(b[1:])))
+		s.latency = time.Since(sent)
+	case netMsgBye:
+		s.left = true
+		s.remoteSeq = 0
+		if s.hosting {
+			// Let the next player join.
+			s.peer = nil
+		}
+	}
+}
+
+func sameAddr(a, b *net.UDPAddr) bool {
+	return a != nil && b != nil && a.IP.Equal(b.IP) && a.Port == b.Port
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"time"
+)
+
+// These counters are published by expvar at /debug/vars when the game runs
+// with -profile. We set them every frame, reading them is up to the HTTP
+// server.
+var (
+	frameTimeCounter      = expvar.NewFloat("frameTimeMilliseconds")
+	drawCallsCounter      = expvar.NewInt("drawCallsPerFrame")
+	mixerUnderrunsCounter = expvar.NewInt("mixerUnderruns")
+)
+
+// frameCounters count what the subsystems do in one frame. counters is the
+// current frame, drawTriangles and the HUD add to it. The frame loop publishes
+// it and keeps it as lastCounters for the F3 overlay, which is drawn while the
+// next frame is counted.
+type frameCounters struct {
+	drawCalls int
+	triangles int
+	// inputLatency is the time from reading the controllers to presenting
+	// the frame that reacts to them.
+	inputLatency time.Duration
+}
+
+var counters, lastCounters frameCounters
+
+// startProfiling serves net/http/pprof and our counters on the given address,
+// e.g. "localhost:6060". This lets users diagnose performance problems on
+// their machines, e.g. with
+//
+//	go tool pprof http://localhost:6060/debug/pprof/profile
+func startProfiling(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "profiling at http://%s/debug/pprof/\n", l.Addr())
+	// Importing net/http/pprof and expvar registers their handlers with the
+	// default mux.
+	go http.Serve(l, nil)
+	return nil
+}
+
+// publishFrameCounters is called at the end of every frame.
+func publishFrameCounters(frameTime time.Duration, underruns int) {
+	frameTimeCounter.Set(float64(frameTime) / float64(time.Millisecond))
+	drawCallsCounter.Set(int64(counters.drawCalls))
+	mixerUnderrunsCounter.Set(int64(underruns))
+	lastCounters = counters
+	counters = frameCounters{}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"strings"
+
+	m "github.com/gonutz/d3dmath/column_major/d3dmath"
+)
+
+// Texts on screen name buttons by their action in braces, e.g.
+// "Press {jump} to jump". The HUD draws the action's button for the device
+// that the player used last, so the prompt changes as soon as they switch from
+// the XBox controller to the keyboard or joystick.
+//
+// The actions are jump, interact, useItem, camera, confirm and back. They
+// match the buttons in xboxInput, joystickInput, keyboardInput and the menu
+// inputs.
+
+// buttonGlyph is how we draw a button: its label on top of a tinted sprite.
+type buttonGlyph struct {
+	label      string
+	sprite     hudSprite
+	color      m.Vec4
+	labelColor m.Vec4
+}
+
+var (
+	xboxGreen  = m.Vec4{0.35, 0.7, 0.2, 1}
+	xboxRed    = m.Vec4{0.85, 0.2, 0.15, 1}
+	xboxBlue   = m.Vec4{0.15, 0.4, 0.9, 1}
+	xboxYellow = m.Vec4{0.9, 0.7, 0.1, 1}
+	buttonGray = m.Vec4{0.3, 0.3, 0.3, 1}
+	keyCapGray = m.Vec4{0.85, 0.85, 0.85, 1}
+	labelWhite = m.Vec4{1, 1, 1, 1}
+	labelBlack = m.Vec4{0.1, 0.1, 0.1, 1}
+)
+
+func xboxButton(label string, color m.Vec4) buttonGlyph {
+	return buttonGlyph{label, spriteCircle, color, labelWhite}
+}
+
+func joystickButton(label string) buttonGlyph {
+	return buttonGlyph{label, spriteCircle, buttonGray, labelWhite}
+}
+
+func keyboardKey(label string) buttonGlyph {
+	return buttonGlyph{label, spriteKey, keyCapGray, labelBlack}
+}
+
+// buttonFor returns the button that triggers the action on the device. ok is
+// false for unknown actions.
+func buttonFor(device inputDevice, action string) (b buttonGlyph, ok bool) {
+	switch device {
+	case deviceJoystick:
+		switch action {
+		case "jump", "confirm":
+			return joystickButton("1"), true
+		case "camera", "back":
+			return joystickButton("2"), true
+		case "useItem":
+			return joystickButton("3"), true
+		case "interact":
+			return joystickButton("4"), true
+		}
+	case deviceKeyboard:
+		switch action {
+		case "jump":
+			return keyboardKey("Space"), true
+		case "camera":
+			return keyboardKey("C"), true
+		case "useItem":
+			return keyboardKey("E"), true
+		case "interact":
+			return keyboardKey("F"), true
+		case "confirm":
+			return keyboardKey("Enter"), true
+		case "back":
+			return keyboardKey("Backspace"), true
+		}
+	default:
+		switch action {
+		case "jump", "confirm":
+			return xboxButton("A", xboxGreen), true
+		case "interact", "back":
+			return xboxButton("B", xboxRed), true
+		case "useItem":
+			return xboxButton("X", xboxBlue), true
+		case "camera":
+			return xboxButton("Y", xboxYellow), true
+		}
+	}
+	return buttonGlyph{}, false
+}
+
+// nextPromptPart splits off the start of text: either plain text up to the
+// next action in braces, or the action itself. It does not allocate.
+func nextPromptPart(text string) (part string, isAction bool, rest string) {
+	start := strings.IndexByte(text, '{')
+	if start > 0 {
+		return text[:start], false, text[start:]
+	}
+	if start == 0 {
+		if end := strings.IndexByte(text, '}'); end != -1 {
+			return text[1:end], true, text[end+1:]
+		}
+	}
+	return text, false, ""
+}
+
+// prompt is like text but draws actions in braces as the device's buttons.
+// Unknown actions are drawn as they are written.
+func (h *hud) prompt(x, y, size float32, text string, device inputDevice, color m.Vec4) {
+	for text != "" {
+		part, isAction, rest := nextPromptPart(text)
+		text = rest
+		if isAction {
+			if b, ok := buttonFor(device, part); ok {
+				x += h.button(x, y, size, b, color)
+				continue
+			}
+			part = "{" + part + "}"
+		}
+		h.text(x, y, size, part, color)
+		x += h.textWidth(part, size)
+	}
+}
+
+// promptWidth is textWidth for a prompt.
+func (h *hud) promptWidth(text string, size float32, device inputDevice) float32 {
+	var w float32
+	for text != "" {
+		part, isAction, rest := nextPromptPart(text)
+		text = rest
+		if isAction {
+			if b, ok := buttonFor(device, part); ok {
+				w += h.buttonWidth(b, size)
+				continue
+			}
+			part = "{" + part + "}"
+		}
+		w += h.textWidth(part, size)
+	}
+	return w
+}
+
+// button draws the button in a line of text of the given size and returns
+// its width. color tints the button, which makes it work for text shadows.
+func (h *hud) button(x, y, size float32, b buttonGlyph, color m.Vec4) float32 {
+	w := h.buttonWidth(b, size)
+	spriteSize := size * 0.9
+	labelSize := size * 0.6
+	spriteY := y + (size-spriteSize)/2
+	h.sprite(b.sprite, x, spriteY, w, spriteSize, tint(b.color, color))
+	labelX := x + (w-h.textWidth(b.label, labelSize))/2
+	labelY := spriteY + (spriteSize-labelSize)/2
+	h.text(labelX, labelY, labelSize, b.label, tint(b.labelColor, color))
+	return w
+}
+
+func (h *hud) buttonWidth(b buttonGlyph, size float32) float32 {
+	w := size * 0.9
+	if b.sprite == spriteKey {
+		// Keys like Space are wider than high.
+		w = max(w, h.textWidth(b.label, size*0.6)+size*0.5)
+	}
+	return w
+}
+
+// tint multiplies the colors component by component.
+func tint(a, b m.Vec4) m.Vec4 {
+	return m.Vec4{a[0] * b[0], a[1] * b[1], a[2] * b[2], a[3] * b[3]}
+}
@@ -0,0 +1,28 @@
+//go:build !dev
+
+package main
+
+import (
+	"io/fs"
+
+	"github.com/gonutz/go_game_demo/assetpack"
+)
+
+// The assets are compressed into assets.pack, which is embedded into the
+// executable, see embed_full.go. Demo builds embed assets_demo.pack instead,
+// see embed_demo.go. Run "go generate" after changing files in the assets
+// directory. The go:generate lines in those files first compile the shaders so
+// the pack contains their bytecode.
+
+// Release builds use the embedded assets, which cannot change.
+const hotReloadAssets = false
+
+const validateAssetsAtStartup = false
+
+func openAssets(externalPacks []string) (fs.FS, error) {
+	pack, err := assetpack.Open(embeddedAssets)
+	if err != nil {
+		return nil, err
+	}
+	return withExternalPacks(pack, externalPacks)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// saveGame is the progress that is kept between sessions. It is stored in
+// save.json in the game's data directory.
+type saveGame struct {
+	Inventory inventory     `json:"inventory"`
+	Stats     lifetimeStats `json:"stats"`
+}
+
+// lifetimeStats are summed up over all sessions and all local players.
+type lifetimeStats struct {
+	Jumps int `json:"jumps"`
+	Steps int `json:"steps"`
+	// DistanceWalked is in level units, which are tiles.
+	DistanceWalked float64 `json:"distanceWalked"`
+	SecondsPlayed  float64 `json:"secondsPlayed"`
+}
+
+const saveFileName = "save.json"
+
+// loadSaveGame reads the save file. If there is none or it cannot be read, we
+// start over with an empty save game.
+func loadSaveGame() saveGame {
+	var s saveGame
+
+	dir, err := dataDir()
+	if err != nil {
+		return s
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, saveFileName))
+	if err != nil {
+		return s
+	}
+
+	if json.Unmarshal(data, &s) != nil {
+		return saveGame{}
+	}
+	return s
+}
+
+func (s *saveGame) save() error {
+	dir, err := dataDir()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash while saving does not leave
+	// a broken save file behind.
+	path := filepath.Join(dir, saveFileName)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// settings holds the user's preferences. They are read from settings.json in
+// the game's data directory. If that file does not exist or cannot be read,
+// we use the default settings.
+type settings struct {
+	// Telemetry is opt-in. If enabled, we collect statistics about each
+	// session and write them to the data directory when the game exits.
+	Telemetry bool `json:"telemetry"`
+	// TelemetryEndpoint is an optional URL. If set (and Telemetry is enabled),
+	// the session statistics are also POSTed there as JSON.
+	TelemetryEndpoint string `json:"telemetryEndpoint"`
+	// RunInBackground keeps the game running, at a low frame rate, while its
+	// window is not focused. By default it pauses.
+	RunInBackground bool `json:"runInBackground"`
+	// Monitor is the 1-based number of the monitor to play on, in the order
+	// of the display settings. 0 means the primary monitor.
+	Monitor int `json:"monitor"`
+	// MasterVolume scales all sounds, MusicVolume and EffectsVolume only the
+	// music or the sound effects. They go from 0 (muted) to 1.
+	MasterVolume  float64 `json:"masterVolume"`
+	MusicVolume   float64 `json:"musicVolume"`
+	EffectsVolume float64 `json:"effectsVolume"`
+	// DisplayMode is the fullscreen resolution and refresh rate. The zero
+	// value keeps the desktop's mode.
+	DisplayMode displayMode `json:"displayMode"`
+	// FieldOfView is the level camera's vertical field of view in degrees,
+	// see levelFieldOfView.
+	FieldOfView float64 `json:"fieldOfView"`
+	// Player1Controller is the controller that player 1 picked, see
+	// setPlayer1Controller. It is empty until they pick one.
+	Player1Controller string `json:"player1Controller"`
+	// SurroundSound outputs 5.1 if the speakers are set up for it in
+	// Windows. Otherwise we mix down to stereo.
+	SurroundSound bool `json:"surroundSound"`
+}
+
+const settingsFileName = "settings.json"
+
+func defaultSettings() settings {
+	return settings{
+		MasterVolume:  1,
+		MusicVolume:   1,
+		EffectsVolume: 1,
+		SurroundSound: true,
+		FieldOfView:   defaultFieldOfView,
+	}
+}
+
+// dataDir returns the directory where we keep settings and other files that
+// belong to the user. It is created if it does not yet exist.
+func dataDir() (string, error) {
+	base, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(base, "go_game_demo")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+func loadSettings() settings {
+	s := defaultSettings()
+
+	dir, err := dataDir()
+	if err != nil {
+		return s
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, settingsFileName))
+	if err != nil {
+		return s
+	}
+
+	if json.Unmarshal(data, &s) != nil {
+		return defaultSettings()
+	}
+	return s
+}
+
+// save writes the settings to settings.json, e.g. after changing them in the
+// options menu.
+func (s *settings) save() error {
+	dir, err := dataDir()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, settingsFileName)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
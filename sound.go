@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"math"
 	"strings"
 	"unsafe"
 
@@ -12,26 +13,39 @@ import (
 	"github.com/jfreymuth/oggvorbis"
 )
 
-const (
-	// 4096 samples is about 93 ms at 44100 Hz.
-	soundWriteAheadSamples = 4096
-	soundWriteAheadSize    = 4 * soundWriteAheadSamples
-)
+// 4096 samples is about 93 ms at 44100 Hz.
+const soundWriteAheadSamples = 4096
 
 type soundHandle int
 
 const invalidSoundHandle soundHandle = 0
 
+// soundBus groups sounds so the player can set their volume together. Every
+// sound starts on busEffects, music is moved to busMusic with setBus.
+type soundBus int
+
+const (
+	busEffects soundBus = iota
+	busMusic
+
+	soundBusCount
+)
+
 type soundSystem struct {
 	dsound *ds.DirectSound
 	// mixBuffer is our hardware sound buffer that gets played in a loop. We
 	// regularly update its contents at the position that will be played next.
 	mixBuffer     *ds.Buffer
 	mixBufferSize int
+	// channels is 2 for stereo output or speakerCount for 5.1. frameSize is
+	// the number of bytes for one sample in all channels.
+	channels  int
+	frameSize int
 	// writeAheadBuffer and writeAheadMixBuffer are really temporary buffers
 	// used in the main update loop. We keep them here to not allocate them
-	// anew every frame.
-	writeAheadBuffer    [soundWriteAheadSamples]soundSample
+	// anew every frame. writeAheadBuffer holds the output samples of all
+	// channels interleaved.
+	writeAheadBuffer    [soundWriteAheadSamples * speakerCount]int16
 	writeAheadMixBuffer [soundWriteAheadSamples]mixSample
 	// lastWritePos is the offset into the mixBuffer where we last wrote to.
 	// This way we can calculate how many samples have been played since the
@@ -47,6 +61,15 @@ type soundSystem struct {
 	// played over time.
 	nextHandle soundHandle
 	queue      []consecutiveSounds
+	// paused stops the hardware buffer, all sounds keep their positions.
+	paused bool
+	// underruns counts the updates that came too late: the sound card played
+	// past the samples we had written ahead and repeated old ones.
+	underruns int
+	// busVolumes and masterVolume scale the volumes of all sounds on top of
+	// their own volumes.
+	busVolumes   [soundBusCount]float64
+	masterVolume float64
 }
 
 type soundState struct {
@@ -55,8 +78,27 @@ type soundState struct {
 	pos       float64
 	lastSpeed float64
 	speed     float64
+	volume    float64
+	bus       soundBus
 	looping   bool
 	queued    bool
+	// stems are layers that play in sync with samples, see addStem. The
+	// samples themselves are stem 0, firstStemVolume is their volume.
+	stems           []soundStem
+	firstStemVolume float64
+	// positional sounds come from a direction, gains pan them across the
+	// speakers. Other sounds play their left and right channels on the front
+	// left and right speakers.
+	positional bool
+	gains      [speakerCount]float64
+}
+
+// soundStem is a recording that plays along with a sound, e.g. one layer of
+// the music. Stems are mixed at the sound's position, so they stay sample
+// locked with it no matter how the speed changes.
+type soundStem struct {
+	samples []soundSample
+	volume  float64
 }
 
 type consecutiveSounds [2]soundHandle
@@ -76,49 +118,45 @@ type soundSample struct {
 // on top of each other. If we did this in the int16 space, we would soon be
 // out of range. We use int32 for the temporary summation of sound samples and
 // convert back down to int16 when we get ready to send it to the sound card.
+// We always mix in 5.1, see surround.go.
 type mixSample struct {
-	channels [2]int32
+	channels [speakerCount]int32
 }
 
-func initSoundSystem(window ds.HWND) (*soundSystem, error) {
+// initSoundSystem starts the sound output. If surround is true and the
+// speakers are set up for 5.1 in Windows, we output 5.1, otherwise stereo.
+func initSoundSystem(window ds.HWND, surround bool) (*soundSystem, error) {
+	if err := requireDLL("dsound.dll", errNoSoundDevice); err != nil {
+		return nil, err
+	}
+
 	dsound, err := ds.Create(nil)
 	if err != nil {
-		return nil, err
+		return nil, errNoSoundDevice(err)
 	}
 
 	// We use the cooperation level "normal" which means that we are restricted
-	// to using 44100 Hz, 2 channel, int16 samples. That is what we set our
-	// sound back buffer to.
+	// to using 44100 Hz, int16 samples. That is what we set our sound back
+	// buffer to. DirectSound mixes it into the primary buffer for us.
 	if err := dsound.SetCooperativeLevel(window, ds.SCL_NORMAL); err != nil {
 		dsound.Release()
 		return nil, err
 	}
 
-	soundFormat := ds.WAVEFORMATEX{
-		FormatTag:     ds.WAVE_FORMAT_PCM,
-		Channels:      2,
-		SamplesPerSec: 44100,
-		BitsPerSample: 16,
+	channels := 2
+	if surround {
+		config, err := dsound.GetSpeakerConfig()
+		if err == nil && isSurroundSpeakerConfig(config) {
+			channels = speakerCount
+		}
 	}
-	soundFormat.BlockAlign =
-		(soundFormat.Channels * soundFormat.BitsPerSample) / 8
-	soundFormat.AvgBytesPerSec =
-		soundFormat.SamplesPerSec * uint32(soundFormat.BlockAlign)
 
-	// Reserve 2 seconds worth of audio buffer.
-	bufferSize := 2 * soundFormat.AvgBytesPerSec
-
-	// The sound buffer should always hold whole 4-byte samples (2 channels, 2
-	// bytes per sample), so it must be divisible by 4.
-	for bufferSize%4 != 0 {
-		bufferSize++
+	buffer, bufferSize, err := createMixBuffer(dsound, channels)
+	if err != nil && channels != 2 {
+		// Not all drivers take 5.1 buffers, stereo always works.
+		channels = 2
+		buffer, bufferSize, err = createMixBuffer(dsound, channels)
 	}
-
-	buffer, err := dsound.CreateSoundBuffer(ds.BUFFERDESC{
-		Flags:       ds.BCAPS_GETCURRENTPOSITION2 | ds.BCAPS_GLOBALFOCUS,
-		BufferBytes: bufferSize,
-		WfxFormat:   &soundFormat,
-	})
 	if err != nil {
 		dsound.Release()
 		return nil, err
@@ -151,17 +189,97 @@ func initSoundSystem(window ds.HWND) (*soundSystem, error) {
 		dsound:        dsound,
 		mixBuffer:     buffer,
 		mixBufferSize: int(bufferSize),
+		channels:      channels,
+		frameSize:     2 * channels,
 		loadedSounds:  map[string][]byte{},
 		nextHandle:    1,
+		busVolumes:    [soundBusCount]float64{1, 1},
+		masterVolume:  1,
 	}, nil
 }
 
+// createMixBuffer creates the buffer that we mix into, with 2 seconds of 16
+// bit samples at 44100 Hz.
+func createMixBuffer(dsound *ds.DirectSound, channels int) (*ds.Buffer, uint32, ds.Error) {
+	format := waveFormatExtensible{
+		formatTag:     ds.WAVE_FORMAT_PCM,
+		channels:      uint16(channels),
+		samplesPerSec: 44100,
+		bitsPerSample: 16,
+	}
+	format.blockAlign = format.channels * format.bitsPerSample / 8
+	format.avgBytesPerSec = format.samplesPerSec * uint32(format.blockAlign)
+	if channels > 2 {
+		// More than two channels need the extensible format, which says
+		// which speakers they go to.
+		format.formatTag = waveFormatTagExtensible
+		format.size = uint16(unsafe.Sizeof(format) - 18)
+		format.validBitsPerSample = 16
+		format.channelMask = surroundChannelMask
+		format.subFormat = ksDataFormatSubtypePCM
+	}
+
+	// The buffer size is a multiple of blockAlign because we reserve whole
+	// seconds.
+	bufferSize := 2 * format.avgBytesPerSec
+
+	buffer, err := dsound.CreateSoundBuffer(ds.BUFFERDESC{
+		Flags:       ds.BCAPS_GETCURRENTPOSITION2 | ds.BCAPS_GLOBALFOCUS,
+		BufferBytes: bufferSize,
+		// The extensible format starts like a WAVEFORMATEX, formatTag tells
+		// DirectSound which one it is.
+		WfxFormat: (*ds.WAVEFORMATEX)(unsafe.Pointer(&format)),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return buffer, bufferSize, nil
+}
+
+// surroundOutput tells whether we output 5.1 or stereo.
+func (s *soundSystem) surroundOutput() bool {
+	return s.channels == speakerCount
+}
+
+func (s *soundSystem) underrunCount() int {
+	return s.underruns
+}
+
+// soundCounts returns how many sounds are mixed right now and how many are in
+// playingSounds, which also holds the queued ones that wait for their turn.
+func (s *soundSystem) soundCounts() (active, playing int) {
+	for i := range s.playingSounds {
+		if !s.playingSounds[i].queued {
+			active++
+		}
+	}
+	return active, len(s.playingSounds)
+}
+
 func (s *soundSystem) close() {
 	s.mixBuffer.Stop()
 	s.mixBuffer.Release()
 	s.dsound.Release()
 }
 
+// pause mutes all sound until resume is called. Playing sounds continue where
+// they left off.
+func (s *soundSystem) pause() error {
+	if s.paused {
+		return nil
+	}
+	s.paused = true
+	return s.mixBuffer.Stop()
+}
+
+func (s *soundSystem) resume() error {
+	if !s.paused {
+		return nil
+	}
+	s.paused = false
+	return s.mixBuffer.Play(0, ds.BPLAY_LOOPING)
+}
+
 func (s *soundSystem) stop(handle soundHandle) error {
 	for i := range s.playingSounds {
 		if handle == s.playingSounds[i].handle {
@@ -182,14 +300,92 @@ func (s *soundSystem) setSpeed(handle soundHandle, speed float64) error {
 	return fmt.Errorf("cannot set speed on unknown sound handle")
 }
 
+// setVolume scales the sound's loudness, 1 plays it as recorded.
+func (s *soundSystem) setVolume(handle soundHandle, volume float64) error {
+	if sound := s.soundFromHandle(handle); sound != nil {
+		sound.volume = volume
+		return nil
+	}
+	return fmt.Errorf("cannot set volume on unknown sound handle")
+}
+
+// addStem plays the file in sync with the sound and returns the new stem's
+// number for setStemVolume. The file should be as long as the sound, it is
+// silent after its end.
+func (s *soundSystem) addStem(handle soundHandle, path string) (int, error) {
+	sound := s.soundFromHandle(handle)
+	if sound == nil {
+		return 0, fmt.Errorf("cannot add stem to unknown sound handle")
+	}
+	raw, err := s.loadRawSamples(path)
+	if err != nil {
+		return 0, err
+	}
+	sound.stems = append(sound.stems, soundStem{samples: rawToSamples(raw), volume: 1})
+	return len(sound.stems), nil
+}
+
+// setStemVolume changes the volume of one of the sound's stems, 0 being the
+// sound itself. It is applied on top of the sound's volume.
+func (s *soundSystem) setStemVolume(handle soundHandle, stem int, volume float64) error {
+	sound := s.soundFromHandle(handle)
+	if sound == nil {
+		return fmt.Errorf("cannot set stem volume on unknown sound handle")
+	}
+	if stem == 0 {
+		sound.firstStemVolume = volume
+	} else if 1 <= stem && stem <= len(sound.stems) {
+		sound.stems[stem-1].volume = volume
+	} else {
+		return fmt.Errorf("sound has no stem %d", stem)
+	}
+	return nil
+}
+
+// setDirection makes the sound come from the azimuth, in turns clockwise
+// from where the listener looks: 0 is ahead, 0.25 is right and 0.5 behind.
+func (s *soundSystem) setDirection(handle soundHandle, azimuth float64) error {
+	sound := s.soundFromHandle(handle)
+	if sound == nil {
+		return fmt.Errorf("cannot set direction on unknown sound handle")
+	}
+	sound.positional = true
+	sound.gains = surroundGains(azimuth)
+	return nil
+}
+
+// setBus moves the sound to the bus, it then follows the bus's volume.
+func (s *soundSystem) setBus(handle soundHandle, bus soundBus) error {
+	if sound := s.soundFromHandle(handle); sound != nil {
+		sound.bus = bus
+		return nil
+	}
+	return fmt.Errorf("cannot set bus on unknown sound handle")
+}
+
+// setBusVolume scales all sounds on the bus, including ones that are already
+// playing. 1 leaves them as they are, 0 mutes them.
+func (s *soundSystem) setBusVolume(bus soundBus, volume float64) {
+	s.busVolumes[bus] = volume
+}
+
+// setMasterVolume scales all sounds, like setBusVolume for every bus.
+func (s *soundSystem) setMasterVolume(volume float64) {
+	s.masterVolume = volume
+}
+
 func (s *soundSystem) update() error {
+	if s.paused {
+		return nil
+	}
+
 	for i := range s.writeAheadMixBuffer {
 		for c := range s.writeAheadMixBuffer[i].channels {
 			s.writeAheadMixBuffer[i].channels[c] = 0
 		}
 	}
 
-	mem, err := s.mixBuffer.Lock(0, soundWriteAheadSize, ds.BLOCK_FROMWRITECURSOR)
+	mem, err := s.mixBuffer.Lock(0, uint32(soundWriteAheadSamples*s.frameSize), ds.BLOCK_FROMWRITECURSOR)
 	if err != nil {
 		return err
 	}
@@ -205,6 +401,9 @@ func (s *soundSystem) update() error {
 	// our current sound position and continue playing the sound from there at
 	// the updated current sound speed.
 	playedSamples := s.writeSampleDist(s.lastWritePos, writePos)
+	if playedSamples > soundWriteAheadSamples {
+		s.underruns++
+	}
 
 	for i := range s.playingSounds {
 		sound := &s.playingSounds[i]
@@ -217,6 +416,7 @@ func (s *soundSystem) update() error {
 		if sound.looping {
 			sound.pos = wrapSoundPos(sound.pos, len(sound.samples))
 		}
+		volume := sound.volume * s.busVolumes[sound.bus] * s.masterVolume
 
 		for i := range s.writeAheadMixBuffer {
 			pos := sound.pos + float64(i)*sound.speed
@@ -224,29 +424,37 @@ func (s *soundSystem) update() error {
 				pos = wrapSoundPos(pos, len(sound.samples))
 			}
 			j := round(pos)
+			mix := &s.writeAheadMixBuffer[i]
 			if 0 <= j && j < len(sound.samples) {
-				for c := range s.writeAheadMixBuffer[i].channels {
-					s.writeAheadMixBuffer[i].channels[c] +=
-						int32(sound.samples[j].channels[c])
+				sound.mix(mix, sound.samples[j], volume*sound.firstStemVolume)
+			}
+			for _, stem := range sound.stems {
+				if 0 <= j && j < len(stem.samples) {
+					sound.mix(mix, stem.samples[j], volume*stem.volume)
 				}
 			}
 		}
 	}
 
-	for i := range s.writeAheadBuffer {
-		for c := range s.writeAheadBuffer[i].channels {
-			x := s.writeAheadMixBuffer[i].channels[c]
-			if x > 32767 {
-				x = 32767
-			}
-			if x < -32768 {
-				x = -32768
+	clamp := func(x int32) int16 {
+		return int16(max(-32768, min(32767, x)))
+	}
+	for i, mix := range s.writeAheadMixBuffer {
+		out := s.writeAheadBuffer[i*s.channels : (i+1)*s.channels]
+		if s.surroundOutput() {
+			for c := range out {
+				out[c] = clamp(mix.channels[c])
 			}
-			s.writeAheadBuffer[i].channels[c] = int16(x)
+		} else {
+			left, right := downmixToStereo(mix.channels)
+			out[0], out[1] = clamp(left), clamp(right)
 		}
 	}
 	mem.WriteRaw(
-		0, unsafe.Pointer(&s.writeAheadBuffer[0]), len(s.writeAheadBuffer)*4)
+		0,
+		unsafe.Pointer(&s.writeAheadBuffer[0]),
+		soundWriteAheadSamples*s.frameSize,
+	)
 
 	if err := s.mixBuffer.Unlock(mem); err != nil {
 		return err
@@ -283,6 +491,23 @@ func (s *soundSystem) update() error {
 	return nil
 }
 
+// mix adds the sample at the volume to the 5.1 mix.
+func (sound *soundState) mix(mix *mixSample, sample soundSample, volume float64) {
+	left := float64(sample.channels[0]) * volume
+	right := float64(sample.channels[1]) * volume
+	if !sound.positional {
+		mix.channels[speakerFrontLeft] += int32(left)
+		mix.channels[speakerFrontRight] += int32(right)
+		return
+	}
+	mono := (left + right) / 2
+	for c, gain := range sound.gains {
+		if gain != 0 {
+			mix.channels[c] += int32(mono * gain)
+		}
+	}
+}
+
 func (s *soundSystem) soundFromHandle(handle soundHandle) *soundState {
 	for i := range s.playingSounds {
 		if handle == s.playingSounds[i].handle {
@@ -315,10 +540,10 @@ func (s *soundSystem) writeSampleDist(a, b int) int {
 	if d < 0 {
 		d = s.mixBufferSize - a + b
 	}
-	if d%4 != 0 {
+	if d%s.frameSize != 0 {
 		panic("why does the sound card play partial samples?")
 	}
-	return d / 4
+	return d / s.frameSize
 }
 
 func (s *soundSystem) play(path string) (soundHandle, error) {
@@ -343,43 +568,112 @@ func (s *soundSystem) preload(path string) error {
 	return err
 }
 
+// reload reads the sound file again. Sounds that are already playing keep
+// their old samples, only new ones use the reloaded file.
+func (s *soundSystem) reload(path string) error {
+	old, ok := s.loadedSounds[path]
+	delete(s.loadedSounds, path)
+	if _, err := s.loadRawSamples(path); err != nil {
+		if ok {
+			s.loadedSounds[path] = old
+		}
+		return err
+	}
+	return nil
+}
+
 func (s *soundSystem) playLoopingAndQueued(path string, looping, queued bool) (soundHandle, error) {
 	raw, err := s.loadRawSamples(path)
 	if err != nil {
 		return invalidSoundHandle, err
 	}
 
-	// We read raw bytes above but we know that a single sound sample consists
-	// of two int16, one for the left and one for the right channel. This makes
-	// 4 bytes, so we cast the raw sound data to an array of 4-byte items (we
-	// chose uint32).
-	// We can index this array to get samples to pass to the sound card.
-	samples := unsafe.Slice((*soundSample)(unsafe.Pointer(&raw[0])), len(raw)/4)
-
 	handle := s.nextHandle
 	s.nextHandle++
 
 	s.playingSounds = append(s.playingSounds, soundState{
-		handle:  handle,
-		samples: samples,
-		speed:   1,
-		looping: looping,
-		queued:  queued,
+		handle:          handle,
+		samples:         rawToSamples(raw),
+		speed:           1,
+		volume:          1,
+		looping:         looping,
+		queued:          queued,
+		firstStemVolume: 1,
 	})
 
 	return handle, nil
 }
 
+// rawToSamples returns the raw data as samples, without copying.
+func rawToSamples(raw []byte) []soundSample {
+	// We know that a single sound sample consists of two int16, one for the
+	// left and one for the right channel. This makes 4 bytes, so we cast the
+	// raw sound data to an array of 4-byte items.
+	// We can index this array to get samples to pass to the sound card.
+	return unsafe.Slice((*soundSample)(unsafe.Pointer(&raw[0])), len(raw)/4)
+}
+
+// preloadLowPass loads the sound and makes a muffled copy of it, which is
+// then available under filteredPath. It cuts the frequencies above cutoffHz.
+// A loop can crossfade between the two, e.g. as stems, to sound far away or
+// muted without needing a second recording.
+func (s *soundSystem) preloadLowPass(path, filteredPath string, cutoffHz float64) error {
+	if _, ok := s.loadedSounds[filteredPath]; ok {
+		return nil
+	}
+	raw, err := s.loadRawSamples(path)
+	if err != nil {
+		return err
+	}
+	filtered := make([]byte, len(raw))
+	lowPass(rawToSamples(raw), rawToSamples(filtered), cutoffHz)
+	s.loadedSounds[filteredPath] = filtered
+	return nil
+}
+
+// lowPass runs a one-pole low-pass filter over the samples. We run over the
+// sound twice and only keep the second run, so the filter starts with the
+// state from the end of the sound and loops do not click.
+func lowPass(samples, filtered []soundSample, cutoffHz float64) {
+	const dt = 1.0 / 44100
+	rc := 1 / (2 * math.Pi * cutoffHz)
+	alpha := dt / (rc + dt)
+	var y [2]float64
+	for run := range 2 {
+		for i, x := range samples {
+			for c := range y {
+				y[c] += alpha * (float64(x.channels[c]) - y[c])
+				if run == 1 {
+					filtered[i].channels[c] = int16(y[c])
+				}
+			}
+		}
+	}
+}
+
 func (s *soundSystem) loadRawSamples(path string) ([]byte, error) {
 	if samples, ok := s.loadedSounds[path]; ok {
 		return samples, nil
 	}
 
-	soundFile, err := assetFiles.ReadFile(path)
+	soundFile, err := readAsset(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rawSoundData, err := decodeSound(path, soundFile)
 	if err != nil {
 		return nil, err
 	}
 
+	s.loadedSounds[path] = rawSoundData
+
+	return s.loadedSounds[path], nil
+}
+
+// decodeSound converts the contents of a .raw, .ogg or .mp3 file to 16 bit
+// stereo samples at 44100 Hz. The file extension in path selects the format.
+func decodeSound(path string, soundFile []byte) ([]byte, error) {
 	var rawSoundData []byte
 
 	if strings.HasSuffix(path, ".raw") {
@@ -419,7 +713,5 @@ func (s *soundSystem) loadRawSamples(path string) ([]byte, error) {
 		return nil, fmt.Errorf("unknown file extension for %q", path)
 	}
 
-	s.loadedSounds[path] = rawSoundData
-
-	return s.loadedSounds[path], nil
+	return rawSoundData, nil
 }
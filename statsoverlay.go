@@ -0,0 +1,121 @@
+package main
+
+import (
+	"math"
+	"runtime/metrics"
+	"strconv"
+	"time"
+
+	m "github.com/gonutz/d3dmath/column_major/d3dmath"
+)
+
+// statsOverlay shows the frame counters, see frameCounters, and what the
+// sound system and the garbage collector are doing in the top-left corner.
+// F3 toggles it. Unlike -profile it needs no browser, so players can read the
+// numbers off a screenshot.
+type statsOverlay struct {
+	visible bool
+	// We read runtime/metrics for the same reason as allocationReport: it
+	// does not stop the world.
+	samples [2]metrics.Sample
+	// buf is reused for formatting the lines without allocating.
+	buf []byte
+}
+
+// overlayStats are the numbers that the overlay gets from the rest of the
+// game, on top of the frame counters.
+type overlayStats struct {
+	meshes        int
+	meshBytes     int
+	activeSounds  int
+	playingSounds int
+}
+
+func newStatsOverlay() *statsOverlay {
+	o := &statsOverlay{}
+	o.samples[0].Name = "/gc/cycles/total:gc-cycles"
+	o.samples[1].Name = "/sched/pauses/total/gc:seconds"
+	return o
+}
+
+// gc returns the number of GC cycles so far and the longest pause that they
+// caused. The runtime only keeps a histogram of the pauses, so the longest
+// pause is the upper end of its bucket.
+func (o *statsOverlay) gc() (cycles uint64, longestPause time.Duration) {
+	metrics.Read(o.samples[:])
+	if o.samples[0].Value.Kind() == metrics.KindUint64 {
+		cycles = o.samples[0].Value.Uint64()
+	}
+	if o.samples[1].Value.Kind() == metrics.KindFloat64Histogram {
+		h := o.samples[1].Value.Float64Histogram()
+		for i := len(h.Counts) - 1; i >= 0; i-- {
+			if h.Counts[i] > 0 {
+				// Buckets[i+1] is the upper end, the last one is +Inf.
+				end := h.Buckets[i+1]
+				if math.IsInf(end, 1) {
+					end = h.Buckets[i]
+				}
+				longestPause = time.Duration(end * float64(time.Second))
+				break
+			}
+		}
+	}
+	return
+}
+
+// draw adds the overlay to the HUD. The counters are lastCounters because the
+// current frame is still being counted.
+func (o *statsOverlay) draw(h *hud, stats overlayStats) {
+	const (
+		margin   = 10
+		textSize = 24
+		width    = 480
+		lines    = 6
+	)
+	h.rect(margin, margin, width, lines*textSize+2*margin, m.Vec4{0, 0, 0, 0.7})
+	x, y := float32(2*margin), float32(2*margin)
+	white := m.Vec4{1, 1, 1, 1}
+	line := func() {
+		h.textBytes(x, y, textSize, o.buf, white)
+		y += textSize
+	}
+
+	o.buf = append(o.buf[:0], "Draw calls: "...)
+	o.buf = strconv.AppendInt(o.buf, int64(lastCounters.drawCalls), 10)
+	line()
+
+	o.buf = append(o.buf[:0], "Triangles: "...)
+	o.buf = strconv.AppendInt(o.buf, int64(lastCounters.triangles), 10)
+	line()
+
+	o.buf = append(o.buf[:0], "Meshes: "...)
+	o.buf = strconv.AppendInt(o.buf, int64(stats.meshes), 10)
+	o.buf = append(o.buf, ", "...)
+	o.buf = strconv.AppendInt(o.buf, int64(stats.meshBytes/1024), 10)
+	o.buf = append(o.buf, " KB"...)
+	line()
+
+	o.buf = append(o.buf[:0], "Sounds: "...)
+	o.buf = strconv.AppendInt(o.buf, int64(stats.activeSounds), 10)
+	o.buf = append(o.buf, " active, "...)
+	o.buf = strconv.AppendInt(o.buf, int64(stats.playingSounds), 10)
+	o.buf = append(o.buf, " playing"...)
+	line()
+
+	cycles, pause := o.gc()
+	o.buf = append(o.buf[:0], "GC: "...)
+	o.buf = strconv.AppendUint(o.buf, cycles, 10)
+	o.buf = append(o.buf, " cycles, longest pause "...)
+	o.buf = appendMilliseconds(o.buf, pause)
+	line()
+
+	o.buf = append(o.buf[:0], "Input latency: "...)
+	o.buf = appendMilliseconds(o.buf, lastCounters.inputLatency)
+	line()
+}
+
+// appendMilliseconds formats d like "1.25 ms".
+func appendMilliseconds(buf []byte, d time.Duration) []byte {
+	buf = strconv.AppendFloat(buf, float64(d)/float64(time.Millisecond), 'f', 2, 64)
+	return append(buf, " ms"...)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"math"
+
+	m "github.com/gonutz/d3dmath/column_major/d3dmath"
+	"github.com/gonutz/ds"
+)
+
+// Our mixer works in 5.1: front left and right, center, low frequency effects
+// (LFE), back left and right, in the order that the channel mask below puts
+// them in the output. If the speakers are set up as stereo, we downmix
+// ourselves.
+const (
+	speakerFrontLeft = iota
+	speakerFrontRight
+	speakerCenter
+	speakerLFE
+	speakerBackLeft
+	speakerBackRight
+
+	speakerCount
+)
+
+// surroundChannelMask is KSAUDIO_SPEAKER_5POINT1.
+const surroundChannelMask = 0x3F
+
+// speakerAngles are the directions of the full range speakers, in turns
+// clockwise from ahead, going around the listener. The LFE channel has no
+// direction.
+var speakerAngles = [...]struct {
+	speaker int
+	angle   float64
+}{
+	{speakerCenter, 0},
+	{speakerFrontRight, 30.0 / 360},
+	{speakerBackRight, 110.0 / 360},
+	{speakerBackLeft, 250.0 / 360},
+	{speakerFrontLeft, 330.0 / 360},
+}
+
+// surroundGains pans a sound between the two speakers next to its azimuth, in
+// turns clockwise from ahead. The pan keeps the power constant.
+func surroundGains(azimuth float64) [speakerCount]float64 {
+	azimuth -= math.Floor(azimuth)
+	var gains [speakerCount]float64
+	for i, a := range speakerAngles {
+		b := speakerAngles[(i+1)%len(speakerAngles)]
+		end := b.angle
+		if end < a.angle {
+			end++
+		}
+		az := azimuth
+		if az < a.angle {
+			az++
+		}
+		if a.angle <= az && az <= end {
+			t := (az - a.angle) / (end - a.angle)
+			gains[b.speaker], gains[a.speaker] = math.Sincos(t * math.Pi / 2)
+			return gains
+		}
+	}
+	gains[speakerCenter] = 1
+	return gains
+}
+
+// listenerAzimuth is the direction of pos for a listener at eye who looks at
+// target, in turns clockwise from ahead, as seen from above.
+func listenerAzimuth(eye, target, pos m.Vec3) float64 {
+	forward := target.Sub(eye)
+	forward[1] = 0
+	right := m.Vec3{0, 1, 0}.Cross(forward)
+	rel := pos.Sub(eye)
+	angle := math.Atan2(float64(rel.Dot(right)), float64(rel.Dot(forward)))
+	return angle / (2 * math.Pi)
+}
+
+// downmixToStereo folds the 5.1 channels into left and right, like the ITU
+// recommends. The LFE channel is dropped.
+func downmixToStereo(c [speakerCount]int32) (left, right int32) {
+	const half = 0.7071
+	center := float32(c[speakerCenter]) * half
+	left = c[speakerFrontLeft] + int32(center+float32(c[speakerBackLeft])*half)
+	right = c[speakerFrontRight] + int32(center+float32(c[speakerBackRight])*half)
+	return
+}
+
+// ksDataFormatSubtypePCM is KSDATAFORMAT_SUBTYPE_PCM, the sub format for
+// integer samples.
+var ksDataFormatSubtypePCM = ds.GUID{
+	Data1: 0x00000001,
+	Data2: 0x0000,
+	Data3: 0x0010,
+	Data4: [8]byte{0x80, 0x00, 0x00, 0xAA, 0x00, 0x38, 0x9B, 0x71},
+}
+
+// waveFormatTagExtensible is WAVE_FORMAT_EXTENSIBLE.
+const waveFormatTagExtensible = 0xFFFE
+
+// waveFormatExtensible is WAVEFORMATEXTENSIBLE, which describes formats with
+// more than two channels. It starts with the fields of ds.WAVEFORMATEX but we
+// cannot embed that, Go would pad it from 18 to 20 bytes. The one in package
+// ds has the wrong size.
+type waveFormatExtensible struct {
+	formatTag          uint16
+	channels           uint16
+	samplesPerSec      uint32
+	avgBytesPerSec     uint32
+	blockAlign         uint16
+	bitsPerSample      uint16
+	size               uint16
+	validBitsPerSample uint16
+	channelMask        uint32
+	subFormat          ds.GUID
+}
+
+// isSurroundSpeakerConfig tells whether the speaker config from DirectSound
+// is one of the 5.1 setups.
+func isSurroundSpeakerConfig(config uint32) bool {
+	switch config & 0xFF {
+	case ds.SPEAKER_5POINT1, ds.SPEAKER_5POINT1_SURROUND:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+	"unsafe"
+
+	"github.com/gonutz/w32/v2"
+)
+
+// windowIconSize is the size of the big window icon, which Windows scales down
+// for the small one.
+const windowIconSize = 32
+
+// createWindowIcon cuts the joker's face out of its texture, it is the window
+// and taskbar icon.
+func createWindowIcon() (w32.HICON, error) {
+	data, err := readAsset("assets/joker.jpg")
+	if err != nil {
+		return 0, err
+	}
+	// readImage gives us BGRA pixels, which is what icons use.
+	img, err := readImage(data)
+	if err != nil {
+		return 0, err
+	}
+
+	// The face is rotated by 90 degrees in the texture, its top points to
+	// the left, see drawDialogueBox.
+	const u0, v0, u1, v1 = 0.5125, 0.5325, 0.6125, 0.6325
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	colors := make([]byte, 4*windowIconSize*windowIconSize)
+	for y := range windowIconSize {
+		for x := range windowIconSize {
+			fx := (float64(x) + 0.5) / windowIconSize
+			fy := (float64(y) + 0.5) / windowIconSize
+			u := u0 + fy*(u1-u0)
+			v := v1 - fx*(v1-v0)
+			src := img.PixOffset(int(u*float64(w)), int(v*float64(h)))
+			dest := 4 * (y*windowIconSize + x)
+			copy(colors[dest:dest+3], img.Pix[src:src+3])
+			colors[dest+3] = 255
+		}
+	}
+	// All 0 bits in the AND mask make the whole icon opaque.
+	mask := make([]byte, windowIconSize*windowIconSize/8)
+
+	icon := w32.CreateIcon(0, windowIconSize, windowIconSize, 1, 32, &mask[0], &colors[0])
+	if icon == 0 {
+		return 0, errors.New("CreateIcon failed")
+	}
+	return icon, nil
+}
+
+func setWindowIcon(window w32.HWND, icon w32.HICON) {
+	w32.SendMessage(window, w32.WM_SETICON, w32.ICON_BIG, uintptr(icon))
+	w32.SendMessage(window, w32.WM_SETICON, w32.ICON_SMALL, uintptr(icon))
+}
+
+var flashWindowEx = syscall.NewLazyDLL("user32.dll").NewProc("FlashWindowEx")
+
+type flashInfo struct {
+	size    uint32
+	window  w32.HWND
+	flags   uint32
+	count   uint32
+	timeout uint32
+}
+
+const (
+	flashStop = 0
+	// flashTray flashes the taskbar button until it is stopped.
+	flashTray = 0x2 | 0x4
+)
+
+// flashTaskbar makes the window's taskbar button blink to get the user's
+// attention, or stops the blinking.
+func flashTaskbar(window w32.HWND, on bool) {
+	info := flashInfo{window: window, flags: flashStop}
+	info.size = uint32(unsafe.Sizeof(info))
+	if on {
+		info.flags = flashTray
+	}
+	flashWindowEx.Call(uintptr(unsafe.Pointer(&info)))
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gonutz/d3d9"
+)
+
+// telemetry collects statistics about a single play session to help us
+// balance the levels. It is opt-in, see settings.Telemetry. If it is disabled,
+// all its methods do nothing.
+type telemetry struct {
+	enabled  bool
+	endpoint string
+	start    time.Time
+	stats    sessionStats
+}
+
+// sessionStats is what gets written to disk and POSTed to the endpoint.
+type sessionStats struct {
+	Start           time.Time `json:"start"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	// PlayTimeSeconds is the time spent actually playing a level, as opposed
+	// to the intro sequence.
+	PlayTimeSeconds float64 `json:"playTimeSeconds"`
+	Deaths          int     `json:"deaths"`
+	Completed       bool    `json:"completed"`
+	// Seed is the session's random seed, see the -seed flag.
+	Seed uint64 `json:"seed"`
+	// Stages lists the game states in the order they were reached.
+	Stages   []stageStats `json:"stages"`
+	Hardware hardwareCaps `json:"hardware"`
+}
+
+type stageStats struct {
+	Name string `json:"name"`
+	// ReachedAfterSeconds is measured from the start of the session.
+	ReachedAfterSeconds float64 `json:"reachedAfterSeconds"`
+}
+
+type hardwareCaps struct {
+	Adapter             string `json:"adapter"`
+	VendorID            uint32 `json:"vendorId"`
+	DeviceID            uint32 `json:"deviceId"`
+	MaxTextureWidth     uint32 `json:"maxTextureWidth"`
+	MaxTextureHeight    uint32 `json:"maxTextureHeight"`
+	VertexShaderVersion string `json:"vertexShaderVersion"`
+	PixelShaderVersion  string `json:"pixelShaderVersion"`
+	HardwareTnL         bool   `json:"hardwareTnL"`
+}
+
+func newTelemetry(s settings) *telemetry {
+	now := time.Now()
+	return &telemetry{
+		enabled:  s.Telemetry,
+		endpoint: s.TelemetryEndpoint,
+		start:    now,
+		stats:    sessionStats{Start: now},
+	}
+}
+
+func (t *telemetry) recordHardware(id d3d9.ADAPTER_IDENTIFIER, caps d3d9.CAPS) {
+	if !t.enabled {
+		return
+	}
+	shaderVersion := func(v uint32) string {
+		return fmt.Sprintf("%d.%d", (v>>8)&0xFF, v&0xFF)
+	}
+	t.stats.Hardware = hardwareCaps{
+		Adapter:             id.GetDescription(),
+		VendorID:            id.VendorId,
+		DeviceID:            id.DeviceId,
+		MaxTextureWidth:     caps.MaxTextureWidth,
+		MaxTextureHeight:    caps.MaxTextureHeight,
+		VertexShaderVersion: shaderVersion(caps.VertexShaderVersion),
+		PixelShaderVersion:  shaderVersion(caps.PixelShaderVersion),
+		HardwareTnL:         caps.DevCaps&d3d9.DEVCAPS_HWTRANSFORMANDLIGHT != 0,
+	}
+}
+
+func (t *telemetry) recordStage(name string) {
+	if !t.enabled {
+		return
+	}
+	t.stats.Stages = append(t.stats.Stages, stageStats{
+		Name:                name,
+		ReachedAfterSeconds: time.Since(t.start).Seconds(),
+	})
+}
+
+// addPlayTime is called every frame while a level is being played.
+func (t *telemetry) addPlayTime(d time.Duration) {
+	if !t.enabled {
+		return
+	}
+	t.stats.PlayTimeSeconds += d.Seconds()
+}
+
+func (t *telemetry) recordSeed(seed uint64) {
+	if !t.enabled {
+		return
+	}
+	t.stats.Seed = seed
+}
+
+func (t *telemetry) recordDeath() {
+	if !t.enabled {
+		return
+	}
+	t.stats.Deaths++
+}
+
+func (t *telemetry) recordCompletion() {
+	if !t.enabled {
+		return
+	}
+	t.stats.Completed = true
+}
+
+// finish writes the session statistics to the telemetry folder in the data
+// directory and, if an endpoint is configured, POSTs them there.
+func (t *telemetry) finish() error {
+	if !t.enabled {
+		return nil
+	}
+
+	t.stats.DurationSeconds = time.Since(t.start).Seconds()
+	data, err := json.MarshalIndent(t.stats, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	dir, err := dataDir()
+	if err != nil {
+		return err
+	}
+	dir = filepath.Join(dir, "telemetry")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	name := "session_" + t.start.Format("2006-01-02_15-04-05") + ".json"
+	if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+		return err
+	}
+
+	if t.endpoint == "" {
+		return nil
+	}
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Post(t.endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("telemetry endpoint returned %s", resp.Status)
+	}
+	return nil
+}
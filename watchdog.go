@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/gonutz/w32/v2"
+)
+
+// watchdog notices when the main loop stops running, e.g. because Present
+// blocks in the driver or the mixer deadlocked. The main loop calls tick every
+// iteration. If there was no tick for the timeout, the watchdog writes the
+// stacks of all goroutines to stderr and to hang.log in our data directory,
+// then optionally asks the user whether to keep waiting or quit.
+//
+// All methods can be called on a nil watchdog, which does nothing. This is what
+// startWatchdog returns when the watchdog is disabled.
+type watchdog struct {
+	timeout    time.Duration
+	showDialog bool
+	// lastTick is the time of the last tick in Unix nanoseconds. It is 0
+	// before the first tick and while paused.
+	lastTick atomic.Int64
+	stopped  atomic.Bool
+}
+
+// mainLoopWatchdog watches the main loop. It is global so reportFatalError can
+// stop it while the crash dialog is open.
+var mainLoopWatchdog *watchdog
+
+func startWatchdog(timeout time.Duration, showDialog bool) *watchdog {
+	if timeout <= 0 {
+		return nil
+	}
+	w := &watchdog{timeout: timeout, showDialog: showDialog}
+	go w.run()
+	return w
+}
+
+// tick tells the watchdog that the main loop is alive. The first tick starts
+// the watchdog, loading the game before that may take as long as it needs.
+func (w *watchdog) tick() {
+	if w != nil && !w.stopped.Load() {
+		w.lastTick.Store(time.Now().UnixNano())
+	}
+}
+
+// pause stops the watchdog until the next tick. Modal loops like dragging the
+// window or the controller settings dialog keep our main loop from running
+// without the game being stuck.
+func (w *watchdog) pause() {
+	if w != nil {
+		w.lastTick.Store(0)
+	}
+}
+
+// stop ends the watchdog for good, ticks do not start it again. After a crash
+// the main loop never runs again, which is not a hang.
+func (w *watchdog) stop() {
+	if w != nil {
+		w.stopped.Store(true)
+		w.lastTick.Store(0)
+	}
+}
+
+func (w *watchdog) run() {
+	// reported is the tick that we last reported a hang for, we report every
+	// hang only once.
+	var reported int64
+	for range time.Tick(w.timeout / 4) {
+		if w.stopped.Load() {
+			return
+		}
+		last := w.lastTick.Load()
+		if last == 0 || last == reported {
+			continue
+		}
+		stalled := time.Since(time.Unix(0, last))
+		if stalled >= w.timeout {
+			reported = last
+			w.reportHang(stalled)
+		}
+	}
+}
+
+func (w *watchdog) reportHang(stalled time.Duration) {
+	report := fmt.Sprintf(
+		"%s: the main loop has not run for %v\n\n%s",
+		time.Now().Format(time.DateTime),
+		stalled.Round(time.Millisecond),
+		allStacks(),
+	)
+	fmt.Fprintln(os.Stderr, report)
+
+	details := ""
+	if dir, err := dataDir(); err == nil {
+		path := filepath.Join(dir, "hang.log")
+		if os.WriteFile(path, []byte(report), 0666) == nil {
+			details = "\n\nDetails were written to " + path
+		}
+	}
+
+	if w.showDialog {
+		choice := w32.MessageBox(
+			0,
+			"The game is not responding.\n\n"+
+				"Click Retry to keep waiting or Cancel to quit the game."+
+				details,
+			errorDialogCaption,
+			w32.MB_RETRYCANCEL|w32.MB_ICONWARNING|w32.MB_TOPMOST,
+		)
+		if choice == w32.IDCANCEL {
+			// The main goroutine is stuck, it cannot clean up anyway.
+			os.Exit(1)
+		}
+	}
+}
+
+// allStacks returns the stack traces of all goroutines.
+func allStacks() []byte {
+	buf := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}